@@ -0,0 +1,77 @@
+// Command quotesim runs a simulated quote server for developing and testing
+// the transaction server without the course quote server. Point the
+// transaction server at it with the quoteaddr and quoteport environment
+// variables.
+//
+// Usage:
+//		quotesim [-addr :4444] [-model fixed|walk|replay] [-price 12.50]
+//			[-step 0.25] [-replay prices.csv] [-latency 50ms] [-jitter 20ms]
+//			[-droprate 0.01] [-garbagerate 0.01] [-seed 1]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"seng468/transaction-server/quotesim"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func main() {
+	addr := flag.String("addr", ":4444", "address to listen on")
+	model := flag.String("model", "fixed", "price model: fixed, walk or replay")
+	price := flag.String("price", "12.50", "fixed price, starting price of a walk, or price of stocks missing from a replay")
+	step := flag.String("step", "0.25", "largest move of a random walk on each quote")
+	replay := flag.String("replay", "", "replay script of stock,price lines, for the replay model")
+	latency := flag.Duration("latency", 0, "delay before every reply")
+	jitter := flag.Duration("jitter", 0, "random extra delay of up to this long before every reply")
+	dropRate := flag.Float64("droprate", 0, "chance of closing the connection instead of replying")
+	garbageRate := flag.Float64("garbagerate", 0, "chance of sending a malformed reply")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed for random prices, latency and failures")
+	flag.Parse()
+
+	start, err := decimal.NewFromString(*price)
+	if err != nil || !start.IsPositive() {
+		fail("price must be a positive number")
+	}
+
+	var prices quotesim.PriceModel
+	switch *model {
+	case "fixed":
+		prices = quotesim.Fixed{Quote: start}
+	case "walk":
+		move, err := decimal.NewFromString(*step)
+		if err != nil || move.IsNegative() {
+			fail("step must be a number that isn't negative")
+		}
+		prices = quotesim.NewRandomWalk(start, move, *seed)
+	case "replay":
+		script, err := os.Open(*replay)
+		if err != nil {
+			fail(err.Error())
+		}
+		prices, err = quotesim.NewReplay(script, start)
+		script.Close()
+		if err != nil {
+			fail(err.Error())
+		}
+	default:
+		fail("unknown price model " + *model)
+	}
+
+	server := quotesim.NewServer(prices, *seed)
+	server.Latency = *latency
+	server.Jitter = *jitter
+	server.DropRate = *dropRate
+	server.GarbageRate = *garbageRate
+
+	fmt.Printf("Simulating the quote server on %s with %s prices\n", *addr, *model)
+	fail(server.ListenAndServe(*addr).Error())
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, "quotesim:", msg)
+	os.Exit(1)
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"seng468/transaction-server/logger"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// AuditedDatabase is a UserDatabase that logs an accountTransaction event for
+// every change it makes to a user's funds, with the amount actually moved.
+// Funds are "add"ed to and "remove"d from a user's balance, and "reserve"d
+// and "unreserve"d in their reserve account. Each AuditedDatabase is bound to
+// the transaction its changes are logged as.
+type AuditedDatabase struct {
+	UserDatabase
+
+	logger   logger.Logger
+	server   string
+	transNum int
+}
+
+// NewAuditedDatabase returns db, logging its changes to funds as the server
+// for the transaction
+func NewAuditedDatabase(db UserDatabase, logger logger.Logger, server string, transNum int) AuditedDatabase {
+	return AuditedDatabase{
+		UserDatabase: db,
+		logger:       logger,
+		server:       server,
+		transNum:     transNum,
+	}
+}
+
+// ForTransaction returns the database, logging its changes to funds for the
+// transaction instead
+func (a AuditedDatabase) ForTransaction(transNum int) AuditedDatabase {
+	a.transNum = transNum
+	return a
+}
+
+// AddFunds logs the amount "add"ed to the user's funds
+func (a AuditedDatabase) AddFunds(user string, amount decimal.Decimal) error {
+	err := a.UserDatabase.AddFunds(user, amount)
+	if err == nil {
+		a.log("add", user, amount)
+	}
+	return err
+}
+
+// RemoveFunds logs the amount "remove"d from the user's funds
+func (a AuditedDatabase) RemoveFunds(user string, amount decimal.Decimal) error {
+	err := a.UserDatabase.RemoveFunds(user, amount)
+	if err == nil {
+		a.log("remove", user, amount)
+	}
+	return err
+}
+
+// AddReserveFunds logs the amount "reserve"d, without touching the user's funds
+func (a AuditedDatabase) AddReserveFunds(user string, amount decimal.Decimal) error {
+	err := a.UserDatabase.AddReserveFunds(user, amount)
+	if err == nil {
+		a.log("reserve", user, amount)
+	}
+	return err
+}
+
+// RemoveReserveFunds logs the amount "unreserve"d, without touching the user's
+// funds
+func (a AuditedDatabase) RemoveReserveFunds(user string, amount decimal.Decimal) error {
+	err := a.UserDatabase.RemoveReserveFunds(user, amount)
+	if err == nil {
+		a.log("unreserve", user, amount)
+	}
+	return err
+}
+
+// ReserveFunds logs the amount "remove"d from the user's funds and "reserve"d
+func (a AuditedDatabase) ReserveFunds(user string, amount decimal.Decimal) (decimal.Decimal, error) {
+	balance, err := a.UserDatabase.ReserveFunds(user, amount)
+	if err == nil {
+		a.log("remove", user, amount)
+		a.log("reserve", user, amount)
+	}
+	return balance, err
+}
+
+// UnreserveFunds logs the amount "unreserve"d and "add"ed back to the user's funds
+func (a AuditedDatabase) UnreserveFunds(user string, amount decimal.Decimal) error {
+	err := a.UserDatabase.UnreserveFunds(user, amount)
+	if err == nil {
+		a.log("unreserve", user, amount)
+		a.log("add", user, amount)
+	}
+	return err
+}
+
+// PlaceBuy logs the cost of the buy "remove"d from the user's funds
+func (a AuditedDatabase) PlaceBuy(user string, stock string, cost decimal.Decimal,
+	shares decimal.Decimal) (decimal.Decimal, error) {
+	balance, err := a.UserDatabase.PlaceBuy(user, stock, cost, shares)
+	if err == nil {
+		a.log("remove", user, cost)
+	}
+	return balance, err
+}
+
+// CancelBuy logs the cost of the buy "add"ed back to the user's funds
+func (a AuditedDatabase) CancelBuy(user string) (string, decimal.Decimal, decimal.Decimal, error) {
+	stock, cost, shares, err := a.UserDatabase.CancelBuy(user)
+	if err == nil {
+		a.log("add", user, cost)
+	}
+	return stock, cost, shares, err
+}
+
+// CommitSell logs the proceeds of the sale "add"ed to the user's funds
+func (a AuditedDatabase) CommitSell(user string) (string, decimal.Decimal, decimal.Decimal, error) {
+	stock, cost, shares, err := a.UserDatabase.CommitSell(user)
+	if err == nil {
+		a.log("add", user, cost)
+	}
+	return stock, cost, shares, err
+}
+
+// ExpireOrders logs the cost of each expired buy "add"ed back to its user's
+// funds. An expiry isn't part of any command, so each order is given a new
+// transaction number to be logged as, or the database's own number if one
+// can't be assigned.
+func (a AuditedDatabase) ExpireOrders(now time.Time) ([]ExpiredOrder, error) {
+	expired, err := a.UserDatabase.ExpireOrders(now)
+	for i, exp := range expired {
+		transNum, numErr := a.UserDatabase.NextTransNum()
+		if numErr != nil {
+			transNum = a.transNum
+		}
+		expired[i].TransNum = transNum
+		if exp.Type == "Buy" {
+			a.ForTransaction(transNum).log("add", exp.User, exp.Order.Cost)
+		}
+	}
+	return expired, err
+}
+
+// FillBuyTrigger logs the funds "unreserve"d, and the change left after the
+// cost of the buy "add"ed back to the user's funds
+func (a AuditedDatabase) FillBuyTrigger(user string, stock string, reserved decimal.Decimal,
+	cost decimal.Decimal, shares decimal.Decimal) error {
+	err := a.UserDatabase.FillBuyTrigger(user, stock, reserved, cost, shares)
+	if err == nil {
+		a.log("unreserve", user, reserved)
+		a.log("add", user, fromCents(toCents(reserved)-toCents(cost)))
+	}
+	return err
+}
+
+// FillSellTrigger logs the proceeds of the sale "add"ed to the user's funds
+func (a AuditedDatabase) FillSellTrigger(user string, stock string, shares decimal.Decimal,
+	proceeds decimal.Decimal) error {
+	err := a.UserDatabase.FillSellTrigger(user, stock, shares, proceeds)
+	if err == nil {
+		a.log("add", user, proceeds)
+	}
+	return err
+}
+
+// log records the amount moved, as the database stores it, unless nothing
+// was moved
+func (a AuditedDatabase) log(action string, user string, amount decimal.Decimal) {
+	moved := fromCents(toCents(amount))
+	if moved.IsZero() {
+		return
+	}
+	a.logger.Log(logger.AccountTransaction{
+		Server:         a.server,
+		TransactionNum: a.transNum,
+		Action:         action,
+		Username:       user,
+		Funds:          moved,
+	})
+}
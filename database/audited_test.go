@@ -0,0 +1,89 @@
+package database
+
+import (
+	"seng468/transaction-server/logger"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// transactionLogger records the account transactions logged to it
+type transactionLogger struct {
+	transactions []string
+}
+
+func (l *transactionLogger) Log(event logger.Event) {
+	if e, ok := event.(logger.AccountTransaction); ok {
+		l.transactions = append(l.transactions, e.Action+" "+e.Username+" "+e.Funds.String())
+	}
+}
+
+func (*transactionLogger) DumpLog(string, string) {}
+
+func TestAuditedDatabase(t *testing.T) {
+	log := &transactionLogger{}
+	mem := NewMemoryDatabase()
+	db := NewAuditedDatabase(mem, log, "transactionserve", 1)
+	dollars := decimal.RequireFromString
+
+	db.AddFunds("bob", dollars("100"))
+	db.RemoveFunds("bob", dollars("10.004"))
+	db.AddReserveFunds("bob", dollars("10"))
+	db.RemoveReserveFunds("bob", dollars("10"))
+	db.ReserveFunds("bob", dollars("5"))
+	db.ReserveFunds("bob", dollars("500"))
+	db.RemoveReserveFunds("bob", dollars("5"))
+	db.AddFunds("bob", dollars("5"))
+	db.ReserveFunds("bob", dollars("10"))
+	db.UnreserveFunds("bob", dollars("20"))
+	db.UnreserveFunds("bob", dollars("10"))
+	db.ReserveFunds("bob", dollars("10"))
+	db.FillBuyTrigger("bob", "ABC", dollars("10"), dollars("9.50"), dollars("1"))
+	db.PlaceBuy("bob", "ABC", dollars("25"), dollars("2"))
+	db.CancelBuy("bob")
+	db.AddStock("bob", "ABC", dollars("2"))
+	db.PlaceSell("bob", "ABC", dollars("20"), dollars("2"))
+	db.CommitSell("bob")
+	db.ReserveStock("bob", "ABC", dollars("1"))
+	db.FillSellTrigger("bob", "ABC", dollars("1"), dollars("12"))
+	// Nothing moved, so nothing is logged
+	db.AddFunds("bob", dollars("0"))
+	db.CommitBuy("bob")
+
+	mem.AddFunds("al", dollars("5"))
+	mem.PlaceBuy("al", "ABC", dollars("5"), dollars("1"))
+	// Expiries aren't part of any command, so are assigned their own number
+	if expired, _ := db.ExpireOrders(time.Now().Add(2 * OrderTimeout)); len(expired) != 1 || expired[0].TransNum != 1 {
+		t.Error("Expected the expired buy to be assigned transaction 1, got", expired)
+	}
+
+	expected := []string{
+		"add bob 100",
+		"remove bob 10",
+		"reserve bob 10",
+		"unreserve bob 10",
+		"remove bob 5",
+		"reserve bob 5",
+		"unreserve bob 5",
+		"add bob 5",
+		"remove bob 10",
+		"reserve bob 10",
+		"unreserve bob 10",
+		"add bob 10",
+		"remove bob 10",
+		"reserve bob 10",
+		"unreserve bob 10",
+		"add bob 0.5",
+		"remove bob 25",
+		"add bob 25",
+		"add bob 20",
+		"add bob 12",
+		"add al 5",
+	}
+	if strings.Join(log.transactions, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected account transactions:\n%s\ngot:\n%s", strings.Join(expected, "\n"),
+			strings.Join(log.transactions, "\n"))
+	}
+}
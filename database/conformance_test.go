@@ -0,0 +1,515 @@
+package database
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestMemoryDatabaseConformance(t *testing.T) {
+	testConformance(t, NewMemoryDatabase())
+}
+
+func TestRedisDatabaseConformance(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	if _, err := db.GetFunds("conformance"); err != nil {
+		t.Skip("redis is unavailable:", err)
+	}
+	testConformance(t, db)
+}
+
+// testConformance checks the behaviour every UserDatabase must share, so the
+// in memory database can stand in for redis. Each run uses new user names,
+// so it can be run against a database that already holds data.
+func testConformance(t *testing.T, db UserDatabase) {
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user := func(name string) string {
+		return "conformance-" + run + "-" + name
+	}
+	dollars := func(amount string) decimal.Decimal {
+		d, _ := decimal.NewFromString(amount)
+		return d
+	}
+	quantity := func(shares string) decimal.Decimal {
+		d, _ := decimal.NewFromString(shares)
+		return d
+	}
+
+	t.Run("Funds", func(t *testing.T) {
+		u := user("funds")
+		funds, err := db.GetFunds(u)
+		if err != nil || !funds.Equal(dollars("0")) {
+			t.Error("A new user should have no funds, got", funds, err)
+		}
+		db.AddFunds(u, dollars("23.01"))
+		db.RemoveFunds(u, dollars("3.01"))
+		funds, _ = db.GetFunds(u)
+		if !funds.Equal(dollars("20")) {
+			t.Error("Expected 20 funds, got", funds)
+		}
+
+		db.AddReserveFunds(u, dollars("5.50"))
+		db.RemoveReserveFunds(u, dollars("2.25"))
+		reserved, err := db.GetReserveFunds(u)
+		if err != nil || !reserved.Equal(dollars("3.25")) {
+			t.Error("Expected 3.25 reserved funds, got", reserved, err)
+		}
+
+		info, err := db.GetUserInfo(u)
+		if err != nil || !info.Balance.Equal(funds) || !info.BalanceReserve.Equal(reserved) {
+			t.Errorf("User info doesn't match funds: %+v %v", info, err)
+		}
+	})
+
+	t.Run("Stocks", func(t *testing.T) {
+		u := user("stocks")
+		held, err := db.GetStock(u, "ABC")
+		if err != nil || !held.Equal(quantity("0")) {
+			t.Error("A new user should hold no stock, got", held, err)
+		}
+		db.AddStock(u, "ABC", quantity("10"))
+		db.RemoveStock(u, "ABC", quantity("4"))
+		db.AddStock(u, "XYZ", quantity("1"))
+		db.AddReserveStock(u, "ABC", quantity("3"))
+		db.RemoveReserveStock(u, "ABC", quantity("1"))
+
+		held, _ = db.GetStock(u, "ABC")
+		reserved, _ := db.GetReserveStock(u, "ABC")
+		if !held.Equal(quantity("6")) || !reserved.Equal(quantity("2")) {
+			t.Error("Expected 6 held and 2 reserved, got", held, reserved)
+		}
+
+		info, _ := db.GetUserInfo(u)
+		if len(info.Stocks) != 2 || !info.Stocks["ABC"].Equal(quantity("6")) ||
+			!info.Stocks["XYZ"].Equal(quantity("1")) {
+			t.Error("User info doesn't match stocks:", info.Stocks)
+		}
+		if len(info.StocksReserve) != 1 || !info.StocksReserve["ABC"].Equal(quantity("2")) {
+			t.Error("User info doesn't match reserved stocks:", info.StocksReserve)
+		}
+	})
+
+	t.Run("OrderStacks", func(t *testing.T) {
+		u := user("stacks")
+		db.PushBuy(u, "ABC", dollars("10"), quantity("1"))
+		db.PushBuy(u, "XYZ", dollars("20.50"), quantity("2"))
+		db.PushSell(u, "DEF", dollars("5"), quantity("5"))
+
+		info, _ := db.GetUserInfo(u)
+		if len(info.BuyOrders) != 2 || info.BuyOrders[0].Stock != "ABC" || info.BuyOrders[1].Stock != "XYZ" {
+			t.Error("Buy orders should be listed oldest first:", info.BuyOrders)
+		}
+		if len(info.SellOrders) != 1 || info.SellOrders[0].Timestamp == 0 {
+			t.Error("Sell order should be listed with its timestamp:", info.SellOrders)
+		}
+
+		stock, cost, shares, err := db.PopBuy(u)
+		if err != nil || stock != "XYZ" || !cost.Equal(dollars("20.50")) || !shares.Equal(quantity("2")) {
+			t.Error("Most recent buy should be popped first, got", stock, cost, shares, err)
+		}
+		stock, _, _, _ = db.PopBuy(u)
+		if stock != "ABC" {
+			t.Error("Oldest buy should be popped last, got", stock)
+		}
+		_, _, _, err = db.PopBuy(u)
+		if err != ErrNoPendingOrder {
+			t.Error("Popping an empty stack should fail, got", err)
+		}
+		stock, _, _, err = db.PopSell(u)
+		if err != nil || stock != "DEF" {
+			t.Error("Sell should be popped, got", stock, err)
+		}
+
+		funds, _ := db.GetFunds(u)
+		held, _ := db.GetStock(u, "ABC")
+		if !funds.Equal(dollars("0")) || !held.Equal(quantity("0")) {
+			t.Error("Popping orders shouldn't credit the account, have", funds, held)
+		}
+	})
+
+	t.Run("Buy", func(t *testing.T) {
+		u := user("buy")
+		db.AddFunds(u, dollars("10"))
+		_, err := db.PlaceBuy(u, "ABC", dollars("20"), quantity("2"))
+		if err != ErrInsufficientFunds {
+			t.Error("Buy should fail with insufficient funds, got", err)
+		}
+
+		balance, err := db.PlaceBuy(u, "ABC", dollars("8"), quantity("2"))
+		if err != nil || !balance.Equal(dollars("2")) {
+			t.Error("Expected 2 remaining funds, got", balance, err)
+		}
+		stock, cost, shares, err := db.CommitBuy(u)
+		if err != nil || stock != "ABC" || !cost.Equal(dollars("8")) || !shares.Equal(quantity("2")) {
+			t.Error("Wrong buy committed", stock, cost, shares, err)
+		}
+		held, _ := db.GetStock(u, "ABC")
+		if !held.Equal(quantity("2")) {
+			t.Error("Shares should be added on commit, have", held)
+		}
+
+		db.PlaceBuy(u, "ABC", dollars("1.50"), quantity("1"))
+		_, _, _, err = db.CancelBuy(u)
+		funds, _ := db.GetFunds(u)
+		if err != nil || !funds.Equal(dollars("2")) {
+			t.Error("Cost should be refunded on cancel, have", funds, err)
+		}
+		_, _, _, err = db.CommitBuy(u)
+		if err != ErrNoPendingOrder {
+			t.Error("Commit with no pending buy should fail, got", err)
+		}
+	})
+
+	t.Run("Sell", func(t *testing.T) {
+		u := user("sell")
+		db.AddStock(u, "ABC", quantity("5"))
+		_, err := db.PlaceSell(u, "ABC", dollars("60"), quantity("6"))
+		if err != ErrInsufficientStock {
+			t.Error("Sell should fail with insufficient stock, got", err)
+		}
+
+		held, err := db.PlaceSell(u, "ABC", dollars("40"), quantity("4"))
+		if err != nil || !held.Equal(quantity("1")) {
+			t.Error("Expected 1 remaining share, got", held, err)
+		}
+		_, _, _, err = db.CommitSell(u)
+		funds, _ := db.GetFunds(u)
+		if err != nil || !funds.Equal(dollars("40")) {
+			t.Error("Proceeds should be added on commit, have", funds, err)
+		}
+
+		db.PlaceSell(u, "ABC", dollars("10"), quantity("1"))
+		_, _, _, err = db.CancelSell(u)
+		held, _ = db.GetStock(u, "ABC")
+		if err != nil || !held.Equal(quantity("1")) {
+			t.Error("Shares should be returned on cancel, have", held, err)
+		}
+		_, _, _, err = db.CancelSell(u)
+		if err != ErrNoPendingOrder {
+			t.Error("Cancel with no pending sell should fail, got", err)
+		}
+	})
+
+	t.Run("FractionalShares", func(t *testing.T) {
+		u := user("fractional")
+		db.AddStock(u, "ABC", quantity("2.5"))
+		held, err := db.PlaceSell(u, "ABC", dollars("3.33"), quantity("0.333333"))
+		if err != nil || !held.Equal(quantity("2.166667")) {
+			t.Error("Expected 2.166667 remaining shares, got", held, err)
+		}
+		_, _, shares, err := db.CancelSell(u)
+		held, _ = db.GetStock(u, "ABC")
+		if err != nil || !shares.Equal(quantity("0.333333")) || !held.Equal(quantity("2.5")) {
+			t.Error("Fractional shares should be returned on cancel, have", shares, held, err)
+		}
+
+		db.AddFunds(u, dollars("10"))
+		db.PlaceBuy(u, "ABC", dollars("1.23"), quantity("0.1234567"))
+		_, _, shares, err = db.CommitBuy(u)
+		held, _ = db.GetStock(u, "ABC")
+		if err != nil || !shares.Equal(quantity("0.123457")) || !held.Equal(quantity("2.623457")) {
+			t.Error("Shares should be rounded to the share unit, have", shares, held, err)
+		}
+
+		db.AddReserveStock(u, "ABC", quantity("0.75"))
+		db.AddHistory(u, HistoryEntry{1, 1, "COMMIT_BUY", "ABC", dollars("1.23"), quantity("0.5")})
+		info, _ := db.GetUserInfo(u)
+		if !info.StocksReserve["ABC"].Equal(quantity("0.75")) || len(info.History) != 1 ||
+			!info.History[0].Shares.Equal(quantity("0.5")) {
+			t.Errorf("User info should keep fractional shares, got %+v", info)
+		}
+	})
+
+	t.Run("Reserve", func(t *testing.T) {
+		u := user("reserve")
+		db.AddFunds(u, dollars("10"))
+		db.AddStock(u, "ABC", quantity("3"))
+		_, err := db.ReserveFunds(u, dollars("10.01"))
+		if err != ErrInsufficientFunds {
+			t.Error("Reserve should fail with insufficient funds, got", err)
+		}
+		_, err = db.ReserveStock(u, "ABC", quantity("3.5"))
+		if err != ErrInsufficientStock {
+			t.Error("Reserve should fail with insufficient stock, got", err)
+		}
+
+		balance, err := db.ReserveFunds(u, dollars("7.50"))
+		if err != nil || !balance.Equal(dollars("2.50")) {
+			t.Error("Expected 2.50 remaining funds, got", balance, err)
+		}
+		held, err := db.ReserveStock(u, "ABC", quantity("1.5"))
+		if err != nil || !held.Equal(quantity("1.5")) {
+			t.Error("Expected 1.5 remaining shares, got", held, err)
+		}
+		funds, _ := db.GetReserveFunds(u)
+		shares, _ := db.GetReserveStock(u, "ABC")
+		if !funds.Equal(dollars("7.50")) || !shares.Equal(quantity("1.5")) {
+			t.Error("Expected 7.50 and 1.5 shares reserved, have", funds, shares)
+		}
+
+		if err = db.UnreserveFunds(u, dollars("7.51")); err != ErrInsufficientFunds {
+			t.Error("Unreserve should fail when the reserve doesn't hold the funds, got", err)
+		}
+		if err = db.UnreserveStock(u, "ABC", quantity("1.6")); err != ErrInsufficientStock {
+			t.Error("Unreserve should fail when the reserve doesn't hold the shares, got", err)
+		}
+		err = db.UnreserveFunds(u, dollars("7.50"))
+		if err == nil {
+			err = db.UnreserveStock(u, "ABC", quantity("1.5"))
+		}
+		funds, _ = db.GetFunds(u)
+		held, _ = db.GetStock(u, "ABC")
+		if err != nil || !funds.Equal(dollars("10")) || !held.Equal(quantity("3")) {
+			t.Error("Expected the reserve returned, have", funds, held, err)
+		}
+		funds, _ = db.GetReserveFunds(u)
+		shares, _ = db.GetReserveStock(u, "ABC")
+		if !funds.IsZero() || !shares.IsZero() {
+			t.Error("Expected nothing left reserved, have", funds, shares)
+		}
+	})
+
+	t.Run("ZeroQuantities", func(t *testing.T) {
+		u := user("zero")
+		db.AddFunds(u, dollars("10"))
+		db.AddStock(u, "ABC", quantity("2"))
+		balance, err := db.ReserveFunds(u, dollars("0"))
+		if err != nil || !balance.Equal(dollars("10")) {
+			t.Error("Reserving no funds should leave the balance, got", balance, err)
+		}
+		held, err := db.ReserveStock(u, "ABC", quantity("0"))
+		if err != nil || !held.Equal(quantity("2")) {
+			t.Error("Reserving no shares should leave the holding, got", held, err)
+		}
+		held, err = db.PlaceSell(u, "ABC", dollars("0"), quantity("0"))
+		if err != nil || !held.Equal(quantity("2")) {
+			t.Error("Selling no shares should leave the holding, got", held, err)
+		}
+		db.CancelSell(u)
+		err = db.FillSellTrigger(u, "ABC", quantity("0"), dollars("0"))
+		held, _ = db.GetStock(u, "ABC")
+		if err != nil || !held.Equal(quantity("2")) {
+			t.Error("Filling a sell of no shares should leave the holding, got", held, err)
+		}
+	})
+
+	t.Run("FillTriggers", func(t *testing.T) {
+		u := user("fill")
+		db.AddFunds(u, dollars("50"))
+		db.AddStock(u, "ABC", quantity("10"))
+		db.ReserveFunds(u, dollars("30"))
+		db.ReserveStock(u, "XYZ", quantity("0"))
+		db.ReserveStock(u, "ABC", quantity("4"))
+
+		err := db.FillBuyTrigger(u, "XYZ", dollars("30.01"), dollars("30"), quantity("3"))
+		if err != ErrInsufficientFunds {
+			t.Error("Fill should fail when the reserve doesn't cover it, got", err)
+		}
+		err = db.FillBuyTrigger(u, "XYZ", dollars("30"), dollars("28.50"), quantity("3"))
+		funds, _ := db.GetFunds(u)
+		reserved, _ := db.GetReserveFunds(u)
+		held, _ := db.GetStock(u, "XYZ")
+		if err != nil || !funds.Equal(dollars("21.50")) || !reserved.Equal(dollars("0")) ||
+			!held.Equal(quantity("3")) {
+			t.Error("Buy should take the reserve and return the change, have", funds, reserved, held, err)
+		}
+
+		err = db.FillSellTrigger(u, "ABC", quantity("4.5"), dollars("45"))
+		if err != ErrInsufficientStock {
+			t.Error("Fill should fail when the reserve doesn't hold the shares, got", err)
+		}
+		err = db.FillSellTrigger(u, "ABC", quantity("3"), dollars("36"))
+		funds, _ = db.GetFunds(u)
+		shares, _ := db.GetReserveStock(u, "ABC")
+		held, _ = db.GetStock(u, "ABC")
+		if err != nil || !funds.Equal(dollars("57.50")) || !shares.Equal(quantity("0")) ||
+			!held.Equal(quantity("7")) {
+			t.Error("Sell should empty the reserve and add the proceeds, have", funds, shares, held, err)
+		}
+	})
+
+	t.Run("ConcurrentReserves", func(t *testing.T) {
+		u := user("concurrent-reserve")
+		db.AddFunds(u, dollars("10"))
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		reserved := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := db.ReserveFunds(u, dollars("1")); err == nil {
+					mu.Lock()
+					reserved++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		funds, _ := db.GetFunds(u)
+		if reserved != 10 || !funds.Equal(dollars("0")) {
+			t.Error("Exactly 10 reserves should succeed, got", reserved, "leaving", funds)
+		}
+	})
+
+	t.Run("ConcurrentBuys", func(t *testing.T) {
+		u := user("concurrent")
+		db.AddFunds(u, dollars("25"))
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		placed := 0
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := db.PlaceBuy(u, "ABC", dollars("1"), quantity("1")); err == nil {
+					mu.Lock()
+					placed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		funds, _ := db.GetFunds(u)
+		if placed != 25 || !funds.Equal(dollars("0")) {
+			t.Error("Exactly 25 buys should be placed, got", placed, "leaving", funds)
+		}
+	})
+
+	t.Run("ExpireOrders", func(t *testing.T) {
+		u := user("expire")
+		db.AddFunds(u, dollars("10"))
+		db.AddStock(u, "ABC", quantity("3"))
+		db.PlaceBuy(u, "ABC", dollars("8"), quantity("2"))
+		db.PlaceSell(u, "ABC", dollars("30"), quantity("3"))
+
+		userOrders := func(expired []ExpiredOrder) (orders []ExpiredOrder) {
+			for _, order := range expired {
+				if order.User == u {
+					orders = append(orders, order)
+				}
+			}
+			return orders
+		}
+		expired, err := db.ExpireOrders(time.Now())
+		if err != nil || len(userOrders(expired)) != 0 {
+			t.Error("Orders should not expire before the timeout", expired, err)
+		}
+
+		expired, err = db.ExpireOrders(time.Now().Add(OrderTimeout + time.Second))
+		orders := userOrders(expired)
+		if err != nil || len(orders) != 2 || orders[0].Type != "Buy" || orders[1].Type != "Sell" {
+			t.Error("Buy and sell should have expired", orders, err)
+		}
+		funds, _ := db.GetFunds(u)
+		held, _ := db.GetStock(u, "ABC")
+		if !funds.Equal(dollars("10")) || !held.Equal(quantity("3")) {
+			t.Error("Expired orders should be refunded, have", funds, held)
+		}
+		_, _, _, err = db.CommitBuy(u)
+		if err != ErrNoPendingOrder {
+			t.Error("Expired buy should no longer be pending, got", err)
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		u := user("history")
+		for i := 1; i <= historyLength+5; i++ {
+			db.AddHistory(u, HistoryEntry{int64(i), i, "ADD", "", dollars("1.25"), quantity("0")})
+		}
+		info, _ := db.GetUserInfo(u)
+		if len(info.History) != historyLength {
+			t.Fatal("Expected", historyLength, "entries, got", len(info.History))
+		}
+		first, last := info.History[0], info.History[historyLength-1]
+		if first.TransNum != 6 || last.TransNum != historyLength+5 {
+			t.Error("Only the most recent entries should be kept, got", first, last)
+		}
+		if last.Command != "ADD" || !last.Funds.Equal(dollars("1.25")) || last.Timestamp != historyLength+5 {
+			t.Error("Entry should be stored unchanged, got", last)
+		}
+	})
+
+	t.Run("Triggers", func(t *testing.T) {
+		u := user("trigger,user")
+		saved := TriggerRecord{"BUY", u, "ABC", 7, dollars("100"), dollars("12.5"), false}
+		db.SaveTrigger(saved)
+		saved.Active = true
+		db.SaveTrigger(saved)
+		db.SaveTrigger(TriggerRecord{"SELL", u, "ABC", 8, dollars("10"), dollars("0"), false})
+
+		userTriggers := func() map[string]TriggerRecord {
+			trigs, err := db.GetTriggers()
+			if err != nil {
+				t.Error(err)
+			}
+			found := make(map[string]TriggerRecord)
+			for _, trig := range trigs {
+				if trig.User == u {
+					found[trig.Type] = trig
+				}
+			}
+			return found
+		}
+		found := userTriggers()
+		buy := found["BUY"]
+		if len(found) != 2 || buy.Stock != "ABC" || !buy.Active || buy.TransNum != 7 ||
+			!buy.BuySellAmount.Equal(saved.BuySellAmount) || !buy.TriggerAmount.Equal(saved.TriggerAmount) {
+			t.Error("Saved triggers were not restored", found)
+		}
+
+		db.DeleteTrigger("BUY", u, "ABC")
+		found = userTriggers()
+		if _, ok := found["BUY"]; ok || len(found) != 1 {
+			t.Error("Only the buy trigger should have been deleted", found)
+		}
+		db.DeleteTrigger("SELL", u, "ABC")
+	})
+
+	t.Run("Reserves", func(t *testing.T) {
+		u := user("reserves")
+		db.AddReserveFunds(u, dollars("15"))
+		db.AddReserveStock(u, "ABC", quantity("4"))
+		reserves, err := db.GetReserves()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reserves.Funds[u].Equal(dollars("15")) || !reserves.Stocks[u]["ABC"].Equal(quantity("4")) {
+			t.Error("Reserves should be listed, got", reserves.Funds[u], reserves.Stocks[u])
+		}
+		if _, ok := reserves.Funds[user("stocks")]; ok {
+			t.Error("Users without a funds reserve shouldn't be listed")
+		}
+	})
+
+	t.Run("TransNums", func(t *testing.T) {
+		first, err := db.NextTransNum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		claimed, _ := db.ClaimTransNum(first)
+		if claimed {
+			t.Error("An assigned transaction number shouldn't be claimable")
+		}
+		claimed, _ = db.ClaimTransNum(first + 1)
+		if !claimed {
+			t.Error("An unused transaction number should be claimable")
+		}
+		claimed, _ = db.ClaimTransNum(first + 1)
+		if claimed {
+			t.Error("A claimed transaction number shouldn't be claimable twice")
+		}
+		next, _ := db.NextTransNum()
+		if next <= first+1 {
+			t.Error("Claimed transaction numbers should be skipped, got", next)
+		}
+		for _, transNum := range []int{0, MaxTransNum + 1, 1 << 32} {
+			if _, err := db.ClaimTransNum(transNum); err != ErrTransNumRange {
+				t.Error("Claiming", transNum, "should be out of range, got", err)
+			}
+		}
+	})
+}
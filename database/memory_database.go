@@ -0,0 +1,538 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// MemoryDatabase is a UserDatabase held entirely in memory, for running the
+// server and its tests without redis. It behaves the same as RedisDatabase,
+// but loses everything when the process exits.
+type MemoryDatabase struct {
+	mu            sync.Mutex
+	users         map[string]*memoryUser
+	pending       map[string]bool
+	triggers      map[string]TriggerRecord
+	lastTransNum  int
+	usedTransNums TransNumBits
+}
+
+// memoryUser is everything the database holds for one user. Balances are in
+// cents and holdings in share units, as RedisDatabase stores them. The reserve
+// balance is a pointer so a reserve that has been touched is kept, even at
+// zero, as redis keeps the key.
+type memoryUser struct {
+	balance        int64
+	balanceReserve *int64
+	stocks         map[string]int64
+	stocksReserve  map[string]int64
+	buyOrders      []Order
+	sellOrders     []Order
+	history        []HistoryEntry
+}
+
+// NewMemoryDatabase returns an empty MemoryDatabase
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		users:    make(map[string]*memoryUser),
+		pending:  make(map[string]bool),
+		triggers: make(map[string]TriggerRecord),
+	}
+}
+
+// user returns the record for a user, creating it if they're new.
+// The caller must hold the lock.
+func (m *MemoryDatabase) user(user string) *memoryUser {
+	u, ok := m.users[user]
+	if !ok {
+		u = &memoryUser{
+			stocks:        make(map[string]int64),
+			stocksReserve: make(map[string]int64),
+		}
+		m.users[user] = u
+	}
+	return u
+}
+
+// GetUserInfo returns all of a users information in the database
+func (m *MemoryDatabase) GetUserInfo(user string) (info UserInfo, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+
+	info.Balance = fromCents(u.balance)
+	if u.balanceReserve != nil {
+		info.BalanceReserve = fromCents(*u.balanceReserve)
+	}
+	info.Stocks = holdings(u.stocks)
+	info.StocksReserve = holdings(u.stocksReserve)
+	info.BuyOrders = append(info.BuyOrders, u.buyOrders...)
+	info.SellOrders = append(info.SellOrders, u.sellOrders...)
+	info.History = append(info.History, u.history...)
+	return info, nil
+}
+
+// holdings converts share units held of each stock into quantities of shares
+func holdings(units map[string]int64) map[string]decimal.Decimal {
+	held := make(map[string]decimal.Decimal)
+	for stock, n := range units {
+		held[stock] = fromUnits(n)
+	}
+	return held
+}
+
+// AddHistory records a completed transaction in the user's history,
+// keeping only the most recent entries
+func (m *MemoryDatabase) AddHistory(user string, entry HistoryEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	u.history = append(u.history, entry)
+	if len(u.history) > historyLength {
+		u.history = u.history[len(u.history)-historyLength:]
+	}
+	return nil
+}
+
+// AddFunds adds amount dollars to the user account
+func (m *MemoryDatabase) AddFunds(user string, amount decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user(user).balance += toCents(amount)
+	return nil
+}
+
+// GetFunds returns the amount of available funds in a users account
+func (m *MemoryDatabase) GetFunds(user string) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fromCents(m.user(user).balance), nil
+}
+
+// RemoveFunds remove n funds from the user's account
+// amount is the absolute value of the funds being removed
+func (m *MemoryDatabase) RemoveFunds(user string, amount decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user(user).balance -= toCents(amount)
+	return nil
+}
+
+// AddReserveFunds adds funds to a user's reserve account
+func (m *MemoryDatabase) AddReserveFunds(user string, amount decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addReserveFunds(m.user(user), toCents(amount))
+	return nil
+}
+
+// GetReserveFunds returns the amount of funds present in a user's reserve account
+func (m *MemoryDatabase) GetReserveFunds(user string) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	if u.balanceReserve == nil {
+		return decimal.Decimal{}, nil
+	}
+	return fromCents(*u.balanceReserve), nil
+}
+
+// RemoveReserveFunds removes funds from a user's reserve account
+func (m *MemoryDatabase) RemoveReserveFunds(user string, amount decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addReserveFunds(m.user(user), -toCents(amount))
+	return nil
+}
+
+func (m *MemoryDatabase) addReserveFunds(u *memoryUser, cents int64) {
+	reserve := cents
+	if u.balanceReserve != nil {
+		reserve += *u.balanceReserve
+	}
+	u.balanceReserve = &reserve
+}
+
+// AddStock adds shares to the user account
+func (m *MemoryDatabase) AddStock(user string, stock string, shares decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user(user).stocks[stock] += toUnits(shares)
+	return nil
+}
+
+// GetStock returns the users available balance of said stock
+func (m *MemoryDatabase) GetStock(user string, stock string) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fromUnits(m.user(user).stocks[stock]), nil
+}
+
+// RemoveStock removes shares of stock from the users account
+// Send the absolute value of the stock being removed
+func (m *MemoryDatabase) RemoveStock(user string, stock string, amount decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user(user).stocks[stock] -= toUnits(amount)
+	return nil
+}
+
+// AddReserveStock adds n shares of stock to a user's account
+func (m *MemoryDatabase) AddReserveStock(user string, stock string, shares decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user(user).stocksReserve[stock] += toUnits(shares)
+	return nil
+}
+
+// GetReserveStock returns the amount of shares present in a user's reserve account
+func (m *MemoryDatabase) GetReserveStock(user string, stock string) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fromUnits(m.user(user).stocksReserve[stock]), nil
+}
+
+// RemoveReserveStock removes n shares of stock from a user's reserve account
+func (m *MemoryDatabase) RemoveReserveStock(user string, stock string, amount decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user(user).stocksReserve[stock] -= toUnits(amount)
+	return nil
+}
+
+// ReserveFunds atomically moves an amount from the user's funds into their
+// reserve account. Returns the user's remaining funds.
+// Returns ErrInsufficientFunds if the user doesn't have the amount.
+func (m *MemoryDatabase) ReserveFunds(user string, amount decimal.Decimal) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	if u.balance < toCents(amount) {
+		return decimal.Decimal{}, ErrInsufficientFunds
+	}
+	u.balance -= toCents(amount)
+	m.addReserveFunds(u, toCents(amount))
+	return fromCents(u.balance), nil
+}
+
+// ReserveStock atomically moves shares of the stock from the user's account
+// into their reserve account. Returns the number of shares the user has left.
+// Returns ErrInsufficientStock if the user doesn't hold enough shares.
+func (m *MemoryDatabase) ReserveStock(user string, stock string, shares decimal.Decimal) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	if u.stocks[stock] < toUnits(shares) {
+		return decimal.Decimal{}, ErrInsufficientStock
+	}
+	u.stocks[stock] -= toUnits(shares)
+	u.stocksReserve[stock] += toUnits(shares)
+	return fromUnits(u.stocks[stock]), nil
+}
+
+// UnreserveFunds atomically moves an amount out of the user's reserve
+// account back into their funds.
+// Returns ErrInsufficientFunds if the reserve doesn't hold the amount.
+func (m *MemoryDatabase) UnreserveFunds(user string, amount decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	var reserve int64
+	if u.balanceReserve != nil {
+		reserve = *u.balanceReserve
+	}
+	if reserve < toCents(amount) {
+		return ErrInsufficientFunds
+	}
+	m.addReserveFunds(u, -toCents(amount))
+	u.balance += toCents(amount)
+	return nil
+}
+
+// UnreserveStock atomically moves shares of the stock out of the user's
+// reserve account back into their account.
+// Returns ErrInsufficientStock if the reserve doesn't hold the shares.
+func (m *MemoryDatabase) UnreserveStock(user string, stock string, shares decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	if u.stocksReserve[stock] < toUnits(shares) {
+		return ErrInsufficientStock
+	}
+	u.stocksReserve[stock] -= toUnits(shares)
+	u.stocks[stock] += toUnits(shares)
+	return nil
+}
+
+// PushBuy adds a record of the users requested buy to their account
+// Expires after OrderTimeout
+func (m *MemoryDatabase) PushBuy(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pushOrder(&m.user(user).buyOrders, user, stock, cost, shares)
+	return nil
+}
+
+// PopBuy removes a users most recent requested buy
+// Returns ErrOrderExpired if it is older than OrderTimeout
+func (m *MemoryDatabase) PopBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return m.settleOrder(user, "Buy", "None")
+}
+
+// PushSell adds a record of the users requested sell to their account
+// Expires after OrderTimeout
+func (m *MemoryDatabase) PushSell(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pushOrder(&m.user(user).sellOrders, user, stock, cost, shares)
+	return nil
+}
+
+// PopSell removes a users most recent requested sell
+// Returns ErrOrderExpired if it is older than OrderTimeout
+func (m *MemoryDatabase) PopSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return m.settleOrder(user, "Sell", "None")
+}
+
+// PlaceBuy atomically removes the cost of a buy from the user's funds and
+// pushes it as their most recent pending buy. Returns the user's remaining funds.
+// Returns ErrInsufficientFunds if the user can't afford it.
+func (m *MemoryDatabase) PlaceBuy(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	if u.balance < toCents(cost) {
+		return decimal.Decimal{}, ErrInsufficientFunds
+	}
+	u.balance -= toCents(cost)
+	m.pushOrder(&u.buyOrders, user, stock, cost, shares)
+	return fromCents(u.balance), nil
+}
+
+// CommitBuy atomically pops the user's most recent pending buy and adds the
+// purchased shares to their account.
+// Returns ErrNoPendingOrder if there is no buy to commit, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (m *MemoryDatabase) CommitBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return m.settleOrder(user, "Buy", "Stock")
+}
+
+// CancelBuy atomically pops the user's most recent pending buy and refunds
+// its cost to their account.
+// Returns ErrNoPendingOrder if there is no buy to cancel, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (m *MemoryDatabase) CancelBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return m.settleOrder(user, "Buy", "Funds")
+}
+
+// PlaceSell atomically removes the shares being sold from the user's account
+// and pushes it as their most recent pending sell. Returns the number of
+// shares of the stock the user has left.
+// Returns ErrInsufficientStock if the user doesn't hold enough shares.
+func (m *MemoryDatabase) PlaceSell(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) (decimal.Decimal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	if u.stocks[stock] < toUnits(shares) {
+		return decimal.Decimal{}, ErrInsufficientStock
+	}
+	u.stocks[stock] -= toUnits(shares)
+	m.pushOrder(&u.sellOrders, user, stock, cost, shares)
+	return fromUnits(u.stocks[stock]), nil
+}
+
+// CommitSell atomically pops the user's most recent pending sell and adds
+// the sale proceeds to their account.
+// Returns ErrNoPendingOrder if there is no sell to commit, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (m *MemoryDatabase) CommitSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return m.settleOrder(user, "Sell", "Funds")
+}
+
+// CancelSell atomically pops the user's most recent pending sell and returns
+// the shares to their account.
+// Returns ErrNoPendingOrder if there is no sell to cancel, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (m *MemoryDatabase) CancelSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return m.settleOrder(user, "Sell", "Stock")
+}
+
+// ExpireOrders removes every pending order placed more than OrderTimeout
+// before now, refunding the cost of expired buys and the shares of expired
+// sells. Returns the orders that expired.
+func (m *MemoryDatabase) ExpireOrders(now time.Time) ([]ExpiredOrder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := timestamp(now.Add(-OrderTimeout))
+	var expired []ExpiredOrder
+	for user := range m.pending {
+		u := m.user(user)
+		for len(u.buyOrders) > 0 && u.buyOrders[0].Timestamp < cutoff {
+			order := u.buyOrders[0]
+			u.buyOrders = u.buyOrders[1:]
+			u.balance += toCents(order.Cost)
+			expired = append(expired, ExpiredOrder{User: user, Type: "Buy", Order: order})
+		}
+		for len(u.sellOrders) > 0 && u.sellOrders[0].Timestamp < cutoff {
+			order := u.sellOrders[0]
+			u.sellOrders = u.sellOrders[1:]
+			u.stocks[order.Stock] += toUnits(order.Shares)
+			expired = append(expired, ExpiredOrder{User: user, Type: "Sell", Order: order})
+		}
+		if len(u.buyOrders) == 0 && len(u.sellOrders) == 0 {
+			delete(m.pending, user)
+		}
+	}
+	return expired, nil
+}
+
+// pushOrder appends an order placed now to the user's orders, with its cost
+// rounded to the cent and its shares to the share unit. The caller must hold
+// the lock.
+func (m *MemoryDatabase) pushOrder(orders *[]Order, user string, stock string, cost decimal.Decimal, shares decimal.Decimal) {
+	*orders = append(*orders, Order{stock, fromCents(toCents(cost)), fromUnits(toUnits(shares)), timestamp(time.Now())})
+	m.pending[user] = true
+}
+
+// settleOrder pops the user's most recent buy or sell order, and credits
+// either its cost to the balance, its shares to the stocks account, or
+// nothing, the same as settleOrderScript
+func (m *MemoryDatabase) settleOrder(user string, transType string,
+	credit string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+
+	var orders *[]Order
+	if transType == "Buy" {
+		orders = &u.buyOrders
+	} else if transType == "Sell" {
+		orders = &u.sellOrders
+	} else {
+		return stock, cost, shares, errors.New("Bad transaction type of " + transType)
+	}
+	if len(*orders) == 0 {
+		return stock, cost, shares, ErrNoPendingOrder
+	}
+	order := (*orders)[len(*orders)-1]
+	if order.Timestamp < timestamp(time.Now().Add(-OrderTimeout)) {
+		return stock, cost, shares, ErrOrderExpired
+	}
+
+	*orders = (*orders)[:len(*orders)-1]
+	if credit == "Funds" {
+		u.balance += toCents(order.Cost)
+	} else if credit == "Stock" {
+		u.stocks[order.Stock] += toUnits(order.Shares)
+	}
+	return order.Stock, order.Cost, order.Shares, nil
+}
+
+// FillBuyTrigger atomically settles an executed buy trigger, taking the
+// funds reserved for it from the user's reserve account, returning what's
+// left after its cost to their funds, and adding the shares bought.
+// Returns ErrInsufficientFunds if the reserve doesn't hold the reserved funds.
+func (m *MemoryDatabase) FillBuyTrigger(user string, stock string, reserved decimal.Decimal,
+	cost decimal.Decimal, shares decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	if u.balanceReserve == nil || *u.balanceReserve < toCents(reserved) {
+		return ErrInsufficientFunds
+	}
+	m.addReserveFunds(u, -toCents(reserved))
+	u.balance += toCents(reserved) - toCents(cost)
+	u.stocks[stock] += toUnits(shares)
+	return nil
+}
+
+// FillSellTrigger atomically settles an executed sell trigger, emptying the
+// user's reserve of the stock, returning any shares that weren't sold to
+// their account, and adding the proceeds to their funds.
+// Returns ErrInsufficientStock if the reserve doesn't hold the shares sold.
+func (m *MemoryDatabase) FillSellTrigger(user string, stock string, shares decimal.Decimal,
+	proceeds decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.user(user)
+	reserved := u.stocksReserve[stock]
+	if reserved < toUnits(shares) {
+		return ErrInsufficientStock
+	}
+	u.stocksReserve[stock] = 0
+	u.stocks[stock] += reserved - toUnits(shares)
+	u.balance += toCents(proceeds)
+	return nil
+}
+
+// SaveTrigger stores or replaces a user's trigger for a stock
+func (m *MemoryDatabase) SaveTrigger(trig TriggerRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.triggers[triggerKey(trig.Type, trig.User, trig.Stock)] = trig
+	return nil
+}
+
+// DeleteTrigger removes a user's saved trigger for a stock
+func (m *MemoryDatabase) DeleteTrigger(triggerType string, user string, stock string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.triggers, triggerKey(triggerType, user, stock))
+	return nil
+}
+
+// GetTriggers returns every saved trigger
+func (m *MemoryDatabase) GetTriggers() ([]TriggerRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var trigs []TriggerRecord
+	for _, trig := range m.triggers {
+		trigs = append(trigs, trig)
+	}
+	return trigs, nil
+}
+
+// GetReserves returns the reserve accounts of all users
+func (m *MemoryDatabase) GetReserves() (Reserves, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reserves := Reserves{
+		Funds:  make(map[string]decimal.Decimal),
+		Stocks: make(map[string]map[string]decimal.Decimal),
+	}
+	for user, u := range m.users {
+		if u.balanceReserve != nil {
+			reserves.Funds[user] = fromCents(*u.balanceReserve)
+		}
+		if len(u.stocksReserve) > 0 {
+			reserves.Stocks[user] = holdings(u.stocksReserve)
+		}
+	}
+	return reserves, nil
+}
+
+// NextTransNum returns a transaction number that hasn't been used
+func (m *MemoryDatabase) NextTransNum() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastTransNum++
+	for m.lastTransNum <= MaxTransNum && m.usedTransNums.Set(m.lastTransNum) {
+		m.lastTransNum++
+	}
+	return m.lastTransNum, nil
+}
+
+// ClaimTransNum marks a client supplied transaction number as used,
+// returning false if it had already been assigned or claimed
+func (m *MemoryDatabase) ClaimTransNum(transNum int) (bool, error) {
+	if transNum < 1 || transNum > MaxTransNum {
+		return false, ErrTransNumRange
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.usedTransNums.Set(transNum), nil
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/shopspring/decimal"
+)
+
+// Balances are stored as integer cents and only ever changed with INCRBY,
+// so they never pick up floating point error. They have their own key
+// suffixes so keys holding dollars from before can be told apart and migrated.
+const (
+	balanceSuffix        = ":BalanceCents"
+	balanceReserveSuffix = ":BalanceReserveCents"
+
+	legacyBalanceSuffix        = ":Balance"
+	legacyBalanceReserveSuffix = ":BalanceReserve"
+)
+
+// toCents converts an amount of money to whole cents, rounding any fraction
+// of a cent to the nearest cent
+func toCents(amount decimal.Decimal) int64 {
+	return amount.Shift(2).Round(0).IntPart()
+}
+
+// fromCents converts whole cents back to an amount of money
+func fromCents(cents int64) decimal.Decimal {
+	return decimal.New(cents, -2)
+}
+
+// luaToFixed is prepended to scripts that need the cents in an order's cost,
+// or the share units in its shares. Amounts are converted from their decimal
+// string to an integer string by moving the point, rather than with tonumber,
+// so they are exact however large they get.
+const luaToFixed = `
+local function to_fixed(amount, places)
+	local sign, whole, frac = string.match(amount, '^(-?)(%d*)%.?(%d*)$')
+	if not whole then
+		return '0'
+	end
+	frac = string.sub(frac .. string.rep('0', places), 1, places)
+	local digits = string.gsub(whole .. frac, '^0+', '')
+	if digits == '' then
+		return '0'
+	end
+	return sign .. digits
+end
+`
+
+// migrateFundsScript moves a balance stored in dollars by INCRBYFLOAT into
+// its cents key, rounding away any drift it had picked up. The cents are
+// read from the balance's digits, and rounded half away from zero on the
+// digit after them, so large balances aren't rounded through a float. It's
+// added to anything already in the cents key, and the dollars key is
+// removed, so it is safe to run repeatedly and from more than one server at
+// once.
+// KEYS: legacy dollars key, cents key
+var migrateFundsScript = redis.NewScript(2, luaToFixed+`
+local dollars = redis.call('GET', KEYS[1])
+if not dollars then
+	return 0
+end
+local sign, whole, frac = string.match(dollars, '^(-?)(%d*)%.?(%d*)$')
+if not whole then
+	return redis.error_reply('invalid balance ' .. dollars .. ' in ' .. KEYS[1])
+end
+redis.call('INCRBY', KEYS[2], to_fixed(dollars, 2))
+if string.sub(frac, 3, 3) >= '5' then
+	redis.call('INCRBY', KEYS[2], sign .. '1')
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// MigrateFunds converts every balance and reserve balance stored in dollars
+// by earlier versions of the server to cents. Returns the number of
+// balances migrated.
+func (u RedisDatabase) MigrateFunds() (int, error) {
+	conn := u.getConn()
+	defer conn.Close()
+
+	migrated := 0
+	for legacy, suffix := range map[string]string{
+		legacyBalanceSuffix:        balanceSuffix,
+		legacyBalanceReserveSuffix: balanceReserveSuffix,
+	} {
+		keys, err := u.scanKeys(conn, "*"+legacy)
+		if err != nil {
+			return migrated, err
+		}
+		for _, key := range keys {
+			n, err := redis.Int(migrateFundsScript.Do(conn, key, strings.TrimSuffix(key, legacy)+suffix))
+			if err != nil {
+				return migrated, err
+			}
+			migrated += n
+		}
+	}
+	return migrated, nil
+}
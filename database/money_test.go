@@ -0,0 +1,144 @@
+package database
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// driftOps is how many random fund operations the drift tests run
+const driftOps = 1000000
+
+func TestCentsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < driftOps; i++ {
+		cents := r.Int63n(1e13) - 5e12
+		if toCents(fromCents(cents)) != cents {
+			t.Fatal("Round trip changed", cents, "to", toCents(fromCents(cents)))
+		}
+		amount, _ := decimal.NewFromString(fromCents(cents).StringFixed(2))
+		if toCents(amount) != cents {
+			t.Fatal("Parsing", amount, "gave", toCents(amount), "cents")
+		}
+	}
+
+	rounded := map[string]int64{"23.01": 2301, "0.005": 1, "10.004": 1000, "-0.015": -2, "7": 700}
+	for amount, cents := range rounded {
+		if got := toCents(decimal.RequireFromString(amount)); got != cents {
+			t.Errorf("Expected %s to be %d cents, got %d", amount, cents, got)
+		}
+	}
+}
+
+func TestMemoryDatabaseMoneyDrift(t *testing.T) {
+	testMoneyDrift(t, NewMemoryDatabase())
+}
+
+func TestRedisDatabaseMoneyDrift(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	if _, err := db.GetFunds("conformance"); err != nil {
+		t.Skip("redis is unavailable:", err)
+	}
+	testMoneyDrift(t, db)
+}
+
+// testMoneyDrift runs random fund operations through every path that moves
+// money, checking the balances against a model kept in whole cents. Any
+// rounding error would build up over the run and show as a mismatch.
+func testMoneyDrift(t *testing.T, db UserDatabase) {
+	ops := driftOps
+	if testing.Short() {
+		ops = 10000
+	}
+	user := "drift-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	r := rand.New(rand.NewSource(2))
+	var balance, reserve int64
+
+	for i := 0; i < ops; i++ {
+		cents := r.Int63n(100000) + 1
+		amount := fromCents(cents)
+		var err error
+		switch r.Intn(6) {
+		case 0:
+			err = db.AddFunds(user, amount)
+			balance += cents
+		case 1:
+			err = db.RemoveFunds(user, amount)
+			balance -= cents
+		case 2:
+			err = db.AddReserveFunds(user, amount)
+			reserve += cents
+		case 3:
+			err = db.RemoveReserveFunds(user, amount)
+			reserve -= cents
+		case 4:
+			// A cancelled buy credits the cost back from the order's encoding
+			if _, err = db.PlaceBuy(user, "ABC", amount, decimal.New(1, 0)); err == nil {
+				_, _, _, err = db.CancelBuy(user)
+			} else if err == ErrInsufficientFunds {
+				err = nil
+			}
+		case 5:
+			// A committed sell credits the cost from the order's encoding
+			db.AddStock(user, "ABC", decimal.New(1, 0))
+			if _, err = db.PlaceSell(user, "ABC", amount, decimal.New(1, 0)); err == nil {
+				_, _, _, err = db.CommitSell(user)
+				balance += cents
+			}
+		}
+		if err != nil {
+			t.Fatal("Operation", i, "failed:", err)
+		}
+	}
+
+	funds, _ := db.GetFunds(user)
+	reserved, _ := db.GetReserveFunds(user)
+	if !funds.Equal(fromCents(balance)) || !reserved.Equal(fromCents(reserve)) {
+		t.Errorf("After %d operations expected %s funds and %s reserved, got %s and %s",
+			ops, fromCents(balance), fromCents(reserve), funds, reserved)
+	}
+}
+
+func TestMigrateFunds(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	if _, err := db.GetFunds("conformance"); err != nil {
+		t.Skip("redis is unavailable:", err)
+	}
+	user := "migrate-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	conn := db.getConn()
+	conn.Do("SET", user+legacyBalanceSuffix, "23.009999999999998")
+	conn.Do("SET", user+legacyBalanceReserveSuffix, "-4.505")
+	conn.Close()
+
+	migrated, err := db.MigrateFunds()
+	if err != nil || migrated < 2 {
+		t.Fatal("Expected both balances to be migrated, got", migrated, err)
+	}
+	funds, _ := db.GetFunds(user)
+	reserved, _ := db.GetReserveFunds(user)
+	if !funds.Equal(decimal.RequireFromString("23.01")) || !reserved.Equal(decimal.RequireFromString("-4.51")) {
+		t.Error("Balances should be rounded to the cent, got", funds, reserved)
+	}
+
+	db.AddFunds(user, decimal.RequireFromString("1"))
+	db.MigrateFunds()
+	funds, _ = db.GetFunds(user)
+	if !funds.Equal(decimal.RequireFromString("24.01")) {
+		t.Error("Migrating again should leave balances alone, got", funds)
+	}
+
+	// A dollar balance written by an old server after the migration is added
+	conn = db.getConn()
+	conn.Do("SET", user+legacyBalanceSuffix, "0.99")
+	conn.Close()
+	db.MigrateFunds()
+	funds, _ = db.GetFunds(user)
+	if !funds.Equal(decimal.RequireFromString("25")) {
+		t.Error("Late dollar balances should be added to the cents balance, got", funds)
+	}
+	db.DeleteKey(user + balanceSuffix)
+	db.DeleteKey(user + balanceReserveSuffix)
+}
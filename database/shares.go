@@ -0,0 +1,102 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/shopspring/decimal"
+)
+
+// MaxSharePrecision is the most decimal places a quantity of shares can have.
+// Holdings are stored as integer units of 1/10^MaxSharePrecision of a share,
+// and only ever changed with HINCRBY, so fractions of shares stay exact.
+const MaxSharePrecision = 6
+
+// Holdings have their own key suffixes so keys holding whole shares from
+// before fractional shares can be told apart and migrated
+const (
+	stocksSuffix        = ":StockUnits"
+	stocksReserveSuffix = ":StocksReserveUnits"
+
+	legacyStocksSuffix        = ":Stocks"
+	legacyStocksReserveSuffix = ":StocksReserve"
+)
+
+// toUnits converts a quantity of shares to whole share units, rounding any
+// finer fraction to the nearest unit
+func toUnits(shares decimal.Decimal) int64 {
+	return shares.Shift(MaxSharePrecision).Round(0).IntPart()
+}
+
+// fromUnits converts whole share units back to a quantity of shares
+func fromUnits(units int64) decimal.Decimal {
+	return decimal.New(units, -MaxSharePrecision)
+}
+
+// decodeShares converts a reply of share units into a quantity of shares,
+// treating a missing field as zero
+func (u RedisDatabase) decodeShares(reply interface{}) (decimal.Decimal, error) {
+	units, err := redis.Int64(reply, nil)
+	if err == redis.ErrNil {
+		return decimal.Decimal{}, nil
+	}
+	return fromUnits(units), err
+}
+
+// decodeHoldings converts an HGETALL reply of share units into the quantity
+// of shares of each stock
+func (u RedisDatabase) decodeHoldings(reply interface{}) (map[string]decimal.Decimal, error) {
+	units, err := redis.Int64Map(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	holdings := make(map[string]decimal.Decimal)
+	for stock, n := range units {
+		holdings[stock] = fromUnits(n)
+	}
+	return holdings, nil
+}
+
+// migrateStocksScript moves whole share holdings into their share units key.
+// They're added to anything already held in units, and the old key is removed,
+// so it is safe to run repeatedly and from more than one server at once.
+// KEYS: legacy whole shares key, share units key   ARGV: units per share
+var migrateStocksScript = redis.NewScript(2, `
+local held = redis.call('HGETALL', KEYS[1])
+if #held == 0 then
+	return 0
+end
+for i = 1, #held, 2 do
+	redis.call('HINCRBY', KEYS[2], held[i], tonumber(held[i + 1]) * tonumber(ARGV[1]))
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// MigrateStocks converts every holding and reserved holding stored in whole
+// shares by earlier versions of the server to share units. Returns the
+// number of accounts migrated.
+func (u RedisDatabase) MigrateStocks() (int, error) {
+	conn := u.getConn()
+	defer conn.Close()
+
+	migrated := 0
+	for legacy, suffix := range map[string]string{
+		legacyStocksSuffix:        stocksSuffix,
+		legacyStocksReserveSuffix: stocksReserveSuffix,
+	} {
+		keys, err := u.scanKeys(conn, "*"+legacy)
+		if err != nil {
+			return migrated, err
+		}
+		for _, key := range keys {
+			n, err := redis.Int(migrateStocksScript.Do(conn, key, strings.TrimSuffix(key, legacy)+suffix,
+				toUnits(decimal.New(1, 0))))
+			if err != nil {
+				return migrated, err
+			}
+			migrated += n
+		}
+	}
+	return migrated, nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestUnitsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < driftOps; i++ {
+		units := r.Int63n(1e15) - 5e14
+		if toUnits(fromUnits(units)) != units {
+			t.Fatal("Round trip changed", units, "to", toUnits(fromUnits(units)))
+		}
+		shares, _ := decimal.NewFromString(fromUnits(units).String())
+		if toUnits(shares) != units {
+			t.Fatal("Parsing", shares, "gave", toUnits(shares), "units")
+		}
+	}
+
+	rounded := map[string]int64{"2.5": 2500000, "0.0000005": 1, "0.1234564": 123456, "-1.25": -1250000, "7": 7000000}
+	for shares, units := range rounded {
+		if got := toUnits(decimal.RequireFromString(shares)); got != units {
+			t.Errorf("Expected %s to be %d units, got %d", shares, units, got)
+		}
+	}
+}
+
+func TestMigrateStocks(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	if _, err := db.GetFunds("conformance"); err != nil {
+		t.Skip("redis is unavailable:", err)
+	}
+	user := "migrate-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	conn := db.getConn()
+	conn.Do("HSET", user+legacyStocksSuffix, "ABC", 3)
+	conn.Do("HSET", user+legacyStocksSuffix, "XYZ", 1)
+	conn.Do("HSET", user+legacyStocksReserveSuffix, "ABC", 2)
+	conn.Close()
+
+	migrated, err := db.MigrateStocks()
+	if err != nil || migrated < 2 {
+		t.Fatal("Expected both holdings to be migrated, got", migrated, err)
+	}
+	abc, _ := db.GetStock(user, "ABC")
+	xyz, _ := db.GetStock(user, "XYZ")
+	reserved, _ := db.GetReserveStock(user, "ABC")
+	if !abc.Equal(decimal.New(3, 0)) || !xyz.Equal(decimal.New(1, 0)) || !reserved.Equal(decimal.New(2, 0)) {
+		t.Error("Holdings should be carried over, got", abc, xyz, reserved)
+	}
+
+	// Whole shares written by an old server after the migration are added
+	db.AddStock(user, "ABC", decimal.RequireFromString("0.5"))
+	conn = db.getConn()
+	conn.Do("HSET", user+legacyStocksSuffix, "ABC", 1)
+	conn.Close()
+	db.MigrateStocks()
+	abc, _ = db.GetStock(user, "ABC")
+	if !abc.Equal(decimal.RequireFromString("4.5")) {
+		t.Error("Late whole shares should be added to the share units, got", abc)
+	}
+	db.DeleteKey(user + stocksSuffix)
+	db.DeleteKey(user + stocksReserveSuffix)
+}
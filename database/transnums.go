@@ -0,0 +1,74 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// MaxTransNum is the largest transaction number a client may claim. Used
+// numbers are kept in a bitmap, which this bounds to 2 MB. Numbers assigned
+// past it can't be claimed, so they aren't recorded.
+const MaxTransNum = 1<<24 - 1
+
+// ErrTransNumRange is returned when claiming a transaction number that isn't
+// between 1 and MaxTransNum
+var ErrTransNumRange = errors.New("transaction number out of range")
+
+const (
+	// transNumKey counts up through the transaction numbers the servers assign
+	transNumKey = "TransNum"
+	// usedTransNumsKey is a bitmap with a bit set for every transaction number
+	// that has been assigned or claimed
+	usedTransNumsKey = "UsedTransNums"
+)
+
+// nextTransNumScript increments the counter until it reaches a transaction
+// number no client has claimed, and marks it as used. Numbers past the
+// largest a client can claim aren't marked.
+// KEYS: counter, used numbers   ARGV: MaxTransNum
+var nextTransNumScript = redis.NewScript(2, `
+local transNum = redis.call('INCR', KEYS[1])
+while transNum <= tonumber(ARGV[1]) and redis.call('SETBIT', KEYS[2], transNum, 1) == 1 do
+	transNum = redis.call('INCR', KEYS[1])
+end
+return transNum
+`)
+
+// NextTransNum returns a transaction number that hasn't been used by any
+// server sharing this database, including before a restart
+func (u RedisDatabase) NextTransNum() (int, error) {
+	conn := u.getConn()
+	defer conn.Close()
+
+	return redis.Int(nextTransNumScript.Do(conn, transNumKey, usedTransNumsKey, MaxTransNum))
+}
+
+// ClaimTransNum marks a client supplied transaction number as used,
+// returning false if it had already been assigned or claimed
+func (u RedisDatabase) ClaimTransNum(transNum int) (bool, error) {
+	if transNum < 1 || transNum > MaxTransNum {
+		return false, ErrTransNumRange
+	}
+	conn := u.getConn()
+	defer conn.Close()
+
+	used, err := redis.Int(conn.Do("SETBIT", usedTransNumsKey, transNum, 1))
+	return used == 0, err
+}
+
+// TransNumBits is a bitmap of used transaction numbers, laid out the same as
+// the one kept in redis, and grown as higher numbers are used. It's what
+// servers that don't share a database track their numbers with too.
+type TransNumBits []uint64
+
+// Set marks the transaction number as used, returning whether it already was
+func (b *TransNumBits) Set(transNum int) bool {
+	word, bit := transNum/64, uint(transNum%64)
+	if word >= len(*b) {
+		*b = append(*b, make([]uint64, word+1-len(*b))...)
+	}
+	used := (*b)[word]&(1<<bit) != 0
+	(*b)[word] |= 1 << bit
+	return used
+}
@@ -0,0 +1,17 @@
+package database
+
+import "testing"
+
+func TestAssignedTransNumsPastMax(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.lastTransNum = MaxTransNum - 1
+	for _, expected := range []int{MaxTransNum, MaxTransNum + 1, MaxTransNum + 2} {
+		if transNum, err := db.NextTransNum(); err != nil || transNum != expected {
+			t.Error("Expected to be assigned", expected, "got", transNum, err)
+		}
+	}
+	// Numbers past MaxTransNum can't be claimed, so aren't tracked
+	if used := len(db.usedTransNums); used > MaxTransNum/64+1 {
+		t.Error("Expected at most", MaxTransNum/64+1, "words of used numbers, got", used)
+	}
+}
@@ -0,0 +1,210 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/shopspring/decimal"
+)
+
+// TriggerRecord is the saved state of a user's buy or sell trigger
+type TriggerRecord struct {
+	Type          string
+	User          string
+	Stock         string
+	TransNum      int
+	BuySellAmount decimal.Decimal
+	TriggerAmount decimal.Decimal
+	Active        bool
+}
+
+// Reserves holds the reserve account of every user that has one
+type Reserves struct {
+	Funds  map[string]decimal.Decimal
+	Stocks map[string]map[string]decimal.Decimal
+}
+
+// fillBuyTriggerScript takes the funds reserved for a buy trigger out of
+// the reserve, returns the change left after its cost to the balance, and
+// adds the shares bought, failing if the reserve doesn't hold the funds
+// KEYS: balance reserve, balance, stocks   ARGV: reserved cents, change in cents, stock, share units
+var fillBuyTriggerScript = redis.NewScript(3, `
+local reserve = tonumber(redis.call('GET', KEYS[1]) or '0')
+if reserve < tonumber(ARGV[1]) then
+	return false
+end
+redis.call('DECRBY', KEYS[1], ARGV[1])
+redis.call('INCRBY', KEYS[2], ARGV[2])
+redis.call('HINCRBY', KEYS[3], ARGV[3], ARGV[4])
+return 1
+`)
+
+// fillSellTriggerScript empties the reserve of the stock held for a sell
+// trigger, returning whatever isn't sold to the user's holding and adding
+// the proceeds to the balance, failing if the reserve doesn't hold the shares
+// KEYS: stocks reserve, stocks, balance
+// ARGV: stock, negated share units sold, proceeds in cents
+var fillSellTriggerScript = redis.NewScript(3, `
+local reserved = redis.call('HGET', KEYS[1], ARGV[1]) or '0'
+if tonumber(reserved) + tonumber(ARGV[2]) < 0 then
+	return false
+end
+redis.call('HSET', KEYS[1], ARGV[1], 0)
+redis.call('HINCRBY', KEYS[2], ARGV[1], reserved)
+redis.call('HINCRBY', KEYS[2], ARGV[1], ARGV[2])
+redis.call('INCRBY', KEYS[3], ARGV[3])
+return 1
+`)
+
+// FillBuyTrigger atomically settles an executed buy trigger, taking the
+// funds reserved for it from the user's reserve account, returning what's
+// left after its cost to their funds, and adding the shares bought.
+// Returns ErrInsufficientFunds if the reserve doesn't hold the reserved funds.
+func (u RedisDatabase) FillBuyTrigger(user string, stock string, reserved decimal.Decimal,
+	cost decimal.Decimal, shares decimal.Decimal) error {
+	conn := u.getConn()
+	_, err := redis.Int(fillBuyTriggerScript.Do(conn, user+balanceReserveSuffix, user+balanceSuffix,
+		user+stocksSuffix, toCents(reserved), toCents(reserved)-toCents(cost), stock, toUnits(shares)))
+	conn.Close()
+	if err == redis.ErrNil {
+		return ErrInsufficientFunds
+	}
+	return err
+}
+
+// FillSellTrigger atomically settles an executed sell trigger, emptying the
+// user's reserve of the stock, returning any shares that weren't sold to
+// their account, and adding the proceeds to their funds.
+// Returns ErrInsufficientStock if the reserve doesn't hold the shares sold.
+func (u RedisDatabase) FillSellTrigger(user string, stock string, shares decimal.Decimal,
+	proceeds decimal.Decimal) error {
+	conn := u.getConn()
+	_, err := redis.Int(fillSellTriggerScript.Do(conn, user+stocksReserveSuffix, user+stocksSuffix,
+		user+balanceSuffix, stock, -toUnits(shares), toCents(proceeds)))
+	conn.Close()
+	if err == redis.ErrNil {
+		return ErrInsufficientStock
+	}
+	return err
+}
+
+// SaveTrigger stores or replaces a user's trigger for a stock
+func (u RedisDatabase) SaveTrigger(trig TriggerRecord) error {
+	conn := u.getConn()
+	_, err := conn.Do("HSET", "Triggers", triggerKey(trig.Type, trig.User, trig.Stock),
+		u.encodeTrigger(trig))
+	conn.Close()
+	return err
+}
+
+// DeleteTrigger removes a user's saved trigger for a stock
+func (u RedisDatabase) DeleteTrigger(triggerType string, user string, stock string) error {
+	conn := u.getConn()
+	_, err := conn.Do("HDEL", "Triggers", triggerKey(triggerType, user, stock))
+	conn.Close()
+	return err
+}
+
+// GetTriggers returns every saved trigger
+func (u RedisDatabase) GetTriggers() ([]TriggerRecord, error) {
+	conn := u.getConn()
+	saved, err := redis.StringMap(conn.Do("HGETALL", "Triggers"))
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var trigs []TriggerRecord
+	for key, encoded := range saved {
+		first, last := strings.Index(key, ","), strings.LastIndex(key, ",")
+		if first == last {
+			continue
+		}
+		trig := u.decodeTrigger(encoded)
+		trig.Type, trig.User, trig.Stock = key[:first], key[first+1:last], key[last+1:]
+		trigs = append(trigs, trig)
+	}
+	return trigs, nil
+}
+
+// GetReserves returns the reserve accounts of all users
+func (u RedisDatabase) GetReserves() (Reserves, error) {
+	reserves := Reserves{
+		Funds:  make(map[string]decimal.Decimal),
+		Stocks: make(map[string]map[string]decimal.Decimal),
+	}
+	conn := u.getConn()
+	defer conn.Close()
+
+	keys, err := u.scanKeys(conn, "*"+balanceReserveSuffix)
+	if err != nil {
+		return reserves, err
+	}
+	for _, key := range keys {
+		r, err := conn.Do("GET", key)
+		if err != nil {
+			return reserves, err
+		}
+		reserves.Funds[strings.TrimSuffix(key, balanceReserveSuffix)] = u.decodeFunds(r)
+	}
+
+	keys, err = u.scanKeys(conn, "*"+stocksReserveSuffix)
+	if err != nil {
+		return reserves, err
+	}
+	for _, key := range keys {
+		r, err := conn.Do("HGETALL", key)
+		if err != nil {
+			return reserves, err
+		}
+		stocks, err := u.decodeHoldings(r)
+		if err != nil {
+			return reserves, err
+		}
+		reserves.Stocks[strings.TrimSuffix(key, stocksReserveSuffix)] = stocks
+	}
+	return reserves, nil
+}
+
+// scanKeys returns all keys matching the pattern without blocking the server
+func (u RedisDatabase) scanKeys(conn redis.Conn, pattern string) ([]string, error) {
+	var keys []string
+	cursor := 0
+	for {
+		r, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return keys, err
+		}
+		cursor, _ = redis.Int(r[0], nil)
+		found, _ := redis.Strings(r[1], nil)
+		keys = append(keys, found...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+func triggerKey(triggerType string, user string, stock string) string {
+	return triggerType + "," + user + "," + stock
+}
+
+// Encodes a trigger into a string, following the format of:
+//		"transNum:buySellAmount:triggerAmount:active"
+func (u RedisDatabase) encodeTrigger(trig TriggerRecord) string {
+	return strconv.Itoa(trig.TransNum) + ":" + trig.BuySellAmount.String() + ":" +
+		trig.TriggerAmount.String() + ":" + strconv.FormatBool(trig.Active)
+}
+
+// Performs the opposite of encodeTrigger
+func (u RedisDatabase) decodeTrigger(encoded string) (trig TriggerRecord) {
+	split := strings.Split(encoded, ":")
+	if len(split) != 4 {
+		return trig
+	}
+	trig.TransNum, _ = strconv.Atoi(split[0])
+	trig.BuySellAmount, _ = decimal.NewFromString(split[1])
+	trig.TriggerAmount, _ = decimal.NewFromString(split[2])
+	trig.Active, _ = strconv.ParseBool(split[3])
+	return trig
+}
@@ -2,9 +2,10 @@ package database
 
 import (
 	"errors"
-	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 
@@ -13,89 +14,638 @@ import (
 
 // UserDatabase holds all of the supported database commands
 type UserDatabase interface {
-	GetUserInfo(user string) (info string, err error)
+	GetUserInfo(user string) (info UserInfo, err error)
+	AddHistory(user string, entry HistoryEntry) error
 
 	AddFunds(string, decimal.Decimal) error
 	GetFunds(string) (decimal.Decimal, error)
 	RemoveFunds(string, decimal.Decimal) error
 
-	AddStock(user string, stock string, shares int) error
-	GetStock(user string, stock string) (int, error)
-	RemoveStock(user string, stock string, amount int) error
+	AddStock(user string, stock string, shares decimal.Decimal) error
+	GetStock(user string, stock string) (decimal.Decimal, error)
+	RemoveStock(user string, stock string, amount decimal.Decimal) error
 
 	AddReserveFunds(string, decimal.Decimal) error
 	GetReserveFunds(string) (decimal.Decimal, error)
 	RemoveReserveFunds(string, decimal.Decimal) error
 
-	AddReserveStock(user string, stock string, shares int) error
-	GetReserveStock(user string, stock string) (int, error)
-	RemoveReserveStock(user string, stock string, amount int) error
-
-	PushBuy(user string, stock string, cost decimal.Decimal, shares int) error
-	PopBuy(user string) (stock string, cost decimal.Decimal, shares int, err error)
-	PushSell(user string, stock string, cost decimal.Decimal, shares int) error
-	PopSell(user string) (stock string, cost decimal.Decimal, shares int, err error)
+	AddReserveStock(user string, stock string, shares decimal.Decimal) error
+	GetReserveStock(user string, stock string) (decimal.Decimal, error)
+	RemoveReserveStock(user string, stock string, amount decimal.Decimal) error
+
+	ReserveFunds(user string, amount decimal.Decimal) (balance decimal.Decimal, err error)
+	ReserveStock(user string, stock string, shares decimal.Decimal) (held decimal.Decimal, err error)
+	UnreserveFunds(user string, amount decimal.Decimal) error
+	UnreserveStock(user string, stock string, shares decimal.Decimal) error
+
+	PushBuy(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) error
+	PopBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error)
+	PushSell(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) error
+	PopSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error)
+
+	PlaceBuy(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) (balance decimal.Decimal, err error)
+	CommitBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error)
+	CancelBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error)
+	PlaceSell(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) (held decimal.Decimal, err error)
+	CommitSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error)
+	CancelSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error)
+	ExpireOrders(now time.Time) ([]ExpiredOrder, error)
+
+	FillBuyTrigger(user string, stock string, reserved decimal.Decimal, cost decimal.Decimal, shares decimal.Decimal) error
+	FillSellTrigger(user string, stock string, shares decimal.Decimal, proceeds decimal.Decimal) error
+	SaveTrigger(trig TriggerRecord) error
+	DeleteTrigger(triggerType string, user string, stock string) error
+	GetTriggers() ([]TriggerRecord, error)
+	GetReserves() (Reserves, error)
+
+	NextTransNum() (int, error)
+	ClaimTransNum(transNum int) (bool, error)
 }
 
-// RedisDatabase holds the address of the redisDB
+var (
+	// ErrInsufficientFunds is returned when a user's balance can't cover an order
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrInsufficientStock is returned when a user doesn't hold enough shares for an order
+	ErrInsufficientStock = errors.New("insufficient stock")
+	// ErrNoPendingOrder is returned when a user has no pending order to commit or cancel
+	ErrNoPendingOrder = errors.New("no pending order")
+	// ErrOrderExpired is returned when a user's most recent order is older than OrderTimeout
+	ErrOrderExpired = errors.New("pending order expired")
+)
+
+// RedisDatabase holds the address of the redisDB, and a pool of connections to it
 type RedisDatabase struct {
 	Addr string
 	Port string
+
+	pool     *redis.Pool
+	counters *poolCounters
 }
 
-func (u RedisDatabase) getConn() redis.Conn {
-	c, err := redis.Dial(u.Addr, u.Port)
-	if err != nil {
-		panic(err)
+// PoolConfig bounds the pool of connections a RedisDatabase keeps to redis
+type PoolConfig struct {
+	// MaxIdle is the most connections kept open while unused
+	MaxIdle int
+	// MaxActive is the most connections open at once. Commands wait for a
+	// connection to be returned once the limit is reached.
+	MaxActive int
+	// IdleTimeout closes connections that have been unused for this long
+	IdleTimeout time.Duration
+	// HealthCheckAfter pings connections that have been idle for this long
+	// before they are reused, replacing any that fail
+	HealthCheckAfter time.Duration
+}
+
+// DefaultPoolConfig is used for any PoolConfig fields left zero
+var DefaultPoolConfig = PoolConfig{
+	MaxIdle:          16,
+	MaxActive:        64,
+	IdleTimeout:      4 * time.Minute,
+	HealthCheckAfter: 30 * time.Second,
+}
+
+// PoolStats is a snapshot of a RedisDatabase's connection pool
+type PoolStats struct {
+	// ActiveCount is the number of open connections, idle or in use
+	ActiveCount int
+	// IdleCount is the number of open connections waiting to be used
+	IdleCount int
+	// MaxActive is the configured limit on ActiveCount
+	MaxActive int
+	// DialFailures counts the attempts to open a connection that failed
+	DialFailures uint64
+	// HealthCheckFailures counts the idle connections dropped for failing a ping
+	HealthCheckFailures uint64
+}
+
+type poolCounters struct {
+	dialFailures        uint64
+	healthCheckFailures uint64
+}
+
+// NewRedisDatabase returns a RedisDatabase that connects over the given network
+// and address, with a connection pool bounded by config
+func NewRedisDatabase(addr string, port string, config PoolConfig) RedisDatabase {
+	if config.MaxIdle == 0 {
+		config.MaxIdle = DefaultPoolConfig.MaxIdle
+	}
+	if config.MaxActive == 0 {
+		config.MaxActive = DefaultPoolConfig.MaxActive
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultPoolConfig.IdleTimeout
+	}
+	if config.HealthCheckAfter == 0 {
+		config.HealthCheckAfter = DefaultPoolConfig.HealthCheckAfter
 	}
-	return c
+
+	counters := new(poolCounters)
+	pool := &redis.Pool{
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial(addr, port)
+			if err != nil {
+				atomic.AddUint64(&counters.dialFailures, 1)
+			}
+			return c, err
+		},
+		TestOnBorrow: func(c redis.Conn, idleSince time.Time) error {
+			if time.Since(idleSince) < config.HealthCheckAfter {
+				return nil
+			}
+			_, err := c.Do("PING")
+			if err != nil {
+				atomic.AddUint64(&counters.healthCheckFailures, 1)
+			}
+			return err
+		},
+	}
+	return RedisDatabase{Addr: addr, Port: port, pool: pool, counters: counters}
+}
+
+// Stats returns the current state of the connection pool
+func (u RedisDatabase) Stats() PoolStats {
+	stats := u.pool.Stats()
+	return PoolStats{
+		ActiveCount:         stats.ActiveCount,
+		IdleCount:           stats.IdleCount,
+		MaxActive:           u.pool.MaxActive,
+		DialFailures:        atomic.LoadUint64(&u.counters.dialFailures),
+		HealthCheckFailures: atomic.LoadUint64(&u.counters.healthCheckFailures),
+	}
+}
+
+// Close closes every connection in the pool
+func (u RedisDatabase) Close() error {
+	return u.pool.Close()
+}
+
+// getConn returns a connection from the pool, which must be closed to return it.
+// If redis can't be reached, the error is returned by the connection's first command.
+func (u RedisDatabase) getConn() redis.Conn {
+	return u.pool.Get()
+}
+
+// UserInfo is a snapshot of everything the database holds for a user
+type UserInfo struct {
+	Balance        decimal.Decimal
+	BalanceReserve decimal.Decimal
+	Stocks         map[string]decimal.Decimal
+	StocksReserve  map[string]decimal.Decimal
+	BuyOrders      []Order
+	SellOrders     []Order
+	History        []HistoryEntry
+}
+
+// Order is a pending buy or sell order waiting to be committed or cancelled
+type Order struct {
+	Stock     string
+	Cost      decimal.Decimal
+	Shares    decimal.Decimal
+	Timestamp int64
+}
+
+// ExpiredOrder is a pending order that was refunded after OrderTimeout
+type ExpiredOrder struct {
+	User  string
+	Type  string
+	Order Order
+	// TransNum is the transaction the refund was logged as, when it was
+	// expired through an AuditedDatabase
+	TransNum int
 }
 
+// OrderTimeout is how long a pending buy or sell can wait to be committed
+const OrderTimeout = 60 * time.Second
+
+// HistoryEntry is a completed transaction on a user's account
+type HistoryEntry struct {
+	Timestamp int64
+	TransNum  int
+	Command   string
+	Stock     string
+	Funds     decimal.Decimal
+	Shares    decimal.Decimal
+}
+
+// historyLength is the number of most recent transactions kept per user
+const historyLength = 100
+
 // GetUserInfo returns all of a users information in the database
-func (u RedisDatabase) GetUserInfo(user string) (info string, err error) {
+func (u RedisDatabase) GetUserInfo(user string) (info UserInfo, err error) {
 	c := u.getConn()
 	c.Send("MULTI")
-	c.Send("GET", user+":Balance")
-	c.Send("GET", user+":Stocks")
-	c.Send("GET", user+":SellOrders")
-	c.Send("GET", user+":BuyOrders")
-	c.Send("GET", user+":SellTriggers")
-	c.Send("GET", user+":BuyTriggers")
-	c.Send("GET", user+":BalanceReserve")
-	c.Send("GET", user+":StocksReserve")
-	c.Send("GET", user+":History")
-	r, err := c.Do("EXEC")
+	c.Send("GET", user+balanceSuffix)
+	c.Send("GET", user+balanceReserveSuffix)
+	c.Send("HGETALL", user+stocksSuffix)
+	c.Send("HGETALL", user+stocksReserveSuffix)
+	c.Send("LRANGE", user+":BuyOrders", 0, -1)
+	c.Send("LRANGE", user+":SellOrders", 0, -1)
+	c.Send("LRANGE", user+":History", 0, -1)
+	r, err := redis.Values(c.Do("EXEC"))
+	c.Close()
 	if err != nil {
-		return "", err
+		return info, err
 	}
 
-	c.Close()
-	return fmt.Sprintf("%v", r), err
+	info.Balance = u.decodeFunds(r[0])
+	info.BalanceReserve = u.decodeFunds(r[1])
+	if info.Stocks, err = u.decodeHoldings(r[2]); err != nil {
+		return info, err
+	}
+	if info.StocksReserve, err = u.decodeHoldings(r[3]); err != nil {
+		return info, err
+	}
+
+	buys, err := redis.Strings(r[4], nil)
+	if err != nil {
+		return info, err
+	}
+	for _, order := range buys {
+		info.BuyOrders = append(info.BuyOrders, u.decodeOrder(order))
+	}
+
+	sells, err := redis.Strings(r[5], nil)
+	if err != nil {
+		return info, err
+	}
+	for _, order := range sells {
+		info.SellOrders = append(info.SellOrders, u.decodeOrder(order))
+	}
+
+	history, err := redis.Strings(r[6], nil)
+	if err != nil {
+		return info, err
+	}
+	for _, entry := range history {
+		info.History = append(info.History, u.decodeHistory(entry))
+	}
+	return info, nil
+}
+
+// AddHistory records a completed transaction in the user's history,
+// keeping only the most recent entries
+func (u RedisDatabase) AddHistory(user string, entry HistoryEntry) error {
+	conn := u.getConn()
+	conn.Send("MULTI")
+	conn.Send("RPUSH", user+":History", u.encodeHistory(entry))
+	conn.Send("LTRIM", user+":History", -historyLength, -1)
+	_, err := conn.Do("EXEC")
+	conn.Close()
+	return err
+}
+
+// Encodes a history entry into a string, following the format of:
+//		"timestamp:transNum:command:stock:funds:shares"
+func (u RedisDatabase) encodeHistory(entry HistoryEntry) string {
+	return strconv.FormatInt(entry.Timestamp, 10) + ":" + strconv.Itoa(entry.TransNum) + ":" +
+		entry.Command + ":" + entry.Stock + ":" + entry.Funds.String() + ":" + fromUnits(toUnits(entry.Shares)).String()
+}
+
+// Performs the opposite of encodeHistory
+func (u RedisDatabase) decodeHistory(encoded string) (entry HistoryEntry) {
+	split := strings.Split(encoded, ":")
+	if len(split) != 6 {
+		return entry
+	}
+	entry.Timestamp, _ = strconv.ParseInt(split[0], 10, 64)
+	entry.TransNum, _ = strconv.Atoi(split[1])
+	entry.Command = split[2]
+	entry.Stock = split[3]
+	entry.Funds, _ = decimal.NewFromString(split[4])
+	entry.Shares, _ = decimal.NewFromString(split[5])
+	return entry
+}
+
+// decodeFunds converts a balance reply in cents into a decimal, treating a
+// missing key as zero
+func (u RedisDatabase) decodeFunds(reply interface{}) decimal.Decimal {
+	cents, err := redis.Int64(reply, nil)
+	if err != nil {
+		return decimal.Decimal{}
+	}
+	return fromCents(cents)
 }
 
 // PushSell adds a record of the users requested sell to their account
-func (u RedisDatabase) PushSell(user string, stock string, cost decimal.Decimal, shares int) error {
+// Expires after OrderTimeout
+func (u RedisDatabase) PushSell(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) error {
 	return u.pushOrder("Sell", user, stock, cost, shares)
 }
 
 // PopSell removes a users most recent requested sell
-func (u RedisDatabase) PopSell(user string) (stock string, cost decimal.Decimal, shares int, err error) {
+// Returns ErrOrderExpired if it is older than OrderTimeout
+func (u RedisDatabase) PopSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
 	return u.popOrder("Sell", user)
 }
 
 // PushBuy adds a record of the users requested buy to their account
-func (u RedisDatabase) PushBuy(user string, stock string, cost decimal.Decimal, shares int) error {
-	// Expires in 60s
+// Expires after OrderTimeout
+func (u RedisDatabase) PushBuy(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) error {
 	return u.pushOrder("Buy", user, stock, cost, shares)
 }
 
 // PopBuy removes a users most recent requested buy
-func (u RedisDatabase) PopBuy(user string) (stock string, cost decimal.Decimal, shares int, err error) {
+// Returns ErrOrderExpired if it is older than OrderTimeout
+func (u RedisDatabase) PopBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
 	return u.popOrder("Buy", user)
 }
 
+// placeBuyScript debits the cost of a buy from the user's balance and pushes
+// the order, failing if the balance can't cover it. Returns the new balance.
+// KEYS: balance, buy orders, pending users   ARGV: cost in cents, encoded order, user
+var placeBuyScript = redis.NewScript(3, `
+local balance = tonumber(redis.call('GET', KEYS[1]) or '0')
+if balance < tonumber(ARGV[1]) then
+	return false
+end
+balance = redis.call('DECRBY', KEYS[1], ARGV[1])
+redis.call('RPUSH', KEYS[2], ARGV[2])
+redis.call('SADD', KEYS[3], ARGV[3])
+return balance
+`)
+
+// placeSellScript removes the shares being sold from the user's account and
+// pushes the order, failing if the user doesn't hold enough shares. Returns
+// the number of share units the user has left.
+// The share units are negated by the caller, since Lua formats a negated
+// zero as "-0", which HINCRBY rejects.
+// KEYS: stocks, sell orders, pending users
+// ARGV: stock, negated share units, encoded order, user
+var placeSellScript = redis.NewScript(3, `
+local held = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if held + tonumber(ARGV[2]) < 0 then
+	return false
+end
+held = redis.call('HINCRBY', KEYS[1], ARGV[1], ARGV[2])
+redis.call('RPUSH', KEYS[2], ARGV[3])
+redis.call('SADD', KEYS[3], ARGV[4])
+return held
+`)
+
+// reserveScript moves an amount from a user's balance or holding of a stock
+// into its reserve, failing if there isn't enough to cover it. Returns what
+// is left. Balances are plain keys, and holdings are fields of a hash. The
+// amount is also passed negated, as for placeSellScript. Passing the reserve
+// account first moves the amount back out of the reserve instead.
+// KEYS: account, reserve account
+// ARGV: amount, negated amount, stock or "" for a balance
+var reserveScript = redis.NewScript(2, `
+local held
+if ARGV[3] == '' then
+	held = tonumber(redis.call('GET', KEYS[1]) or '0')
+else
+	held = tonumber(redis.call('HGET', KEYS[1], ARGV[3]) or '0')
+end
+if held < tonumber(ARGV[1]) then
+	return false
+end
+if ARGV[3] == '' then
+	redis.call('INCRBY', KEYS[2], ARGV[1])
+	return redis.call('INCRBY', KEYS[1], ARGV[2])
+end
+redis.call('HINCRBY', KEYS[2], ARGV[3], ARGV[1])
+return redis.call('HINCRBY', KEYS[1], ARGV[3], ARGV[2])
+`)
+
+// settleOrderScript pops the user's most recent order and credits either its
+// cost to the balance or its shares to the stocks account. An order older
+// than the cutoff is left for the reaper and 'expired' is returned.
+// KEYS: orders, balance, stocks   ARGV: "Funds", "Stock" or "None", cutoff
+var settleOrderScript = redis.NewScript(3, luaToFixed+`
+local order = redis.call('LINDEX', KEYS[1], -1)
+if not order then
+	return false
+end
+local stock, cost, shares, placed = string.match(order, '^([^:]*):([^:]*):([^:]*):?([^:]*)$')
+if (tonumber(placed) or 0) < tonumber(ARGV[2]) then
+	return 'expired'
+end
+redis.call('RPOP', KEYS[1])
+if ARGV[1] == 'Funds' then
+	redis.call('INCRBY', KEYS[2], to_fixed(cost, 2))
+elseif ARGV[1] == 'Stock' then
+	redis.call('HINCRBY', KEYS[3], stock, to_fixed(shares, 6))
+end
+return order
+`)
+
+// expireOrdersScript removes every buy and sell order older than the cutoff,
+// refunding the cost of buys and the shares of sells. The user is removed
+// from the pending set once they have no orders left.
+// KEYS: buy orders, sell orders, balance, stocks, pending users   ARGV: cutoff, user
+var expireOrdersScript = redis.NewScript(5, luaToFixed+`
+local function expire(orders, refund)
+	local expired = {}
+	while true do
+		local order = redis.call('LINDEX', orders, 0)
+		if not order then
+			break
+		end
+		local stock, cost, shares, placed = string.match(order, '^([^:]*):([^:]*):([^:]*):?([^:]*)$')
+		if (tonumber(placed) or 0) >= tonumber(ARGV[1]) then
+			break
+		end
+		redis.call('LPOP', orders)
+		if refund == 'Funds' then
+			redis.call('INCRBY', KEYS[3], to_fixed(cost, 2))
+		else
+			redis.call('HINCRBY', KEYS[4], stock, to_fixed(shares, 6))
+		end
+		table.insert(expired, order)
+	end
+	return expired
+end
+local buys = expire(KEYS[1], 'Funds')
+local sells = expire(KEYS[2], 'Stock')
+if redis.call('LLEN', KEYS[1]) == 0 and redis.call('LLEN', KEYS[2]) == 0 then
+	redis.call('SREM', KEYS[5], ARGV[2])
+end
+return {buys, sells}
+`)
+
+// PlaceBuy atomically removes the cost of a buy from the user's funds and
+// pushes it as their most recent pending buy. Returns the user's remaining funds.
+// Returns ErrInsufficientFunds if the user can't afford it.
+func (u RedisDatabase) PlaceBuy(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) (decimal.Decimal, error) {
+	order := Order{stock, cost, shares, timestamp(time.Now())}
+	conn := u.getConn()
+	balance, err := redis.Int64(placeBuyScript.Do(conn, user+balanceSuffix, user+":BuyOrders", "PendingOrders",
+		toCents(cost), u.encodeOrder(order), user))
+	conn.Close()
+	if err == redis.ErrNil {
+		return decimal.Decimal{}, ErrInsufficientFunds
+	} else if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return fromCents(balance), nil
+}
+
+// CommitBuy atomically pops the user's most recent pending buy and adds the
+// purchased shares to their account.
+// Returns ErrNoPendingOrder if there is no buy to commit, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (u RedisDatabase) CommitBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return u.settleOrder(user, ":BuyOrders", "Stock")
+}
+
+// CancelBuy atomically pops the user's most recent pending buy and refunds
+// its cost to their account.
+// Returns ErrNoPendingOrder if there is no buy to cancel, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (u RedisDatabase) CancelBuy(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return u.settleOrder(user, ":BuyOrders", "Funds")
+}
+
+// PlaceSell atomically removes the shares being sold from the user's account
+// and pushes it as their most recent pending sell. Returns the number of
+// shares of the stock the user has left.
+// Returns ErrInsufficientStock if the user doesn't hold enough shares.
+func (u RedisDatabase) PlaceSell(user string, stock string, cost decimal.Decimal, shares decimal.Decimal) (decimal.Decimal, error) {
+	order := Order{stock, cost, shares, timestamp(time.Now())}
+	conn := u.getConn()
+	held, err := redis.Int64(placeSellScript.Do(conn, user+stocksSuffix, user+":SellOrders", "PendingOrders",
+		stock, -toUnits(shares), u.encodeOrder(order), user))
+	conn.Close()
+	if err == redis.ErrNil {
+		return decimal.Decimal{}, ErrInsufficientStock
+	} else if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return fromUnits(held), nil
+}
+
+// ReserveFunds atomically moves an amount from the user's funds into their
+// reserve account. Returns the user's remaining funds.
+// Returns ErrInsufficientFunds if the user doesn't have the amount.
+func (u RedisDatabase) ReserveFunds(user string, amount decimal.Decimal) (decimal.Decimal, error) {
+	conn := u.getConn()
+	balance, err := redis.Int64(reserveScript.Do(conn, user+balanceSuffix, user+balanceReserveSuffix,
+		toCents(amount), -toCents(amount), ""))
+	conn.Close()
+	if err == redis.ErrNil {
+		return decimal.Decimal{}, ErrInsufficientFunds
+	} else if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return fromCents(balance), nil
+}
+
+// ReserveStock atomically moves shares of the stock from the user's account
+// into their reserve account. Returns the number of shares the user has left.
+// Returns ErrInsufficientStock if the user doesn't hold enough shares.
+func (u RedisDatabase) ReserveStock(user string, stock string, shares decimal.Decimal) (decimal.Decimal, error) {
+	conn := u.getConn()
+	held, err := redis.Int64(reserveScript.Do(conn, user+stocksSuffix, user+stocksReserveSuffix,
+		toUnits(shares), -toUnits(shares), stock))
+	conn.Close()
+	if err == redis.ErrNil {
+		return decimal.Decimal{}, ErrInsufficientStock
+	} else if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return fromUnits(held), nil
+}
+
+// UnreserveFunds atomically moves an amount out of the user's reserve
+// account back into their funds.
+// Returns ErrInsufficientFunds if the reserve doesn't hold the amount.
+func (u RedisDatabase) UnreserveFunds(user string, amount decimal.Decimal) error {
+	conn := u.getConn()
+	_, err := redis.Int64(reserveScript.Do(conn, user+balanceReserveSuffix, user+balanceSuffix,
+		toCents(amount), -toCents(amount), ""))
+	conn.Close()
+	if err == redis.ErrNil {
+		return ErrInsufficientFunds
+	}
+	return err
+}
+
+// UnreserveStock atomically moves shares of the stock out of the user's
+// reserve account back into their account.
+// Returns ErrInsufficientStock if the reserve doesn't hold the shares.
+func (u RedisDatabase) UnreserveStock(user string, stock string, shares decimal.Decimal) error {
+	conn := u.getConn()
+	_, err := redis.Int64(reserveScript.Do(conn, user+stocksReserveSuffix, user+stocksSuffix,
+		toUnits(shares), -toUnits(shares), stock))
+	conn.Close()
+	if err == redis.ErrNil {
+		return ErrInsufficientStock
+	}
+	return err
+}
+
+// CommitSell atomically pops the user's most recent pending sell and adds
+// the sale proceeds to their account.
+// Returns ErrNoPendingOrder if there is no sell to commit, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (u RedisDatabase) CommitSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return u.settleOrder(user, ":SellOrders", "Funds")
+}
+
+// CancelSell atomically pops the user's most recent pending sell and returns
+// the shares to their account.
+// Returns ErrNoPendingOrder if there is no sell to cancel, or ErrOrderExpired
+// if it is older than OrderTimeout.
+func (u RedisDatabase) CancelSell(user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	return u.settleOrder(user, ":SellOrders", "Stock")
+}
+
+// ExpireOrders removes every pending order placed more than OrderTimeout
+// before now, refunding the cost of expired buys and the shares of expired
+// sells. Returns the orders that expired.
+func (u RedisDatabase) ExpireOrders(now time.Time) ([]ExpiredOrder, error) {
+	conn := u.getConn()
+	defer conn.Close()
+	users, err := redis.Strings(conn.Do("SMEMBERS", "PendingOrders"))
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := timestamp(now.Add(-OrderTimeout))
+	var expired []ExpiredOrder
+	for _, user := range users {
+		r, err := redis.Values(expireOrdersScript.Do(conn, user+":BuyOrders", user+":SellOrders",
+			user+balanceSuffix, user+stocksSuffix, "PendingOrders", cutoff, user))
+		if err != nil {
+			return expired, err
+		}
+		buys, _ := redis.Strings(r[0], nil)
+		for _, order := range buys {
+			expired = append(expired, ExpiredOrder{User: user, Type: "Buy", Order: u.decodeOrder(order)})
+		}
+		sells, _ := redis.Strings(r[1], nil)
+		for _, order := range sells {
+			expired = append(expired, ExpiredOrder{User: user, Type: "Sell", Order: u.decodeOrder(order)})
+		}
+	}
+	return expired, nil
+}
+
+func (u RedisDatabase) settleOrder(user string, ordersSuffix string,
+	credit string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
+	cutoff := timestamp(time.Now().Add(-OrderTimeout))
+	conn := u.getConn()
+	encoded, err := redis.String(settleOrderScript.Do(conn, user+ordersSuffix,
+		user+balanceSuffix, user+stocksSuffix, credit, cutoff))
+	conn.Close()
+	if err == redis.ErrNil {
+		return stock, cost, shares, ErrNoPendingOrder
+	} else if err != nil {
+		return stock, cost, shares, err
+	} else if encoded == "expired" {
+		return stock, cost, shares, ErrOrderExpired
+	}
+
+	order := u.decodeOrder(encoded)
+	return order.Stock, order.Cost, order.Shares, nil
+}
+
 func (u RedisDatabase) pushOrder(transType string, user string,
-	stock string, cost decimal.Decimal, shares int) error {
+	stock string, cost decimal.Decimal, shares decimal.Decimal) error {
 	accountSuffix := ""
 	if transType == "Buy" {
 		accountSuffix = ":BuyOrders"
@@ -105,15 +655,18 @@ func (u RedisDatabase) pushOrder(transType string, user string,
 		return errors.New("Bad transaction type of " + transType)
 	}
 
-	encoded := u.encodeOrder(stock, cost, shares)
+	encoded := u.encodeOrder(Order{stock, cost, shares, timestamp(time.Now())})
 
 	conn := u.getConn()
-	_, err := redis.Int64(conn.Do("RPUSH", user+accountSuffix, encoded))
+	conn.Send("MULTI")
+	conn.Send("RPUSH", user+accountSuffix, encoded)
+	conn.Send("SADD", "PendingOrders", user)
+	_, err := conn.Do("EXEC")
 	conn.Close()
 	return err
 }
 
-func (u RedisDatabase) popOrder(transType string, user string) (stock string, cost decimal.Decimal, shares int, err error) {
+func (u RedisDatabase) popOrder(transType string, user string) (stock string, cost decimal.Decimal, shares decimal.Decimal, err error) {
 	accountSuffix := ""
 	if transType == "Buy" {
 		accountSuffix = ":BuyOrders"
@@ -123,141 +676,149 @@ func (u RedisDatabase) popOrder(transType string, user string) (stock string, co
 		return stock, cost, shares, errors.New("Bad transaction type of " + transType)
 	}
 
-	conn := u.getConn()
-	recv, err := redis.String(conn.Do("RPOP", user+accountSuffix))
-	conn.Close()
-
-	stock, cost, shares = u.decodeOrder(recv)
-	return stock, cost, shares, err
+	return u.settleOrder(user, accountSuffix, "None")
 }
 
 // Encodes a buy or sell order into a string, to be pushed onto the pending orders stack
+// The cost is rounded to the cent and the shares to the share unit, as they
+// will be when credited to an account
 // Returns a string following the format of:
-//		"stock:cost:shares"
-func (u RedisDatabase) encodeOrder(stock string, cost decimal.Decimal, shares int) string {
-	return stock + ":" + cost.String() + ":" + strconv.Itoa(shares)
+//		"stock:cost:shares:timestamp"
+func (u RedisDatabase) encodeOrder(order Order) string {
+	return order.Stock + ":" + fromCents(toCents(order.Cost)).String() + ":" +
+		fromUnits(toUnits(order.Shares)).String() + ":" +
+		strconv.FormatInt(order.Timestamp, 10)
 }
 
 // Performs the opposite of encodeOrder
-func (u RedisDatabase) decodeOrder(order string) (stock string, cost decimal.Decimal, shares int) {
-	split := strings.Split(order, ":")
-	if len(split) == 3 {
-		stock = split[0]
-		cost, _ = decimal.NewFromString(split[1])
-		shares, _ = strconv.Atoi(split[2])
+// Orders stored before timestamps were added decode with a timestamp of 0
+func (u RedisDatabase) decodeOrder(encoded string) (order Order) {
+	split := strings.Split(encoded, ":")
+	if len(split) == 3 || len(split) == 4 {
+		order.Stock = split[0]
+		order.Cost, _ = decimal.NewFromString(split[1])
+		order.Shares, _ = decimal.NewFromString(split[2])
 	} else {
-		stock = ""
-		cost, _ = decimal.NewFromString("0")
-		shares = 0
+		order.Cost, _ = decimal.NewFromString("0")
 	}
+	if len(split) == 4 {
+		order.Timestamp, _ = strconv.ParseInt(split[3], 10, 64)
+	}
+
+	return order
+}
 
-	return stock, cost, shares
+// timestamp returns the time in milliseconds since the epoch
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
 // AddFunds adds amount dollars to the user account
 func (u RedisDatabase) AddFunds(user string, amount decimal.Decimal) error {
-	_, err := u.fundAction("Add", user, ":Balance", amount)
+	_, err := u.fundAction("Add", user, balanceSuffix, amount)
 	return err
 }
 
 // GetFunds returns the amount of available funds in a users account
 func (u RedisDatabase) GetFunds(user string) (decimal.Decimal, error) {
 	amount := decimal.NewFromFloat(0.0)
-	return u.fundAction("Get", user, ":Balance", amount)
+	return u.fundAction("Get", user, balanceSuffix, amount)
 }
 
 // RemoveFunds remove n funds from the user's account
 // amount is the absolute value of the funds being removed
 func (u RedisDatabase) RemoveFunds(user string, amount decimal.Decimal) error {
-	_, err := u.fundAction("Remove", user, ":Balance", amount)
+	_, err := u.fundAction("Remove", user, balanceSuffix, amount)
 	return err
 }
 
 // AddReserveFunds adds funds to a user's reserve account
 func (u RedisDatabase) AddReserveFunds(user string, amount decimal.Decimal) error {
-	_, err := u.fundAction("Add", user, ":BalanceReserve", amount)
+	_, err := u.fundAction("Add", user, balanceReserveSuffix, amount)
 	return err
 }
 
 // GetReserveFunds returns the amount of funds present in a users reserve account
 func (u RedisDatabase) GetReserveFunds(user string) (decimal.Decimal, error) {
 	amount := decimal.NewFromFloat(0.0)
-	return u.fundAction("Get", user, ":BalanceReserve", amount)
+	return u.fundAction("Get", user, balanceReserveSuffix, amount)
 }
 
 // RemoveReserveFunds removes n funds from a users account
 // Pass in the absoloute value of funds to be removed.
 func (u RedisDatabase) RemoveReserveFunds(user string, amount decimal.Decimal) error {
-	_, err := u.fundAction("Add", user, ":BalanceReserve", amount)
+	_, err := u.fundAction("Remove", user, balanceReserveSuffix, amount)
 	return err
 }
 
-// stockAction handles the generic stock commands
+// fundAction handles the generic fund commands
 func (u RedisDatabase) fundAction(action string, user string,
 	accountSuffix string, amount decimal.Decimal) (decimal.Decimal, error) {
 	command := ""
 	if action == "Add" {
-		command = "INCRBYFLOAT"
+		command = "INCRBY"
 	} else if action == "Get" {
 		command = "GET"
 	} else if action == "Remove" {
-		command = "INCRBYFLOAT"
-		amount = amount.Neg()
+		command = "DECRBY"
 	} else {
 		return decimal.NewFromFloat(0.0), errors.New("Bad action attempt on funds")
 	}
 
 	conn := u.getConn()
-	var r float64
+	var r int64
 	var err error
 	if action != "Get" {
-		r, err = redis.Float64(conn.Do(command, user+accountSuffix, amount))
+		r, err = redis.Int64(conn.Do(command, user+accountSuffix, toCents(amount)))
 	} else {
-		r, err = redis.Float64(conn.Do(command, user+accountSuffix))
-
+		r, err = redis.Int64(conn.Do(command, user+accountSuffix))
+		// A user that has never had funds has none
+		if err == redis.ErrNil {
+			err = nil
+		}
 	}
 	conn.Close()
-	return decimal.NewFromFloat(r), err
+	return fromCents(r), err
 }
 
 // GetStock returns the users available balance of said stock
-func (u RedisDatabase) GetStock(user string, stock string) (int, error) {
-	return u.stockAction("Get", user, ":Stocks", stock, 0)
+func (u RedisDatabase) GetStock(user string, stock string) (decimal.Decimal, error) {
+	return u.stockAction("Get", user, stocksSuffix, stock, decimal.Decimal{})
 }
 
-// RemoveStock removes int stocks from the users account
+// RemoveStock removes shares of stock from the users account
 // Send the absolute value of the stock being removed
-func (u RedisDatabase) RemoveStock(user string, stock string, amount int) error {
-	_, err := u.stockAction("Remove", user, ":Stocks", stock, amount)
+func (u RedisDatabase) RemoveStock(user string, stock string, amount decimal.Decimal) error {
+	_, err := u.stockAction("Remove", user, stocksSuffix, stock, amount)
 	return err
 }
 
 // AddStock adds shares to the user account
-func (u RedisDatabase) AddStock(user string, stock string, shares int) error {
-	_, err := u.stockAction("Add", user, ":Stocks", stock, shares)
+func (u RedisDatabase) AddStock(user string, stock string, shares decimal.Decimal) error {
+	_, err := u.stockAction("Add", user, stocksSuffix, stock, shares)
 	return err
 }
 
 // AddReserveStock adds n shares of stock to a user's account
-func (u RedisDatabase) AddReserveStock(user string, stock string, amount int) error {
-	_, err := u.stockAction("Add", user, ":StocksReserve", stock, amount)
+func (u RedisDatabase) AddReserveStock(user string, stock string, amount decimal.Decimal) error {
+	_, err := u.stockAction("Add", user, stocksReserveSuffix, stock, amount)
 	return err
 }
 
 // GetReserveStock returns the amount of shares present in a user's reserve account
-func (u RedisDatabase) GetReserveStock(user string, stock string) (int, error) {
-	return u.stockAction("Get", user, ":StocksReserve", stock, 0)
+func (u RedisDatabase) GetReserveStock(user string, stock string) (decimal.Decimal, error) {
+	return u.stockAction("Get", user, stocksReserveSuffix, stock, decimal.Decimal{})
 }
 
 // RemoveReserveStock removes n shares of stock from a user's reserve account
-func (u RedisDatabase) RemoveReserveStock(user string, stock string, amount int) error {
-	_, err := u.stockAction("Remove", user, ":StocksReserve", stock, amount)
+func (u RedisDatabase) RemoveReserveStock(user string, stock string, amount decimal.Decimal) error {
+	_, err := u.stockAction("Remove", user, stocksReserveSuffix, stock, amount)
 	return err
 }
 
 // stockAction handles the generic stock commands
 func (u RedisDatabase) stockAction(action string, user string,
-	accountSuffix string, stock string, amount int) (int, error) {
+	accountSuffix string, stock string, amount decimal.Decimal) (decimal.Decimal, error) {
 	command := ""
 	if action == "Add" {
 		command = "HINCRBY"
@@ -265,22 +826,25 @@ func (u RedisDatabase) stockAction(action string, user string,
 		command = "HGET"
 	} else if action == "Remove" {
 		command = "HINCRBY"
-		amount = -amount
+		amount = amount.Neg()
 	} else {
-		return 0, errors.New("Bad action attempt on stocks")
+		return decimal.Decimal{}, errors.New("Bad action attempt on stocks")
 	}
 
 	conn := u.getConn()
-	var r int
+	var r interface{}
 	var err error
 	if action != "Get" {
-		r, err = redis.Int(conn.Do(command, user+accountSuffix, stock, amount))
+		r, err = conn.Do(command, user+accountSuffix, stock, toUnits(amount))
 	} else {
-		r, err = redis.Int(conn.Do(command, user+accountSuffix, stock))
-
+		r, err = conn.Do(command, user+accountSuffix, stock)
 	}
 	conn.Close()
-	return r, err
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	// A user that has never held the stock has none
+	return u.decodeShares(r)
 }
 
 // DeleteKey deletes a key in the database
@@ -1,14 +1,14 @@
 package database
 
 import (
-	"fmt"
 	"testing"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
 
 func TestAddUser(t *testing.T) {
-	db := RedisDatabase{"tcp", ":6379"}
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
 	_, err := db.GetUserInfo("AAA")
 	if err != nil {
 		t.Error(err)
@@ -16,7 +16,7 @@ func TestAddUser(t *testing.T) {
 }
 
 func TestAddFunds(t *testing.T) {
-	db := RedisDatabase{"tcp", ":6379"}
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
 	dollar, err := decimal.NewFromString("23.01")
 	err2 := db.AddFunds("AAA", dollar)
 	if err != nil || err2 != nil {
@@ -26,20 +26,41 @@ func TestAddFunds(t *testing.T) {
 }
 
 func TestGetUserInfo(t *testing.T) {
-	db := RedisDatabase{"tcp", ":6379"}
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
 	dollar, _ := decimal.NewFromString("23.01")
 	db.AddFunds("AAA", dollar)
 	r, error := db.GetUserInfo("AAA")
 	if error != nil {
 		t.Error(error)
-	} else {
-		fmt.Println("%v", r)
+	} else if !r.Balance.Equal(dollar) {
+		t.Error("Wrong balance in user info, should be 23.01, is", r.Balance)
 	}
-	db.DeleteKey("AAA:Balance")
+	db.DeleteKey("AAA" + balanceSuffix)
+}
+
+func TestHistory(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	for i := 0; i < historyLength+5; i++ {
+		err := db.AddHistory("historian", HistoryEntry{TransNum: i, Command: "ADD", Funds: decimal.NewFromFloat(1.5)})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	info, err := db.GetUserInfo("historian")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(info.History) != historyLength {
+		t.Error("History should be trimmed to", historyLength, "entries, has", len(info.History))
+	} else if info.History[historyLength-1].TransNum != historyLength+4 {
+		t.Error("Most recent history entry should be last")
+	}
+	db.DeleteKey("historian:History")
 }
 
 func TestRemoveFunds(t *testing.T) {
-	db := RedisDatabase{"tcp", ":6379"}
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
 	dollar, err := decimal.NewFromString("23.01")
 	err2 := db.AddFunds("F", dollar)
 	if err != nil || err2 != nil {
@@ -51,11 +72,11 @@ func TestRemoveFunds(t *testing.T) {
 	if zero.String() != "0" {
 		t.Error("Account should be 0")
 	}
-	db.DeleteKey("F:Balance")
+	db.DeleteKey("F" + balanceSuffix)
 }
 
 func TestGetFunds(t *testing.T) {
-	db := RedisDatabase{"tcp", ":6379"}
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
 	dollar, err := decimal.NewFromString("23.01")
 
 	err2 := db.AddFunds("fundGetter", dollar)
@@ -68,47 +89,167 @@ func TestGetFunds(t *testing.T) {
 	if amount.String() != dollar.String() {
 		t.Error("Amounts not equal, 23.01,", amount)
 	}
-	db.DeleteKey("fundGetter:Balance")
+	db.DeleteKey("fundGetter" + balanceSuffix)
 }
 
 func TestStocks(t *testing.T) {
-	db := RedisDatabase{"tcp", ":6379"}
-	db.AddStock("F", "stockname", 22)
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	db.AddStock("F", "stockname", decimal.New(22, 0))
 
 	amt, _ := db.GetStock("F", "stockname")
-	if amt != 22 {
+	if !amt.Equal(decimal.New(22, 0)) {
 		t.Error("Wrong value for stocks, should be 22, is ", amt)
 	}
 
 	amt, _ = db.GetStock("F", "wrongstockname")
-	if amt != 0 {
+	if !amt.IsZero() {
 		t.Error("Should get no value for stocks")
 	}
 
-	err := db.RemoveStock("F", "stockname", 2)
+	err := db.RemoveStock("F", "stockname", decimal.New(2, 0))
 	if err != nil {
 		t.Error(err)
 	}
 
 	amt, err = db.GetStock("F", "stockname")
-	if amt != 20 {
+	if !amt.Equal(decimal.New(20, 0)) {
 		t.Error("Failed to remove stock")
 	} else if err != nil {
 		t.Error(err)
 	}
 
-	db.DeleteKey("F:Stocks")
+	db.DeleteKey("F" + stocksSuffix)
 }
 
 func TestOrders(t *testing.T) {
-	db := RedisDatabase{"tcp", ":6379"}
-	err := db.PushSell("SELLER", "AAA", decimal.NewFromFloat(11.11), 3)
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	err := db.PushSell("SELLER", "AAA", decimal.NewFromFloat(11.11), decimal.New(3, 0))
+	if err != nil {
+		t.Error(err)
+	}
+	err = db.PushSell("SELLER", "BBB", decimal.NewFromFloat(11.11), decimal.New(3, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestPlaceBuy(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	db.AddFunds("buyer", decimal.NewFromFloat(10))
+
+	_, err := db.PlaceBuy("buyer", "ABC", decimal.NewFromFloat(20), decimal.New(2, 0))
+	if err != ErrInsufficientFunds {
+		t.Error("Buy should fail with insufficient funds, got", err)
+	}
+
+	remaining, err := db.PlaceBuy("buyer", "ABC", decimal.NewFromFloat(8), decimal.New(2, 0))
 	if err != nil {
 		t.Error(err)
+	} else if !remaining.Equal(decimal.NewFromFloat(2)) {
+		t.Error("Remaining funds should be returned, got", remaining)
+	}
+	funds, _ := db.GetFunds("buyer")
+	if !funds.Equal(decimal.NewFromFloat(2)) {
+		t.Error("Cost should be removed from funds, have", funds)
 	}
-	err = db.PushSell("SELLER", "BBB", decimal.NewFromFloat(11.11), 3)
+
+	stock, _, shares, err := db.CommitBuy("buyer")
+	if err != nil || stock != "ABC" || !shares.Equal(decimal.New(2, 0)) {
+		t.Error("Wrong order committed", stock, shares, err)
+	}
+	held, _ := db.GetStock("buyer", "ABC")
+	if !held.Equal(decimal.New(2, 0)) {
+		t.Error("Shares should be added on commit, have", held)
+	}
+
+	_, _, _, err = db.CommitBuy("buyer")
+	if err != ErrNoPendingOrder {
+		t.Error("Commit with no pending buy should fail, got", err)
+	}
+	db.DeleteKey("buyer" + balanceSuffix)
+	db.DeleteKey("buyer" + stocksSuffix)
+}
+
+func TestExpireOrders(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	db.AddFunds("expirer", decimal.NewFromFloat(10))
+	_, err := db.PlaceBuy("expirer", "ABC", decimal.NewFromFloat(8), decimal.New(2, 0))
 	if err != nil {
 		t.Error(err)
 	}
 
+	expired, err := db.ExpireOrders(time.Now())
+	if err != nil || len(expired) != 0 {
+		t.Error("Order should not expire before the timeout", expired, err)
+	}
+
+	expired, err = db.ExpireOrders(time.Now().Add(OrderTimeout + time.Second))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(expired) != 1 || expired[0].User != "expirer" || expired[0].Type != "Buy" {
+		t.Error("Buy order should have expired", expired)
+	}
+	funds, _ := db.GetFunds("expirer")
+	if !funds.Equal(decimal.NewFromFloat(10)) {
+		t.Error("Expired buy should be refunded, have", funds)
+	}
+	db.DeleteKey("expirer" + balanceSuffix)
+}
+
+func TestTriggers(t *testing.T) {
+	db := NewRedisDatabase("tcp", ":6379", DefaultPoolConfig)
+	saved := TriggerRecord{
+		Type:          "BUY",
+		User:          "trigger,user",
+		Stock:         "ABC",
+		TransNum:      7,
+		BuySellAmount: decimal.NewFromFloat(100),
+		TriggerAmount: decimal.NewFromFloat(12.5),
+		Active:        true,
+	}
+	err := db.SaveTrigger(saved)
+	if err != nil {
+		t.Error(err)
+	}
+
+	trigs, err := db.GetTriggers()
+	if err != nil {
+		t.Error(err)
+	}
+	found := false
+	for _, trig := range trigs {
+		if trig.Type == saved.Type && trig.User == saved.User && trig.Stock == saved.Stock {
+			found = trig.Active && trig.TransNum == 7 && trig.TriggerAmount.Equal(saved.TriggerAmount)
+		}
+	}
+	if !found {
+		t.Error("Saved trigger was not restored", trigs)
+	}
+
+	db.DeleteTrigger("BUY", "trigger,user", "ABC")
+	trigs, _ = db.GetTriggers()
+	for _, trig := range trigs {
+		if trig.User == saved.User {
+			t.Error("Trigger should have been deleted")
+		}
+	}
+}
+
+func TestUnreachableDatabase(t *testing.T) {
+	db := NewRedisDatabase("tcp", "127.0.0.1:1", PoolConfig{MaxActive: 2})
+	_, err := db.GetFunds("AAA")
+	if err == nil {
+		t.Error("Expected an error from an unreachable database")
+	}
+	_, _, _, err = db.CommitBuy("AAA")
+	if err == nil {
+		t.Error("Expected an error from an unreachable database")
+	}
+
+	stats := db.Stats()
+	if stats.DialFailures != 2 || stats.ActiveCount != 0 || stats.MaxActive != 2 {
+		t.Errorf("Unexpected pool stats %+v", stats)
+	}
 }
@@ -0,0 +1,164 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"seng468/transaction-server/response"
+	"seng468/transaction-server/socketserver"
+	"strconv"
+	"strings"
+)
+
+// HTTPServer exposes the commands registered with a SocketServer as JSON
+// endpoints. Each command is served at its lowercased name, so
+//		POST /set_buy_amount {"transactionNum": 5, "user": "bob", "stock": "ABC", "amount": "10.00"}
+// runs SET_BUY_AMOUNT,bob,ABC,10.00 exactly as the socket server would.
+// Commands that only read, listed in readOnly, may also be sent as GET
+// requests with the same parameters in the query string. Every other command
+// must be POSTed, so link prefetchers, crawlers and cross-site links can't run
+// it. When transactionNum is left out the server assigns one, and every reply
+// carries the transaction number the command ran as in the Transaction-Num
+// header. GET /stats reports the health of the server's parts, such as its
+// database connections, for operators.
+type HTTPServer struct {
+	addr     string
+	commands socketserver.SocketServer
+	stats    map[string]func() interface{}
+}
+
+func NewHTTPServer(addr string, commands socketserver.SocketServer) HTTPServer {
+	return HTTPServer{
+		addr:     addr,
+		commands: commands,
+		stats:    make(map[string]func() interface{}),
+	}
+}
+
+// AddStats reports what report returns under name at GET /stats
+func (h HTTPServer) AddStats(name string, report func() interface{}) {
+	h.stats[name] = report
+}
+
+func (h HTTPServer) Run() {
+	fmt.Println("HTTP listening on " + h.addr)
+	err := http.ListenAndServe(h.addr, h)
+	if err != nil {
+		fmt.Println("Error listening:", err.Error())
+	}
+}
+
+// readOnly are the commands that don't change any state, so may be sent
+// with GET
+var readOnly = map[string]bool{
+	"QUOTE":           true,
+	"DISPLAY_SUMMARY": true,
+}
+
+// ServeHTTP runs the command named by the request path
+func (h HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	command := strings.ToUpper(strings.Trim(r.URL.Path, "/"))
+	if command == "STATS" {
+		h.serveStats(w, r)
+		return
+	}
+	if r.Method != http.MethodPost && (r.Method != http.MethodGet || !readOnly[command]) {
+		allow := http.MethodPost
+		if readOnly[command] {
+			allow = http.MethodGet + ", " + http.MethodPost
+		}
+		w.Header().Set("Allow", allow)
+		reply(w, http.StatusMethodNotAllowed, 0, response.Error(response.BadArguments,
+			"method "+r.Method+" is not allowed for "+command))
+		return
+	}
+
+	params, supplied, err := h.getParams(w, r)
+	transNum := 0
+	var res response.Response
+	if err != nil {
+		res = response.Error(response.BadArguments, err.Error())
+	} else {
+		transNum, res = h.commands.ExecuteNamed(supplied, command, params)
+	}
+	reply(w, statusCode(res.Code), transNum, res)
+}
+
+// serveStats replies with every report added with AddStats, by name
+func (h HTTPServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		reply(w, http.StatusMethodNotAllowed, 0, response.Error(response.BadArguments,
+			"method "+r.Method+" is not allowed for STATS"))
+		return
+	}
+	stats := make(map[string]interface{})
+	for name, report := range h.stats {
+		stats[name] = report()
+	}
+	reply(w, http.StatusOK, 0, response.Success(stats))
+}
+
+// reply writes the response as JSON, with the transaction number it ran as
+func reply(w http.ResponseWriter, status int, transNum int, res response.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Transaction-Num", strconv.Itoa(transNum))
+	w.WriteHeader(status)
+	fmt.Fprint(w, res.Encode(response.JSON))
+}
+
+// getParams reads the command parameters and the client's transaction number,
+// if it gave one, from the JSON body of a POST or the query string of a GET.
+// Bodies are limited to the same size as a socket server message.
+func (h HTTPServer) getParams(w http.ResponseWriter, r *http.Request) (map[string]string, string, error) {
+	params := make(map[string]string)
+	if r.Method == http.MethodGet {
+		for key, values := range r.URL.Query() {
+			params[key] = values[0]
+		}
+	} else {
+		var body map[string]interface{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, socketserver.MaxMessageSize)).Decode(&body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, "", fmt.Errorf("request body longer than %d bytes", tooLarge.Limit)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("request body is not a JSON object: %s", err.Error())
+		}
+		for key, value := range body {
+			switch v := value.(type) {
+			case string:
+				params[key] = v
+			case float64:
+				params[key] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				return nil, "", fmt.Errorf("parameter %s must be a string or number", key)
+			}
+		}
+	}
+
+	supplied := params["transactionNum"]
+	delete(params, "transactionNum")
+	return params, supplied, nil
+}
+
+// statusCode returns the HTTP status for a response code
+func statusCode(code response.Code) int {
+	switch code {
+	case response.OK:
+		return http.StatusOK
+	case response.UnknownCommand:
+		return http.StatusNotFound
+	case response.BadArguments:
+		return http.StatusBadRequest
+	case response.DuplicateTransNum, response.InsufficientFunds, response.InsufficientStock,
+		response.NoPendingOrder, response.OrderExpired, response.NoTrigger, response.TriggerExists:
+		return http.StatusConflict
+	case response.QuoteUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
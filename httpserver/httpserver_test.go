@@ -0,0 +1,70 @@
+package httpserver
+
+import (
+	"net/http/httptest"
+	"seng468/transaction-server/response"
+	"seng468/transaction-server/socketserver"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCommandEndpoints(t *testing.T) {
+	commands := socketserver.NewSocketServer("")
+	commands.Route("ADD,<user>,<amount>", func(transNum int, args ...string) response.Response {
+		return response.Success(strconv.Itoa(transNum) + ":" + strings.Join(args, ":"))
+	})
+	commands.Route("COMMIT_BUY,<user>", func(transNum int, args ...string) response.Response {
+		return response.Error(response.NoPendingOrder, "No pending buy orders to commit")
+	})
+	commands.Route("QUOTE,<user>,<stock>", func(transNum int, args ...string) response.Response {
+		return response.Success(strconv.Itoa(transNum) + ":" + strings.Join(args, ":"))
+	})
+	server := NewHTTPServer("", commands)
+	server.AddStats("quotes", func() interface{} { return map[string]int{"Queries": 3} })
+
+	cases := []struct {
+		method string
+		target string
+		body   string
+		status int
+		reply  string
+	}{
+		{"POST", "/add", `{"transactionNum": 4, "user": "bob", "amount": 10.5}`, 200,
+			`{"status":"ok","code":"OK","data":"4:bob:10.5"}`},
+		{"GET", "/quote?user=bob&stock=ABC", "", 200,
+			`{"status":"ok","code":"OK","data":"1:bob:ABC"}`},
+		{"GET", "/add?user=bob&amount=3", "", 405,
+			`{"status":"error","code":"BAD_ARGUMENTS","message":"method GET is not allowed for ADD"}`},
+		{"PUT", "/quote", `{"user": "bob", "stock": "ABC"}`, 405, ""},
+		{"POST", "/quote", `{"user": "bob", "stock": "ABC"}`, 200,
+			`{"status":"ok","code":"OK","data":"2:bob:ABC"}`},
+		{"POST", "/add", `{"transactionNum": 4, "user": "bob", "amount": 1}`, 409,
+			`{"status":"error","code":"DUPLICATE_TRANSACTION","message":"transaction number 4 has already been used"}`},
+		{"POST", "/add", `{"transactionNum": "four", "user": "bob", "amount": 1}`, 400,
+			`{"status":"error","code":"BAD_ARGUMENTS","message":"invalid transaction number 'four'"}`},
+		{"POST", "/commit_buy", `{"user": "bob"}`, 409,
+			`{"status":"error","code":"NO_PENDING_ORDER","message":"No pending buy orders to commit"}`},
+		{"POST", "/add", `{"user": "bob"}`, 400,
+			`{"status":"error","code":"BAD_ARGUMENTS","message":"bad arguments: ADD does not take the parameters [user]"}`},
+		{"POST", "/add", `not json`, 400, ""},
+		{"POST", "/add", `{"user": "` + strings.Repeat("a", socketserver.MaxMessageSize) + `", "amount": 1}`, 400,
+			`{"status":"error","code":"BAD_ARGUMENTS","message":"request body longer than 65536 bytes"}`},
+		{"GET", "/stats", "", 200,
+			`{"status":"ok","code":"OK","data":{"quotes":{"Queries":3}}}`},
+		{"POST", "/stats", "", 405, ""},
+		{"POST", "/sell_everything", `{}`, 404,
+			`{"status":"error","code":"UNKNOWN_COMMAND","message":"unknown command: SELL_EVERYTHING"}`},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d", c.method, c.target, c.status, rec.Code)
+		}
+		if c.reply != "" && rec.Body.String() != c.reply {
+			t.Errorf("%s %s: expected reply %s, got %s", c.method, c.target, c.reply, rec.Body.String())
+		}
+	}
+}
@@ -1,152 +1,112 @@
 package logger
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"strconv"
 	"time"
-
-	"github.com/shopspring/decimal"
 )
 
+// Logger records events in the audit log. Handlers call it inline, so
+// implementations shouldn't wait on a remote audit server, as BatchLogger
+// doesn't.
 type Logger interface {
-	QuoteServer(server string, transNum int,
-		price string, stock string, user string, qsTime uint64, key string)
-
-	AccountTransaction(server string, transNum int,
-		action string, user interface{}, funds interface{})
-
-	SystemError(server string, transNum int,
-		command string, user interface{}, stock interface{},
-		filename interface{},
-		funds interface{}, errorMsg interface{})
+	// Log records the event, unless it is invalid
+	Log(event Event)
 
-	SystemEvent(server string, transNum int,
-		command string, username interface{}, stock interface{},
-		filename interface{}, funds interface{})
-
-	DumpLog(filename string, username interface{})
+	// DumpLog writes the audit log to filename, or only the user's events
+	// if username isn't empty. It may wait on the store or audit server, so
+	// handlers run it in the background.
+	DumpLog(filename string, username string)
 }
 
+// AuditLogger sends events to the audit server at Addr, one request per event
 type AuditLogger struct {
 	Addr string
+
+	batch *BatchLogger
 }
 
-func (al AuditLogger) DumpLog(filename string, username interface{}) {
+func (al AuditLogger) DumpLog(filename string, username string) {
 	params := map[string]string{
 		"filename": filename,
 	}
-	if username != nil {
-		params["username"] = username.(string)
+	if username != "" {
+		params["username"] = username
 	}
 	al.SendLog("/dumpLog", params)
 }
 
-func (al AuditLogger) SystemEvent(server string, transNum int, command string, username interface{}, stock interface{},
-	filename interface{}, funds interface{}) {
-	params := map[string]string{
-		"server":         server,
-		"transactionNum": strconv.Itoa(transNum),
-		"command":        command,
-	}
-	if username != nil {
-		params["username"] = username.(string)
-	}
-	if stock != nil {
-		params["stockSymbol"] = stock.(string)
-	}
-	if filename != nil {
-		params["filename"] = filename.(string)
-	}
-	if funds != nil {
-		params["funds"] = funds.(decimal.Decimal).String()
-	}
-	al.SendLog("/systemEvent", params)
-}
-
-func (al AuditLogger) SystemError(server string, transNum int, command string, user interface{}, stock interface{}, filename interface{},
-	funds interface{}, errorMsg interface{}) {
-	params := map[string]string{
-		"server":         server,
-		"transactionNum": strconv.Itoa(transNum),
-		"command":        command,
-	}
-	if user != nil {
-		params["username"] = user.(string)
-	}
-	if stock != nil {
-		params["stockSymbol"] = stock.(string)
-	}
-	if filename != nil {
-		params["filename"] = filename.(string)
-	}
-	if funds != nil {
-		params["funds"] = funds.(decimal.Decimal).String()
+// Log sends the event to the audit server at the path named for its type,
+// such as "/userCommand", with its fields as the query. Invalid events are
+// printed and dropped.
+func (al AuditLogger) Log(event Event) {
+	if err := event.Validate(); err != nil {
+		fmt.Println("Error logging audit event:", err.Error())
+		return
 	}
-	if errorMsg != nil {
-		params["errorMessage"] = errorMsg.(string)
+	e := event.entry()
+	params := make(map[string]string)
+	for _, field := range e.fields() {
+		if field[0] != "timestamp" && field[1] != "" {
+			params[field[0]] = field[1]
+		}
 	}
-	al.SendLog("/errorEvent", params)
+	al.SendLog("/"+e.Type, params)
 }
 
-func (al AuditLogger) AccountTransaction(server string, transactionNum int, action string, user interface{}, funds interface{}) {
-	params := map[string]string{
-		"server":         server,
-		"transactionNum": strconv.Itoa(transactionNum),
-		"action":         action,
-	}
-	if user != nil {
-		params["username"] = user.(string)
+// SendLog sends the event to the audit server at the path. An AuditLogger
+// from a BatchLogger queues it to be sent in a batch instead.
+func (al AuditLogger) SendLog(slash string, params map[string]string) {
+	if al.batch != nil {
+		al.batch.enqueue(event{Path: slash, Params: params})
+		return
 	}
-	if funds != nil {
-		params["funds"] = funds.(decimal.Decimal).String()
+	if _, err := deliver(directClient, al.Addr, event{Path: slash, Params: params}); err != nil {
+		fmt.Printf("Error connecting to the audit server for  %s command:  %s", slash, err.Error())
 	}
-	al.SendLog("/accountTransaction", params)
 }
 
-func (al AuditLogger) QuoteServer(server string, transactionNum int,
-	price string, stock string, user string, qsTime uint64, key string) {
-	params := map[string]string{
-		"server":          server,
-		"transactionNum":  strconv.Itoa(transactionNum),
-		"price":           price,
-		"stockSymbol":     stock,
-		"username":        user,
-		"quoteServerTime": strconv.FormatUint(qsTime, 10),
-		"cryptokey":       key,
-	}
-	al.SendLog("/quoteServer", params)
+// directClient sends the events of AuditLoggers that aren't batched, closing
+// its connection after every event
+var directClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   0,
+			KeepAlive: 0,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableKeepAlives:   true,
+	},
 }
 
-func (al AuditLogger) SendLog(slash string, params map[string]string) {
-	req, err := http.NewRequest("GET", al.Addr+slash, nil)
-	req.Header.Set("Connection", "close")
+// deliver sends a single event to the audit server at addr. It returns false
+// if the audit server answered but rejected the event, and an error if the
+// event should be sent again.
+func deliver(client *http.Client, addr string, e event) (bool, error) {
+	req, err := http.NewRequest("GET", addr+e.Path, nil)
 	if err != nil {
-		log.Print(err)
-		return
+		return false, err
 	}
 
 	url := req.URL.Query()
-	for k, v := range params {
+	for k, v := range e.Params {
 		url.Add(k, v)
 	}
-
 	req.URL.RawQuery = url.Encode()
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   0,
-			KeepAlive: 0,
-		}).Dial,
-		TLSHandshakeTimeout: 10 * time.Second,
-	}
-	client := &http.Client{Transport: transport}
+
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("Error connecting to the audit server for  %s command:  %s", slash, err.Error())
-		return
+		return false, err
 	}
+	io.Copy(ioutil.Discard, resp.Body)
 	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return false, errors.New("audit server replied " + resp.Status)
+	}
+	return resp.StatusCode < 400, nil
 }
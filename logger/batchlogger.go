@@ -0,0 +1,515 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// event is a single entry for the audit server, sent as a request to Path
+// with Params as its query
+type event struct {
+	Path   string            `json:"path"`
+	Params map[string]string `json:"params"`
+}
+
+// BatchLogger is an AuditLogger that queues events and sends them to the
+// audit server in batches from a single goroutine, so logging never blocks a
+// handler. Events that can't be delivered are kept in an on-disk journal and
+// replayed once the audit server is reachable again.
+type BatchLogger struct {
+	AuditLogger
+
+	config   BatchConfig
+	client   *http.Client
+	queue    chan event
+	flushes  chan chan struct{}
+	done     chan struct{}
+	counters *batchCounters
+
+	// mu guards closed, so nothing is queued after the queue is closed
+	mu     sync.RWMutex
+	closed bool
+
+	// journalMu guards the journal file, which is appended to by handlers
+	// when the queue is full
+	journalMu sync.Mutex
+
+	// backoff and retryAt are only used by the sending goroutine
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// BatchConfig sets how a BatchLogger queues events, and how it handles the
+// audit server failing
+type BatchConfig struct {
+	// QueueSize is the most events waiting to be sent. Events logged while
+	// the queue is full are written to the journal instead.
+	QueueSize int
+	// BatchSize is the most events sent together
+	BatchSize int
+	// FlushInterval is the longest an event waits for its batch to fill
+	FlushInterval time.Duration
+	// Timeout bounds each request to the audit server
+	Timeout time.Duration
+	// Retries is how many more times a failed batch is sent.
+	// Negative disables retrying.
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubling for each
+	// retry after it
+	RetryBackoff time.Duration
+	// MaxBackoff is the longest batches go straight to the journal, without
+	// trying the audit server, after it has failed
+	MaxBackoff time.Duration
+	// Journal is the file events are kept in while the audit server is
+	// unreachable
+	Journal string
+}
+
+// DefaultBatchConfig is used for any BatchConfig fields left zero
+var DefaultBatchConfig = BatchConfig{
+	QueueSize:     4096,
+	BatchSize:     100,
+	FlushInterval: 100 * time.Millisecond,
+	Timeout:       5 * time.Second,
+	Retries:       3,
+	RetryBackoff:  50 * time.Millisecond,
+	MaxBackoff:    30 * time.Second,
+	Journal:       "audit.journal",
+}
+
+// BatchStats is a snapshot of a BatchLogger's progress
+type BatchStats struct {
+	// Logged counts every event logged
+	Logged uint64
+	// Sent counts the events accepted by the audit server
+	Sent uint64
+	// Rejected counts the events the audit server refused, which are not
+	// sent again
+	Rejected uint64
+	// Batches counts the batches sent
+	Batches uint64
+	// Retries counts the attempts made after sending a batch failed
+	Retries uint64
+	// Journaled counts the events written to the journal
+	Journaled uint64
+	// Replayed counts the events from the journal sent to the audit server
+	Replayed uint64
+	// Lost counts the events that could be neither sent nor journaled
+	Lost uint64
+	// Queued is the number of events waiting to be sent
+	Queued int
+	// Pending is the number of events in the journal waiting to be replayed
+	Pending int64
+}
+
+type batchCounters struct {
+	logged    uint64
+	sent      uint64
+	rejected  uint64
+	batches   uint64
+	retries   uint64
+	journaled uint64
+	replayed  uint64
+	lost      uint64
+	pending   int64
+}
+
+// NewBatchLogger returns a BatchLogger for the audit server at addr, with its
+// queue and failure handling set by config. Events left in the journal by an
+// earlier run are replayed once the audit server is reachable.
+func NewBatchLogger(addr string, config BatchConfig) *BatchLogger {
+	if config.QueueSize == 0 {
+		config.QueueSize = DefaultBatchConfig.QueueSize
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultBatchConfig.BatchSize
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultBatchConfig.FlushInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultBatchConfig.Timeout
+	}
+	if config.Retries == 0 {
+		config.Retries = DefaultBatchConfig.Retries
+	} else if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = DefaultBatchConfig.RetryBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = DefaultBatchConfig.MaxBackoff
+	}
+	if config.Journal == "" {
+		config.Journal = DefaultBatchConfig.Journal
+	}
+
+	b := &BatchLogger{
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		queue:    make(chan event, config.QueueSize),
+		flushes:  make(chan chan struct{}),
+		done:     make(chan struct{}),
+		counters: new(batchCounters),
+	}
+	b.AuditLogger = AuditLogger{Addr: addr, batch: b}
+	b.counters.pending = int64(countLines(b.config.Journal) + countLines(b.replayPath()))
+	go b.run()
+	return b
+}
+
+// Flush waits until every event logged so far has been sent or journaled
+func (b *BatchLogger) Flush() {
+	reply := make(chan struct{})
+	select {
+	case b.flushes <- reply:
+		<-reply
+	case <-b.done:
+	}
+}
+
+// DumpLog asks the audit server to dump its log, once every event logged so
+// far has been sent or journaled ahead of the request, so none are missing
+// from the dump. It waits on the audit server, so shouldn't be called inline.
+func (b *BatchLogger) DumpLog(filename string, username string) {
+	b.Flush()
+	b.AuditLogger.DumpLog(filename, username)
+}
+
+// Close sends or journals every queued event and stops the logger. Events
+// logged after Close go straight to the journal.
+func (b *BatchLogger) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
+
+// Stats returns a snapshot of the logger's progress
+func (b *BatchLogger) Stats() BatchStats {
+	return BatchStats{
+		Logged:    atomic.LoadUint64(&b.counters.logged),
+		Sent:      atomic.LoadUint64(&b.counters.sent),
+		Rejected:  atomic.LoadUint64(&b.counters.rejected),
+		Batches:   atomic.LoadUint64(&b.counters.batches),
+		Retries:   atomic.LoadUint64(&b.counters.retries),
+		Journaled: atomic.LoadUint64(&b.counters.journaled),
+		Replayed:  atomic.LoadUint64(&b.counters.replayed),
+		Lost:      atomic.LoadUint64(&b.counters.lost),
+		Queued:    len(b.queue),
+		Pending:   atomic.LoadInt64(&b.counters.pending),
+	}
+}
+
+// enqueue queues the event to be sent, or journals it if the queue is full
+func (b *BatchLogger) enqueue(e event) {
+	atomic.AddUint64(&b.counters.logged, 1)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if !b.closed {
+		select {
+		case b.queue <- e:
+			return
+		default:
+		}
+	}
+	b.spill([]event{e})
+}
+
+// run collects queued events into batches and ships them, until the queue
+// is closed
+func (b *BatchLogger) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]event, 0, b.config.BatchSize)
+	for {
+		select {
+		case e, ok := <-b.queue:
+			if !ok {
+				b.ship(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) < b.config.BatchSize {
+				continue
+			}
+		case reply := <-b.flushes:
+			batch = b.drain(batch)
+			close(reply)
+			continue
+		case <-ticker.C:
+		}
+		b.ship(batch)
+		batch = batch[:0]
+	}
+}
+
+// drain ships the batch along with every event waiting in the queue, and
+// returns the emptied batch
+func (b *BatchLogger) drain(batch []event) []event {
+	for {
+		select {
+		case e, ok := <-b.queue:
+			if ok {
+				batch = append(batch, e)
+				if len(batch) < b.config.BatchSize {
+					continue
+				}
+			}
+			b.ship(batch)
+			batch = batch[:0]
+			if !ok {
+				return batch
+			}
+		default:
+			b.ship(batch)
+			return batch[:0]
+		}
+	}
+}
+
+// ship sends the batch to the audit server, journaling whatever can't be
+// sent. The journal is replayed first, so events are sent in the order they
+// were logged where possible.
+func (b *BatchLogger) ship(batch []event) {
+	if atomic.LoadInt64(&b.counters.pending) > 0 && b.available() {
+		b.replay()
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if atomic.LoadInt64(&b.counters.pending) > 0 || !b.available() {
+		b.spill(batch)
+		return
+	}
+	if sent := b.send(batch); sent < len(batch) {
+		b.spill(batch[sent:])
+	}
+}
+
+// available returns false while backing off from a failed audit server
+func (b *BatchLogger) available() bool {
+	return !time.Now().Before(b.retryAt)
+}
+
+// send sends the events to the audit server in order, retrying with backoff,
+// and returns how many were sent. If it gives up, nothing more is sent until
+// the backoff has passed, and the backoff is doubled for the next failure.
+func (b *BatchLogger) send(events []event) int {
+	sent := 0
+	wait := b.config.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var n int
+		n, err = b.post(events[sent:])
+		sent += n
+		if err == nil {
+			atomic.AddUint64(&b.counters.batches, 1)
+			b.backoff = 0
+			return sent
+		}
+		if attempt == b.config.Retries {
+			break
+		}
+		atomic.AddUint64(&b.counters.retries, 1)
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	if b.backoff == 0 {
+		b.backoff = b.config.RetryBackoff
+	} else if b.backoff *= 2; b.backoff > b.config.MaxBackoff {
+		b.backoff = b.config.MaxBackoff
+	}
+	b.retryAt = time.Now().Add(b.backoff)
+	fmt.Println("Audit server unreachable, journaling events for", b.backoff.String()+":", err.Error())
+	return sent
+}
+
+// post sends each event to the audit server over the logger's connections,
+// stopping at the first that fails. Returns how many were sent.
+func (b *BatchLogger) post(events []event) (int, error) {
+	for i, e := range events {
+		accepted, err := deliver(b.client, b.Addr, e)
+		if err != nil {
+			return i, err
+		}
+		if accepted {
+			atomic.AddUint64(&b.counters.sent, 1)
+		} else {
+			atomic.AddUint64(&b.counters.rejected, 1)
+			fmt.Println("Audit server rejected event for", e.Path)
+		}
+	}
+	return len(events), nil
+}
+
+// spill appends the events to the journal, one JSON object per line
+func (b *BatchLogger) spill(events []event) {
+	b.journalMu.Lock()
+	defer b.journalMu.Unlock()
+	err := appendJournal(b.config.Journal, events)
+	if err != nil {
+		atomic.AddUint64(&b.counters.lost, uint64(len(events)))
+		fmt.Println("Error journaling", len(events), "audit events:", err.Error())
+		return
+	}
+	atomic.AddUint64(&b.counters.journaled, uint64(len(events)))
+	atomic.AddInt64(&b.counters.pending, int64(len(events)))
+}
+
+// replay sends the journaled events to the audit server, until the journal
+// is empty or the audit server fails
+func (b *BatchLogger) replay() {
+	for atomic.LoadInt64(&b.counters.pending) > 0 && b.replayJournal() {
+	}
+}
+
+// replayJournal sends the events in the journal to the audit server, and
+// returns false if any are left. The journal is moved aside first, so events
+// spilled while replaying start a new one. Whatever can't be sent is kept to
+// be replayed next time.
+func (b *BatchLogger) replayJournal() bool {
+	replayPath := b.replayPath()
+	b.journalMu.Lock()
+	if _, err := os.Stat(replayPath); os.IsNotExist(err) {
+		err = os.Rename(b.config.Journal, replayPath)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("Error replaying the audit journal:", err.Error())
+		}
+	}
+	b.journalMu.Unlock()
+
+	events, corrupt, err := readJournal(replayPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error replaying the audit journal:", err.Error())
+		}
+		return false
+	}
+	if corrupt > 0 {
+		atomic.AddUint64(&b.counters.lost, uint64(corrupt))
+		atomic.AddInt64(&b.counters.pending, -int64(corrupt))
+		fmt.Println("Skipped", corrupt, "corrupt events in the audit journal")
+	}
+
+	for start := 0; start < len(events); start += b.config.BatchSize {
+		end := start + b.config.BatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+		sent := b.send(events[start:end])
+		atomic.AddUint64(&b.counters.replayed, uint64(sent))
+		atomic.AddInt64(&b.counters.pending, -int64(sent))
+		if sent < end-start {
+			rest := events[start+sent:]
+			if err := writeJournal(replayPath, rest); err != nil {
+				fmt.Println("Error rewriting the audit journal:", err.Error())
+			}
+			return false
+		}
+	}
+	os.Remove(replayPath)
+	return true
+}
+
+// replayPath is where the journal is moved to while it is replayed
+func (b *BatchLogger) replayPath() string {
+	return b.config.Journal + ".replay"
+}
+
+// appendJournal appends the events to the journal at path, creating it if
+// it doesn't exist
+func appendJournal(path string, events []event) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeJournal replaces the journal at path with the events
+func writeJournal(path string, events []event) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := appendJournal(tmp, events); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJournal returns the events in the journal at path, and the number of
+// lines that weren't events
+func readJournal(path string) ([]event, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var events []event
+	corrupt := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Path == "" {
+			corrupt++
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, corrupt, scanner.Err()
+}
+
+// countLines returns the number of lines in the file at path, or 0 if it
+// can't be read
+func countLines(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
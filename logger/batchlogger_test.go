@@ -0,0 +1,195 @@
+package logger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// auditServer is a fake audit server recording the transaction numbers of
+// the events it accepts, in order. It fails every request while down is set.
+type auditServer struct {
+	*httptest.Server
+	down int32
+
+	mu       sync.Mutex
+	received []string
+}
+
+func newAuditServer() *auditServer {
+	s := &auditServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.mu.Lock()
+		s.received = append(s.received, r.URL.Query().Get("transactionNum"))
+		s.mu.Unlock()
+	}))
+	return s
+}
+
+func (s *auditServer) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&s.down, 1)
+	} else {
+		atomic.StoreInt32(&s.down, 0)
+	}
+}
+
+func (s *auditServer) events() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// testConfig keeps the journal in a temporary directory, and backs off only
+// briefly so tests don't wait long for the audit server to be retried
+func testConfig(t *testing.T) BatchConfig {
+	return BatchConfig{
+		BatchSize:     10,
+		FlushInterval: 10 * time.Millisecond,
+		Retries:       1,
+		RetryBackoff:  time.Millisecond,
+		MaxBackoff:    5 * time.Millisecond,
+		Journal:       filepath.Join(t.TempDir(), "audit.journal"),
+	}
+}
+
+func logEvents(l Logger, from int, to int) {
+	for i := from; i < to; i++ {
+		l.Log(AccountTransaction{Server: "transactionserve", TransactionNum: i, Action: "add",
+			Username: "user1", Funds: decimal.New(int64(i), 0)})
+	}
+}
+
+func expectEvents(t *testing.T, got []string, from int, to int) {
+	t.Helper()
+	if len(got) != to-from {
+		t.Fatalf("Expected %d events, got %d: %v", to-from, len(got), got)
+	}
+	for i, num := range got {
+		if num != strconv.Itoa(from+i) {
+			t.Fatalf("Expected events %d to %d in order, got %v", from, to-1, got)
+		}
+	}
+}
+
+func TestBatchLoggerSendsInOrder(t *testing.T) {
+	server := newAuditServer()
+	defer server.Close()
+	l := NewBatchLogger(server.URL, testConfig(t))
+	defer l.Close()
+
+	logEvents(l, 1, 26)
+	l.Flush()
+	expectEvents(t, server.events(), 1, 26)
+	if stats := l.Stats(); stats.Logged != 25 || stats.Sent != 25 || stats.Journaled != 0 {
+		t.Errorf("Expected 25 events sent without journaling, got %+v", stats)
+	}
+}
+
+func TestBatchLoggerJournalsWhileAuditServerIsDown(t *testing.T) {
+	server := newAuditServer()
+	defer server.Close()
+	config := testConfig(t)
+	l := NewBatchLogger(server.URL, config)
+	defer l.Close()
+
+	server.setDown(true)
+	logEvents(l, 1, 21)
+	l.Flush()
+	if got := server.events(); len(got) != 0 {
+		t.Fatal("Expected no events accepted while the audit server is down, got", got)
+	}
+	if stats := l.Stats(); stats.Journaled != 20 || stats.Pending != 20 || stats.Retries == 0 {
+		t.Fatalf("Expected 20 events journaled after retrying, got %+v", stats)
+	}
+	// The journal may have been moved aside to be replayed
+	if countLines(config.Journal)+countLines(l.replayPath()) != 20 {
+		t.Fatal("Expected 20 events in the journal")
+	}
+
+	// Once the audit server is back, the journal is replayed before the
+	// events logged since
+	server.setDown(false)
+	time.Sleep(2 * config.MaxBackoff)
+	logEvents(l, 21, 26)
+	l.Flush()
+	expectEvents(t, server.events(), 1, 26)
+	if stats := l.Stats(); stats.Replayed != 20 || stats.Pending != 0 || stats.Lost != 0 {
+		t.Errorf("Expected the journal replayed, got %+v", stats)
+	}
+}
+
+func TestBatchLoggerCloseFlushes(t *testing.T) {
+	server := newAuditServer()
+	defer server.Close()
+	config := testConfig(t)
+	config.FlushInterval = time.Hour
+	l := NewBatchLogger(server.URL, config)
+
+	logEvents(l, 1, 6)
+	l.Close()
+	expectEvents(t, server.events(), 1, 6)
+
+	// Events logged after closing are kept for the next run
+	logEvents(l, 6, 8)
+	if stats := l.Stats(); stats.Journaled != 2 {
+		t.Fatalf("Expected the events logged after closing journaled, got %+v", stats)
+	}
+	config.FlushInterval = 0
+	next := NewBatchLogger(server.URL, config)
+	defer next.Close()
+	if stats := next.Stats(); stats.Pending != 2 {
+		t.Fatalf("Expected 2 events pending from the last run, got %+v", stats)
+	}
+	next.Flush()
+	expectEvents(t, server.events(), 1, 8)
+}
+
+func TestBatchLoggerDumpLogSendsQueuedEventsFirst(t *testing.T) {
+	server := newAuditServer()
+	defer server.Close()
+	config := testConfig(t)
+	config.FlushInterval = time.Hour
+	l := NewBatchLogger(server.URL, config)
+	defer l.Close()
+
+	logEvents(l, 1, 6)
+	l.DumpLog("log.xml", "")
+	l.Flush()
+	got := server.events()
+	if len(got) != 6 || got[5] != "" {
+		t.Fatal("Expected the dump requested after 5 events, got", got)
+	}
+	expectEvents(t, got[:5], 1, 6)
+}
+
+func TestJournalSkipsCorruptEvents(t *testing.T) {
+	config := testConfig(t)
+	events := []event{{Path: "/systemEvent", Params: map[string]string{"transactionNum": "1"}}}
+	if err := appendJournal(config.Journal, events); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(config.Journal, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{\"path\":\"/sys\n")
+	f.Close()
+
+	got, corrupt, err := readJournal(config.Journal)
+	if err != nil || len(got) != 1 || got[0].Params["transactionNum"] != "1" || corrupt != 1 {
+		t.Errorf("Expected 1 event and 1 corrupt line, got %v, %d, %v", got, corrupt, err)
+	}
+}
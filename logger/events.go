@@ -0,0 +1,282 @@
+package logger
+
+import (
+	"encoding/xml"
+	"strconv"
+
+	"github.com/shopspring/decimal"
+)
+
+// Event is an entry for the audit log: a UserCommand, QuoteServer,
+// AccountTransaction, SystemEvent or ErrorEvent. Optional fields are left
+// empty, or nil for funds, when they don't apply.
+type Event interface {
+	// Validate returns an EventError if a required field is missing or a
+	// field's value is invalid
+	Validate() error
+
+	entry() entry
+}
+
+// EventError is returned for an event that can't be logged
+type EventError struct {
+	// Type is the event's type in the audit log, such as "userCommand"
+	Type string
+	// Reason describes what was wrong with it
+	Reason string
+}
+
+func (e *EventError) Error() string {
+	return "invalid " + e.Type + " event: " + e.Reason
+}
+
+// UserCommand is a command as it was sent by a user, before it runs
+type UserCommand struct {
+	Server         string
+	TransactionNum int
+	Command        string
+	Username       string
+	StockSymbol    string
+	Filename       string
+	Funds          *decimal.Decimal
+}
+
+// QuoteServer is a quote received from the quote server
+type QuoteServer struct {
+	Server          string
+	TransactionNum  int
+	Price           decimal.Decimal
+	StockSymbol     string
+	Username        string
+	QuoteServerTime uint64
+	Cryptokey       string
+}
+
+// AccountTransaction is a change to the funds in a user's account
+type AccountTransaction struct {
+	Server         string
+	TransactionNum int
+	Action         string
+	Username       string
+	Funds          decimal.Decimal
+}
+
+// SystemEvent is something the server did while running a command, or on
+// its own such as expiring an order
+type SystemEvent struct {
+	Server         string
+	TransactionNum int
+	Command        string
+	Username       string
+	StockSymbol    string
+	Filename       string
+	Funds          *decimal.Decimal
+}
+
+// ErrorEvent is a command that failed, or an error the server ran into
+type ErrorEvent struct {
+	Server         string
+	TransactionNum int
+	Command        string
+	Username       string
+	StockSymbol    string
+	Filename       string
+	Funds          *decimal.Decimal
+	ErrorMessage   string
+}
+
+func (e UserCommand) Validate() error {
+	return validate(e.entry(), "command", e.Funds)
+}
+
+func (e QuoteServer) Validate() error {
+	if err := validate(e.entry(), "stockSymbol", nil); err != nil {
+		return err
+	}
+	if !e.Price.IsPositive() {
+		return &EventError{"quoteServer", "price is not positive"}
+	}
+	if e.Username == "" || e.QuoteServerTime == 0 || e.Cryptokey == "" {
+		return &EventError{"quoteServer", "username, quoteServerTime and cryptokey are required"}
+	}
+	return nil
+}
+
+func (e AccountTransaction) Validate() error {
+	if err := validate(e.entry(), "action", &e.Funds); err != nil {
+		return err
+	}
+	if e.Username == "" {
+		return &EventError{"accountTransaction", "username is required"}
+	}
+	return nil
+}
+
+func (e SystemEvent) Validate() error {
+	return validate(e.entry(), "command", e.Funds)
+}
+
+func (e ErrorEvent) Validate() error {
+	return validate(e.entry(), "command", e.Funds)
+}
+
+// validate checks the fields every event has, that the field named by
+// required is set, and that funds aren't negative
+func validate(e entry, required string, funds *decimal.Decimal) error {
+	if e.Server == "" {
+		return &EventError{e.Type, "server is required"}
+	}
+	if e.TransactionNum < 1 {
+		return &EventError{e.Type, "transactionNum " + strconv.Itoa(e.TransactionNum) + " is not positive"}
+	}
+	for _, field := range e.fields() {
+		if field[0] == required && field[1] == "" {
+			return &EventError{e.Type, required + " is required"}
+		}
+	}
+	if funds != nil && funds.IsNegative() {
+		return &EventError{e.Type, "funds " + funds.String() + " are negative"}
+	}
+	return nil
+}
+
+func (e UserCommand) entry() entry {
+	return entry{
+		Type:           "userCommand",
+		Server:         e.Server,
+		TransactionNum: e.TransactionNum,
+		Command:        e.Command,
+		Username:       e.Username,
+		StockSymbol:    e.StockSymbol,
+		Filename:       e.Filename,
+		Funds:          optionalFunds(e.Funds),
+	}
+}
+
+func (e QuoteServer) entry() entry {
+	return entry{
+		Type:            "quoteServer",
+		Server:          e.Server,
+		TransactionNum:  e.TransactionNum,
+		Price:           e.Price.StringFixed(2),
+		StockSymbol:     e.StockSymbol,
+		Username:        e.Username,
+		QuoteServerTime: e.QuoteServerTime,
+		Cryptokey:       e.Cryptokey,
+	}
+}
+
+func (e AccountTransaction) entry() entry {
+	return entry{
+		Type:           "accountTransaction",
+		Server:         e.Server,
+		TransactionNum: e.TransactionNum,
+		Action:         e.Action,
+		Username:       e.Username,
+		Funds:          e.Funds.String(),
+	}
+}
+
+func (e SystemEvent) entry() entry {
+	return entry{
+		Type:           "systemEvent",
+		Server:         e.Server,
+		TransactionNum: e.TransactionNum,
+		Command:        e.Command,
+		Username:       e.Username,
+		StockSymbol:    e.StockSymbol,
+		Filename:       e.Filename,
+		Funds:          optionalFunds(e.Funds),
+	}
+}
+
+func (e ErrorEvent) entry() entry {
+	return entry{
+		Type:           "errorEvent",
+		Server:         e.Server,
+		TransactionNum: e.TransactionNum,
+		Command:        e.Command,
+		Username:       e.Username,
+		StockSymbol:    e.StockSymbol,
+		Filename:       e.Filename,
+		Funds:          optionalFunds(e.Funds),
+		ErrorMessage:   e.ErrorMessage,
+	}
+}
+
+// entry is a single event in the audit log, as a FileLogger keeps it.
+// Fields that don't apply to its Type are left empty.
+type entry struct {
+	Type            string `json:"type"`
+	Timestamp       int64  `json:"timestamp"`
+	Server          string `json:"server"`
+	TransactionNum  int    `json:"transactionNum"`
+	Command         string `json:"command,omitempty"`
+	Action          string `json:"action,omitempty"`
+	Username        string `json:"username,omitempty"`
+	StockSymbol     string `json:"stockSymbol,omitempty"`
+	Filename        string `json:"filename,omitempty"`
+	Funds           string `json:"funds,omitempty"`
+	Price           string `json:"price,omitempty"`
+	QuoteServerTime uint64 `json:"quoteServerTime,omitempty"`
+	Cryptokey       string `json:"cryptokey,omitempty"`
+	ErrorMessage    string `json:"errorMessage,omitempty"`
+}
+
+// MarshalXML writes the entry as an element named for its type, with its
+// fields in the order the logfile schema gives for that type
+func (e entry) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: e.Type}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, field := range e.fields() {
+		if field[1] == "" {
+			continue
+		}
+		if err := enc.EncodeElement(field[1], xml.StartElement{Name: xml.Name{Local: field[0]}}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// fields returns the name and value of each of the entry's fields, in the
+// order the logfile schema gives for its type
+func (e entry) fields() [][2]string {
+	fields := [][2]string{
+		{"timestamp", strconv.FormatInt(e.Timestamp, 10)},
+		{"server", e.Server},
+		{"transactionNum", strconv.Itoa(e.TransactionNum)},
+	}
+	switch e.Type {
+	case "quoteServer":
+		return append(fields,
+			[2]string{"price", e.Price},
+			[2]string{"stockSymbol", e.StockSymbol},
+			[2]string{"username", e.Username},
+			[2]string{"quoteServerTime", strconv.FormatUint(e.QuoteServerTime, 10)},
+			[2]string{"cryptokey", e.Cryptokey})
+	case "accountTransaction":
+		return append(fields,
+			[2]string{"action", e.Action},
+			[2]string{"username", e.Username},
+			[2]string{"funds", e.Funds})
+	default:
+		return append(fields,
+			[2]string{"command", e.Command},
+			[2]string{"username", e.Username},
+			[2]string{"stockSymbol", e.StockSymbol},
+			[2]string{"filename", e.Filename},
+			[2]string{"funds", e.Funds},
+			[2]string{"errorMessage", e.ErrorMessage})
+	}
+}
+
+// optionalFunds returns the amount for an optional funds field, or "" for nil
+func optionalFunds(funds *decimal.Decimal) string {
+	if funds == nil {
+		return ""
+	}
+	return funds.String()
+}
@@ -0,0 +1,52 @@
+package logger
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestEventValidation(t *testing.T) {
+	funds := decimal.RequireFromString("10.00")
+	negative := decimal.RequireFromString("-10.00")
+	cases := []struct {
+		name  string
+		event Event
+		valid bool
+	}{
+		{"user command", UserCommand{Server: "ts", TransactionNum: 1, Command: "ADD", Username: "bob",
+			Funds: &funds}, true},
+		{"user command without funds", UserCommand{Server: "ts", TransactionNum: 1, Command: "COMMIT_BUY",
+			Username: "bob"}, true},
+		{"user command without command", UserCommand{Server: "ts", TransactionNum: 1}, false},
+		{"negative funds", UserCommand{Server: "ts", TransactionNum: 1, Command: "ADD", Funds: &negative}, false},
+		{"missing server", SystemEvent{TransactionNum: 1, Command: "ADD"}, false},
+		{"negative transaction", SystemEvent{Server: "ts", TransactionNum: -1, Command: "ADD"}, false},
+		{"zero transaction", SystemEvent{Server: "ts", Command: "CANCEL_BUY", Username: "bob"}, false},
+		{"system event", SystemEvent{Server: "ts", TransactionNum: 1, Command: "CANCEL_BUY", Username: "bob"}, true},
+		{"error event", ErrorEvent{Server: "ts", TransactionNum: 1, Command: "SELL",
+			ErrorMessage: "Not enough shares"}, true},
+		{"account transaction", AccountTransaction{Server: "ts", TransactionNum: 1, Action: "add",
+			Username: "bob", Funds: funds}, true},
+		{"account transaction without user", AccountTransaction{Server: "ts", TransactionNum: 1,
+			Action: "add", Funds: funds}, false},
+		{"account transaction without action", AccountTransaction{Server: "ts", TransactionNum: 1,
+			Username: "bob", Funds: funds}, false},
+		{"quote", QuoteServer{Server: "qs", TransactionNum: 1, Price: funds, StockSymbol: "ABC",
+			Username: "bob", QuoteServerTime: 1167631200000, Cryptokey: "key"}, true},
+		{"quote without price", QuoteServer{Server: "qs", TransactionNum: 1, StockSymbol: "ABC",
+			Username: "bob", QuoteServerTime: 1167631200000, Cryptokey: "key"}, false},
+		{"quote without key", QuoteServer{Server: "qs", TransactionNum: 1, Price: funds, StockSymbol: "ABC",
+			Username: "bob", QuoteServerTime: 1167631200000}, false},
+	}
+	for _, c := range cases {
+		err := c.event.Validate()
+		if c.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", c.name, err)
+		} else if !c.valid {
+			if _, ok := err.(*EventError); !ok {
+				t.Errorf("%s: expected an EventError, got %v", c.name, err)
+			}
+		}
+	}
+}
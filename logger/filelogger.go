@@ -0,0 +1,171 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileLogger keeps the audit log in an append-only file on local disk, one
+// JSON entry per line, so DUMPLOG works without the audit server.
+// Dumps are written to DumpDir in the standard XML logfile format.
+type FileLogger struct {
+	// DumpDir is the directory dumps are written to
+	DumpDir string
+
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+// NewFileLogger returns a FileLogger appending to the store at path, which
+// is created if it doesn't exist, and writing dumps to dumpDir
+func NewFileLogger(path string, dumpDir string) (*FileLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FileLogger{
+		DumpDir: dumpDir,
+		path:    path,
+		file:    file,
+		size:    info.Size(),
+	}, nil
+}
+
+// Close closes the store. Nothing more can be logged after.
+func (fl *FileLogger) Close() error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return fl.file.Close()
+}
+
+// Log appends the event to the store, or prints why it's invalid and drops it
+func (fl *FileLogger) Log(event Event) {
+	if err := event.Validate(); err != nil {
+		fmt.Println("Error logging audit event:", err.Error())
+		return
+	}
+	fl.append(event.entry())
+}
+
+// DumpLog writes every entry logged so far to filename in DumpDir, or only
+// the user's entries if username isn't empty. Only the base of filename is
+// used, so dumps can't be written outside of DumpDir.
+func (fl *FileLogger) DumpLog(filename string, username string) {
+	path := filepath.Join(fl.DumpDir, filepath.Base(filename))
+	if err := fl.dump(path, username); err != nil {
+		fmt.Println("Error dumping the audit log to", path+":", err.Error())
+	}
+}
+
+// append adds the entry to the end of the store, stamped with the time now
+func (fl *FileLogger) append(e entry) {
+	e.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	line, err := json.Marshal(e)
+	if err != nil {
+		fmt.Println("Error encoding", e.Type, "audit entry:", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	n, err := fl.file.Write(line)
+	fl.size += int64(n)
+	if err != nil {
+		fmt.Println("Error writing", e.Type, "audit entry:", err.Error())
+	}
+}
+
+// dump writes the entries in the store for the user, or every user if user
+// is empty, to the file at path. Entries logged while dumping are left out.
+func (fl *FileLogger) dump(path string, user string) error {
+	fl.mu.Lock()
+	size := fl.size
+	fl.mu.Unlock()
+
+	store, err := os.Open(fl.path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeDump(out, io.LimitReader(store, size), user)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeDump reads entries from the store and writes those for the user, or
+// every user if user is empty, as an XML logfile following the format of:
+//		<?xml version="1.0"?>
+//		<log>
+//			<userCommand>
+//				<timestamp>1167631200000</timestamp>
+//				<server>transactionserve</server>
+//				<transactionNum>1</transactionNum>
+//				<command>ADD</command>
+//				<username>jiosesdo</username>
+//				<funds>100.00</funds>
+//			</userCommand>
+//			...
+//		</log>
+// Lines in the store that can't be read, such as one cut off by a crash,
+// are skipped.
+func writeDump(w io.Writer, store io.Reader, user string) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("<?xml version=\"1.0\"?>\n<log>\n")
+	enc := xml.NewEncoder(buf)
+	enc.Indent("\t", "\t")
+
+	entries := 0
+	scanner := bufio.NewScanner(store)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Type == "" {
+			continue
+		}
+		if user != "" && e.Username != user {
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		entries++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	if entries > 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("</log>\n")
+	return buf.Flush()
+}
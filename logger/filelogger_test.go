@@ -0,0 +1,124 @@
+package logger
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// dumpedLog is the XML logfile, keeping each entry's element name and the
+// names of its fields in order
+type dumpedLog struct {
+	Entries []struct {
+		XMLName xml.Name
+		Fields  []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:",any"`
+}
+
+func readDump(t *testing.T, path string) dumpedLog {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "<?xml version=\"1.0\"?>\n<log>") {
+		t.Fatalf("Expected an XML log, got %q", data)
+	}
+	var log dumpedLog
+	if err := xml.Unmarshal(data, &log); err != nil {
+		t.Fatal("Expected a valid XML log, got", err)
+	}
+	return log
+}
+
+func TestFileLoggerDumpLog(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := NewFileLogger(filepath.Join(dir, "audit.log"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+
+	funds := decimal.RequireFromString("100.00")
+	fl.Log(UserCommand{Server: "transactionserve", TransactionNum: 1, Command: "ADD", Username: "user1",
+		Funds: &funds})
+	fl.Log(AccountTransaction{Server: "transactionserve", TransactionNum: 1, Action: "add",
+		Username: "user1", Funds: funds})
+	fl.Log(QuoteServer{Server: "quoteserve", TransactionNum: 2, Price: decimal.RequireFromString("12.50"),
+		StockSymbol: "ABC", Username: "user2", QuoteServerTime: 1167631200000, Cryptokey: "key"})
+	fl.Log(SystemEvent{Server: "transactionserve", TransactionNum: 3, Command: "COMMIT_BUY",
+		Username: "user1"})
+	fl.Log(ErrorEvent{Server: "transactionserve", TransactionNum: 4, Command: "SELL", Username: "user2",
+		StockSymbol: "ABC", ErrorMessage: "Not enough shares"})
+	// Invalid events are dropped
+	fl.Log(SystemEvent{TransactionNum: 5, Command: "ADD"})
+
+	fl.DumpLog("all.xml", "")
+	log := readDump(t, filepath.Join(dir, "all.xml"))
+	var types []string
+	for _, e := range log.Entries {
+		types = append(types, e.XMLName.Local)
+	}
+	if strings.Join(types, ",") != "userCommand,accountTransaction,quoteServer,systemEvent,errorEvent" {
+		t.Fatal("Expected every entry in the order logged, got", types)
+	}
+
+	// Fields follow the schema's order, and optional fields left out are
+	// omitted
+	var fields []string
+	for _, f := range log.Entries[2].Fields {
+		fields = append(fields, f.XMLName.Local+"="+f.Value)
+	}
+	if strings.Join(fields[1:], ",") != "server=quoteserve,transactionNum=2,price=12.50,stockSymbol=ABC,"+
+		"username=user2,quoteServerTime=1167631200000,cryptokey=key" {
+		t.Error("Expected the quoteServer fields in the schema's order, got", fields)
+	}
+	if len(log.Entries[3].Fields) != 5 {
+		t.Error("Expected the systemEvent without its optional fields, got", log.Entries[3].Fields)
+	}
+
+	// A user's dump only has their entries, and can't be written outside of
+	// the dump directory
+	fl.DumpLog("../user2.xml", "user2")
+	log = readDump(t, filepath.Join(dir, "user2.xml"))
+	if len(log.Entries) != 2 || log.Entries[0].XMLName.Local != "quoteServer" {
+		t.Error("Expected only user2's 2 entries, got", log.Entries)
+	}
+}
+
+func TestFileLoggerAppends(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	fl, err := NewFileLogger(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl.Log(SystemEvent{Server: "transactionserve", TransactionNum: 1, Command: "ADD", Username: "user1"})
+	fl.Close()
+
+	// An entry cut off by a crash is skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{\"type\":\"sys\n")
+	f.Close()
+
+	fl, err = NewFileLogger(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	fl.Log(SystemEvent{Server: "transactionserve", TransactionNum: 2, Command: "ADD", Username: "user1"})
+	fl.DumpLog("log.xml", "")
+	if log := readDump(t, filepath.Join(dir, "log.xml")); len(log.Entries) != 2 {
+		t.Error("Expected the entries from both runs, got", log.Entries)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"seng468/transaction-server/database"
+	"seng468/transaction-server/httpserver"
+	"seng468/transaction-server/logger"
+	"seng468/transaction-server/quote"
+	"seng468/transaction-server/response"
+	"seng468/transaction-server/socketserver"
+	"seng468/transaction-server/transactionserver"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// serverName is the server named in the audit log
+const serverName = "transactionserve"
+
+func main() {
+	serverAddr := os.Getenv("transaddr") + ":" + os.Getenv("transport")
+	httpAddr := os.Getenv("httpaddr") + ":" + os.Getenv("httpport")
+
+	server := socketserver.NewSocketServer(serverAddr)
+	if format, ok := response.ParseFormat(os.Getenv("respformat")); ok {
+		server.Format = format
+	}
+	userDatabase := newDatabase()
+	server.TransNums = userDatabase
+	logger, closeLogger := newLogger()
+	closeOnSignal(closeLogger)
+	server.Logger = logger
+	server.Name = serverName
+	quoteClient := quoteclient.NewQuoteClient(quoteAddr(), logger, quoteConfig())
+
+	// Only whole shares are traded unless shareprecision allows fractions of one
+	sharePrecision, _ := strconv.Atoi(os.Getenv("shareprecision"))
+	ts := transactionserver.NewTransactionServer(serverName, serverAddr, server,
+		logger, userDatabase, quoteClient, int32(sharePrecision))
+	ts.Start()
+	if os.Getenv("httpport") != "" {
+		httpServer := httpserver.NewHTTPServer(httpAddr, server)
+		addStats(httpServer, userDatabase, quoteClient, ts)
+		go httpServer.Run()
+	}
+	server.Run()
+}
+
+// addStats reports the health of the database, quote client and triggers at
+// the HTTP server's /stats endpoint
+func addStats(httpServer httpserver.HTTPServer, userDatabase database.UserDatabase,
+	quoteClient *quoteclient.QuoteClient, ts *transactionserver.TransactionServer) {
+	if redis, ok := userDatabase.(database.RedisDatabase); ok {
+		httpServer.AddStats("database", func() interface{} { return redis.Stats() })
+	}
+	httpServer.AddStats("quotes", func() interface{} { return quoteClient.Stats() })
+	httpServer.AddStats("triggers", func() interface{} { return ts.TriggerEngine.Metrics() })
+}
+
+// newDatabase returns the database named by dbtype, either "memory" to keep
+// everything in process, or redis at dbaddr:dbport by default. Balances left
+// in dollars and holdings left in whole shares by older versions are migrated
+// to cents and share units before starting.
+func newDatabase() database.UserDatabase {
+	if os.Getenv("dbtype") == "memory" {
+		fmt.Println("Using an in memory database, nothing will be saved")
+		return database.NewMemoryDatabase()
+	}
+	db := database.NewRedisDatabase("tcp", os.Getenv("dbaddr")+":"+os.Getenv("dbport"), dbPoolConfig())
+	migrated, err := db.MigrateFunds()
+	if err != nil {
+		fmt.Println("Error migrating balances to cents:", err.Error())
+	} else if migrated > 0 {
+		fmt.Println("Migrated", migrated, "balances to cents")
+	}
+	migrated, err = db.MigrateStocks()
+	if err != nil {
+		fmt.Println("Error migrating holdings to share units:", err.Error())
+	} else if migrated > 0 {
+		fmt.Println("Migrated", migrated, "holdings to share units")
+	}
+	return db
+}
+
+// dbPoolConfig reads the database connection pool limits from the environment,
+// leaving the defaults in place for any that are unset
+func dbPoolConfig() database.PoolConfig {
+	var config database.PoolConfig
+	config.MaxActive, _ = strconv.Atoi(os.Getenv("dbpoolsize"))
+	config.MaxIdle, _ = strconv.Atoi(os.Getenv("dbpoolidle"))
+	config.IdleTimeout, _ = time.ParseDuration(os.Getenv("dbidletimeout"))
+	return config
+}
+
+// quoteAddr returns the quote server at quoteaddr:quoteport, such as a
+// quotesim started for development, or the course quote server by default
+func quoteAddr() string {
+	if os.Getenv("quoteaddr") == "" {
+		return quoteclient.DefaultAddr
+	}
+	return os.Getenv("quoteaddr") + ":" + os.Getenv("quoteport")
+}
+
+// quoteConfig reads the quote client's connection and retry limits from the
+// environment, leaving the defaults in place for any that are unset
+func quoteConfig() quoteclient.Config {
+	var config quoteclient.Config
+	config.MaxIdle, _ = strconv.Atoi(os.Getenv("quotepoolidle"))
+	config.Retries, _ = strconv.Atoi(os.Getenv("quoteretries"))
+	config.ReadTimeout, _ = time.ParseDuration(os.Getenv("quotetimeout"))
+	config.BreakerCooldown, _ = time.ParseDuration(os.Getenv("quotecooldown"))
+	config.QuoteValidity, _ = time.ParseDuration(os.Getenv("quotevalidity"))
+	config.MaxStaleness, _ = time.ParseDuration(os.Getenv("quotemaxstale"))
+	config.BypassCacheForTrades = os.Getenv("quotefreshtrades") == "true"
+	return config
+}
+
+// newLogger returns the audit logger named by auditbackend, either "file" to
+// keep the log in auditstore and write dumps to auditdumpdir, or the audit
+// server at auditaddr:auditport by default. It also returns a function that
+// writes out anything the logger still holds.
+func newLogger() (logger.Logger, func()) {
+	if os.Getenv("auditbackend") == "file" {
+		store := os.Getenv("auditstore")
+		if store == "" {
+			store = "audit.log"
+		}
+		dumpDir := os.Getenv("auditdumpdir")
+		if dumpDir == "" {
+			dumpDir = "."
+		}
+		fileLogger, err := logger.NewFileLogger(store, dumpDir)
+		if err != nil {
+			fmt.Println("Error opening the audit log:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Keeping the audit log in", store)
+		return fileLogger, func() { fileLogger.Close() }
+	}
+	auditAddr := "http://" + os.Getenv("auditaddr") + ":" + os.Getenv("auditport")
+	batchLogger := logger.NewBatchLogger(auditAddr, auditConfig())
+	return batchLogger, batchLogger.Close
+}
+
+// auditConfig reads the audit logger's queue, retry and journal settings from
+// the environment, leaving the defaults in place for any that are unset
+func auditConfig() logger.BatchConfig {
+	var config logger.BatchConfig
+	config.QueueSize, _ = strconv.Atoi(os.Getenv("auditqueue"))
+	config.BatchSize, _ = strconv.Atoi(os.Getenv("auditbatch"))
+	config.Retries, _ = strconv.Atoi(os.Getenv("auditretries"))
+	config.MaxBackoff, _ = time.ParseDuration(os.Getenv("auditmaxbackoff"))
+	config.Journal = os.Getenv("auditjournal")
+	return config
+}
+
+// closeOnSignal closes the audit logger before the server is stopped, so no
+// events are lost
+func closeOnSignal(closeLogger func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Println("Received", sig.String()+", flushing audit events")
+		closeLogger()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,87 @@
+package quoteclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting the quote server while it is
+// considered unhealthy
+var ErrCircuitOpen = errors.New("quote server is unavailable, not retrying until it recovers")
+
+// Breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breaker is a circuit breaker in front of the quote server. It opens after
+// threshold queries in a row fail, rejecting queries until cooldown has
+// passed. A single query is then let through as a probe, closing the breaker
+// if it succeeds or opening it again if it fails.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	opens     uint64
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// allow reports whether a query may be sent to the quote server
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		// Only the probe is let through until it finishes
+		return false
+	}
+	return true
+}
+
+// success records a query that reached the quote server, returning whether
+// it closed the breaker
+func (b *breaker) success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	closed := b.state != BreakerClosed
+	b.state = BreakerClosed
+	b.failures = 0
+	return closed
+}
+
+// failure records a query that failed after all of its retries, returning
+// the number of failures in a row and whether it opened the breaker
+func (b *breaker) failure() (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		b.opens++
+		return b.failures, true
+	}
+	return b.failures, false
+}
+
+// stats returns the breaker's state and how many times it has opened
+func (b *breaker) stats() (string, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.opens
+}
@@ -4,86 +4,402 @@ import (
 	"bufio"
 	"fmt"
 	"net"
-	"regexp"
 	"seng468/transaction-server/logger"
-	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	"github.com/shopspring/decimal"
+	"golang.org/x/sync/singleflight"
 )
 
 type QuoteClientI interface {
 	Query(string, string, int) (decimal.Decimal, error)
+	QueryForTrade(string, string, int) (decimal.Decimal, error)
+	Flush(string) bool
 }
 
+// DefaultAddr is the address of the quote server
+const DefaultAddr = "quoteserve.seng:4444"
+
 type QuoteClient struct {
-	name   string
-	addr   string
-	cache  *cache.Cache
-	re     *regexp.Regexp
-	logger logger.Logger
+	name     string
+	addr     string
+	config   Config
+	cache    *cache.Cache
+	logger   logger.Logger
+	idle     chan *quoteConn
+	inflight singleflight.Group
+	breaker  *breaker
+	counters *counters
+}
+
+// Config sets how a QuoteClient connects to the quote server, and how it
+// handles the server failing
+type Config struct {
+	// MaxIdle is the most connections to the quote server kept open while unused
+	MaxIdle int
+	// DialTimeout bounds how long opening a connection can take
+	DialTimeout time.Duration
+	// ReadTimeout bounds how long the quote server can take to reply
+	ReadTimeout time.Duration
+	// Retries is how many more times a failed query is attempted.
+	// Negative disables retrying.
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubling for each
+	// retry after it
+	RetryBackoff time.Duration
+	// BreakerThreshold is how many queries in a row can fail, after their
+	// retries, before queries are rejected with ErrCircuitOpen
+	BreakerThreshold int
+	// BreakerCooldown is how long queries are rejected for before the quote
+	// server is tried again
+	BreakerCooldown time.Duration
+	// QuoteValidity is how long a quote can be used for after the time the
+	// quote server gave it. Quotes are cached until then.
+	QuoteValidity time.Duration
+	// MaxStaleness is the longest a quote is cached for, however long it is
+	// valid, in case the quote server's clock runs ahead
+	MaxStaleness time.Duration
+	// BypassCacheForTrades fetches a new quote for every QueryForTrade,
+	// so trades are never priced from the cache
+	BypassCacheForTrades bool
+}
+
+// DefaultConfig is used for any Config fields left zero
+var DefaultConfig = Config{
+	MaxIdle:          16,
+	DialTimeout:      30 * time.Millisecond,
+	ReadTimeout:      5 * time.Second,
+	Retries:          2,
+	RetryBackoff:     20 * time.Millisecond,
+	BreakerThreshold: 5,
+	BreakerCooldown:  5 * time.Second,
+	QuoteValidity:    60 * time.Second,
+	MaxStaleness:     60 * time.Second,
 }
 
-type QuoteReply struct {
-	quote decimal.Decimal
-	stock string
-	user  string
-	time  uint64
-	key   string
+// Stats is a snapshot of a QuoteClient's health
+type Stats struct {
+	// Queries counts every quote asked for, including those from the cache
+	Queries uint64
+	// CacheHits counts the quotes answered from the cache
+	CacheHits uint64
+	// CacheMisses counts the quotes that weren't cached, or had expired
+	CacheMisses uint64
+	// CacheBypasses counts the trades that skipped the cache for a new quote
+	CacheBypasses uint64
+	// Coalesced counts the queries that shared a single request to the quote
+	// server with other queries for the same stock
+	Coalesced uint64
+	// Retries counts the attempts made after a query to the quote server failed
+	Retries uint64
+	// Failures counts the queries that failed after all of their retries
+	Failures uint64
+	// Rejected counts the queries failed with ErrCircuitOpen
+	Rejected uint64
+	// DialFailures counts the attempts to open a connection that failed
+	DialFailures uint64
+	// BadReplies counts the replies from the quote server that couldn't be used
+	BadReplies uint64
+	// IdleConns is the number of open connections waiting to be used
+	IdleConns int
+	// BreakerState is BreakerClosed while the quote server is healthy
+	BreakerState string
+	// BreakerOpens counts the times the breaker has opened
+	BreakerOpens uint64
 }
 
-func NewQuoteClient(logger logger.Logger) *QuoteClient {
-	re := regexp.MustCompile("(?P<quote>.+),(?P<stock>.+),(?P<user>.+),(?P<time>.+),(?P<key>.+)")
+type counters struct {
+	queries      uint64
+	cacheHits    uint64
+	cacheMisses  uint64
+	bypasses     uint64
+	coalesced    uint64
+	retries      uint64
+	failures     uint64
+	rejected     uint64
+	dialFailures uint64
+	badReplies   uint64
+}
+
+// NewQuoteClient returns a QuoteClient for the quote server at addr, with its
+// connections and failure handling set by config
+func NewQuoteClient(addr string, logger logger.Logger, config Config) *QuoteClient {
+	if config.MaxIdle == 0 {
+		config.MaxIdle = DefaultConfig.MaxIdle
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = DefaultConfig.DialTimeout
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = DefaultConfig.ReadTimeout
+	}
+	if config.Retries == 0 {
+		config.Retries = DefaultConfig.Retries
+	} else if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = DefaultConfig.RetryBackoff
+	}
+	if config.BreakerThreshold == 0 {
+		config.BreakerThreshold = DefaultConfig.BreakerThreshold
+	}
+	if config.BreakerCooldown == 0 {
+		config.BreakerCooldown = DefaultConfig.BreakerCooldown
+	}
+	if config.QuoteValidity == 0 {
+		config.QuoteValidity = DefaultConfig.QuoteValidity
+	}
+	if config.MaxStaleness == 0 {
+		config.MaxStaleness = DefaultConfig.MaxStaleness
+	}
+
 	return &QuoteClient{
-		name:   "quoteserve",
-		addr:   "quoteserve.seng:4444",
-		cache:  cache.New(time.Minute, time.Minute),
-		re:     re,
-		logger: logger,
+		name:     "quoteserve",
+		addr:     addr,
+		config:   config,
+		cache:    cache.New(config.MaxStaleness, time.Minute),
+		logger:   logger,
+		idle:     make(chan *quoteConn, config.MaxIdle),
+		breaker:  newBreaker(config.BreakerThreshold, config.BreakerCooldown),
+		counters: new(counters),
 	}
 }
 
+// Query returns the price of a stock, from the cache if it is still valid.
+// Concurrent queries for a stock that isn't cached share a single request to
+// the quote server, so it is only paid for and logged once.
+// Failed queries are retried with backoff, and return ErrCircuitOpen without
+// contacting the quote server while it is unhealthy.
 func (q *QuoteClient) Query(u string, s string, transNum int) (decimal.Decimal, error) {
-	quote, found := q.cache.Get(s)
-	if found {
-		d, _ := decimal.NewFromString(quote.(string))
-		return d, nil
+	atomic.AddUint64(&q.counters.queries, 1)
+	if quote, found := q.cachedQuote(s); found {
+		atomic.AddUint64(&q.counters.cacheHits, 1)
+		return quote, nil
+	}
+	atomic.AddUint64(&q.counters.cacheMisses, 1)
+	return q.query(u, s, transNum, false)
+}
+
+// QueryForTrade returns the price of a stock to trade at. It is the same as
+// Query, unless the client is configured to bypass the cache for trades.
+func (q *QuoteClient) QueryForTrade(u string, s string, transNum int) (decimal.Decimal, error) {
+	if !q.config.BypassCacheForTrades {
+		return q.Query(u, s, transNum)
+	}
+	atomic.AddUint64(&q.counters.queries, 1)
+	atomic.AddUint64(&q.counters.bypasses, 1)
+	return q.query(u, s, transNum, true)
+}
+
+// Flush removes a stock's quote from the cache, so the next query for it
+// goes to the quote server. Returns false if it wasn't cached.
+func (q *QuoteClient) Flush(stock string) bool {
+	_, found := q.cache.Get(stock)
+	q.cache.Delete(stock)
+	return found
+}
+
+// query fetches a quote, sharing the request with any other query for the
+// stock already waiting on the quote server. Fresh queries only share
+// requests with each other, as others may be answered from the cache.
+func (q *QuoteClient) query(u string, s string, transNum int, fresh bool) (decimal.Decimal, error) {
+	key := s
+	if fresh {
+		key = "fresh:" + s
+	}
+	reply, err, shared := q.inflight.Do(key, func() (interface{}, error) {
+		return q.fetch(u, s, transNum, fresh)
+	})
+	if shared {
+		atomic.AddUint64(&q.counters.coalesced, 1)
+	}
+	if err == ErrCircuitOpen {
+		atomic.AddUint64(&q.counters.rejected, 1)
 	}
-	conn, err := net.DialTimeout("tcp", q.addr, 30*time.Millisecond)
 	if err != nil {
 		return decimal.Decimal{}, err
 	}
-	request := fmt.Sprintf("%s,%s\n", s, u)
-	fmt.Fprintf(conn, request)
-	message, err := bufio.NewReader(conn).ReadString('\n')
+	return reply.(*QuoteReply).quote, nil
+}
+
+// fetch requests a quote from the quote server and caches it until it is no
+// longer valid. Only one fetch runs at a time for each stock.
+func (q *QuoteClient) fetch(u string, s string, transNum int, fresh bool) (*QuoteReply, error) {
+	// The quote may have been cached by a fetch that finished since Query missed
+	if quote, found := q.cachedQuote(s); found && !fresh {
+		return &QuoteReply{quote: quote, stock: s, user: u}, nil
+	}
+	if !q.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	var reply *QuoteReply
+	var err error
+	for attempt := 0; ; attempt++ {
+		reply, err = q.request(s, u)
+		if _, bad := err.(*ReplyError); bad {
+			atomic.AddUint64(&q.counters.badReplies, 1)
+			q.logger.Log(logger.ErrorEvent{Server: q.name, TransactionNum: transNum, Command: "QUOTE",
+				Username: u, StockSymbol: s, ErrorMessage: err.Error()})
+		}
+		if err == nil || attempt >= q.config.Retries {
+			break
+		}
+		atomic.AddUint64(&q.counters.retries, 1)
+		time.Sleep(q.config.RetryBackoff << uint(attempt))
+	}
+	// Changes to the breaker are logged as errors against the query that
+	// caused them
 	if err != nil {
-		return decimal.Decimal{}, err
+		atomic.AddUint64(&q.counters.failures, 1)
+		if failures, opened := q.breaker.failure(); opened {
+			q.logger.Log(logger.ErrorEvent{Server: q.name, TransactionNum: transNum, Command: "QUOTE",
+				Username: u, StockSymbol: s, ErrorMessage: fmt.Sprintf(
+					"Quote server failed %d queries in a row, opening circuit breaker for %s",
+					failures, q.config.BreakerCooldown)})
+		}
+		return nil, err
 	}
-	reply := q.getReply(message)
-	go q.logger.QuoteServer(q.name, transNum, reply.quote.String(), reply.stock,
-		reply.user, reply.time, reply.key)
-	q.cache.Set(reply.stock, reply.quote.String(), cache.DefaultExpiration)
-	conn.Close()
-	return reply.quote, nil
+	if q.breaker.success() {
+		q.logger.Log(logger.ErrorEvent{Server: q.name, TransactionNum: transNum, Command: "QUOTE",
+			Username: u, StockSymbol: s, ErrorMessage: "Quote server recovered, closing circuit breaker"})
+	}
+
+	q.logger.Log(logger.QuoteServer{Server: q.name, TransactionNum: transNum, Price: reply.quote,
+		StockSymbol: reply.stock, Username: reply.user, QuoteServerTime: reply.time, Cryptokey: reply.key})
+	if ttl := q.ttl(reply.time, time.Now()); ttl > 0 {
+		q.cache.Set(reply.stock, reply.quote.String(), ttl)
+	}
+	return reply, nil
+}
+
+// ttl returns how much longer a quote given by the quote server at quoted,
+// in milliseconds since the epoch, can be cached for
+func (q *QuoteClient) ttl(quoted uint64, now time.Time) time.Duration {
+	expires := time.Unix(0, int64(quoted)*int64(time.Millisecond)).Add(q.config.QuoteValidity)
+	ttl := expires.Sub(now)
+	if ttl > q.config.MaxStaleness {
+		ttl = q.config.MaxStaleness
+	}
+	return ttl
+}
+
+func (q *QuoteClient) cachedQuote(stock string) (decimal.Decimal, bool) {
+	quote, found := q.cache.Get(stock)
+	if !found {
+		return decimal.Decimal{}, false
+	}
+	d, _ := decimal.NewFromString(quote.(string))
+	return d, true
+}
+
+// Stats returns the current health of the client and its connections
+func (q *QuoteClient) Stats() Stats {
+	state, opens := q.breaker.stats()
+	return Stats{
+		Queries:       atomic.LoadUint64(&q.counters.queries),
+		CacheHits:     atomic.LoadUint64(&q.counters.cacheHits),
+		CacheMisses:   atomic.LoadUint64(&q.counters.cacheMisses),
+		CacheBypasses: atomic.LoadUint64(&q.counters.bypasses),
+		Coalesced:     atomic.LoadUint64(&q.counters.coalesced),
+		Retries:       atomic.LoadUint64(&q.counters.retries),
+		Failures:      atomic.LoadUint64(&q.counters.failures),
+		Rejected:      atomic.LoadUint64(&q.counters.rejected),
+		DialFailures:  atomic.LoadUint64(&q.counters.dialFailures),
+		BadReplies:    atomic.LoadUint64(&q.counters.badReplies),
+		IdleConns:     len(q.idle),
+		BreakerState:  state,
+		BreakerOpens:  opens,
+	}
+}
+
+// Close closes every idle connection to the quote server
+func (q *QuoteClient) Close() {
+	for {
+		select {
+		case conn := <-q.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// request sends a single query to the quote server and returns its parsed
+// reply. A reused connection may have been closed by the server while idle,
+// so a failure on one is tried once more on a new connection.
+func (q *QuoteClient) request(stock string, user string) (*QuoteReply, error) {
+	conn, reused, err := q.getConn()
+	if err != nil {
+		return nil, err
+	}
+	message, err := q.roundTrip(conn, stock, user)
+	if err != nil && reused {
+		conn.Close()
+		if conn, err = q.dial(); err != nil {
+			return nil, err
+		}
+		message, err = q.roundTrip(conn, stock, user)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := parseReply(message, stock, user)
+	if err != nil {
+		// The connection may be out of step with its replies, so isn't reused
+		conn.Close()
+		return nil, err
+	}
+	q.putConn(conn)
+	return reply, nil
 }
 
-func (q *QuoteClient) getReply(msg string) *QuoteReply {
-	n1 := q.re.SubexpNames()
-	r2 := q.re.FindAllStringSubmatch(msg, -1)[0]
+func (q *QuoteClient) roundTrip(conn *quoteConn, stock string, user string) (string, error) {
+	conn.SetDeadline(time.Now().Add(q.config.ReadTimeout))
+	if _, err := fmt.Fprintf(conn, "%s,%s\n", stock, user); err != nil {
+		return "", err
+	}
+	return conn.reader.ReadString('\n')
+}
+
+// quoteConn is a connection to the quote server, along with the reader its
+// replies are read through. The reader is kept with the connection while
+// it's idle, so nothing it has buffered is lost between queries.
+type quoteConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// getConn returns an idle connection if there is one, or opens a new one
+func (q *QuoteClient) getConn() (conn *quoteConn, reused bool, err error) {
+	select {
+	case conn = <-q.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err = q.dial()
+	return conn, false, err
+}
 
-	res := map[string]string{}
-	for i, n := range r2 {
-		res[n1[i]] = n
+// putConn keeps a connection for reuse, closing it if enough are idle already
+func (q *QuoteClient) putConn(conn *quoteConn) {
+	select {
+	case q.idle <- conn:
+	default:
+		conn.Close()
 	}
+}
 
-	quote, _ := decimal.NewFromString(res["quote"])
-	timestamp, _ := strconv.ParseUint(res["time"], 10, 64)
-	return &QuoteReply{
-		quote: quote,
-		stock: res["stock"],
-		user:  res["user"],
-		time:  timestamp,
-		key:   res["key"],
+func (q *QuoteClient) dial() (*quoteConn, error) {
+	conn, err := net.DialTimeout("tcp", q.addr, q.config.DialTimeout)
+	if err != nil {
+		atomic.AddUint64(&q.counters.dialFailures, 1)
+		return nil, err
 	}
+	return &quoteConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
 }
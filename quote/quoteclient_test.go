@@ -0,0 +1,341 @@
+package quoteclient
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"seng468/transaction-server/logger"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// nopLogger drops everything logged to it
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.Event)        {}
+func (nopLogger) DumpLog(string, string) {}
+
+// errorLogger sends the message of every error event logged to it down errors
+type errorLogger struct {
+	nopLogger
+	errors chan string
+}
+
+func (l errorLogger) Log(event logger.Event) {
+	if err, ok := event.(logger.ErrorEvent); ok {
+		l.errors <- err.ErrorMessage
+	}
+}
+
+// quoteServer is a fake quote server that quotes every stock at 12.50,
+// serving any number of queries on each connection. The first drop
+// connections it accepts are closed without a reply, every reply is
+// held back by delay, and quotes are timestamped age ago. If reply is
+// set it is sent in place of every quote.
+type quoteServer struct {
+	listener net.Listener
+	accepted int64
+	requests int64
+	drop     int64
+	delay    time.Duration
+	age      time.Duration
+	reply    string
+}
+
+func newQuoteServer(t *testing.T, drop int64) *quoteServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &quoteServer{listener: l, drop: drop}
+	go s.serve()
+	return s
+}
+
+func (s *quoteServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if atomic.AddInt64(&s.accepted, 1) <= atomic.LoadInt64(&s.drop) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(&s.requests, 1)
+				time.Sleep(s.delay)
+				if s.reply != "" {
+					conn.Write([]byte(s.reply))
+					continue
+				}
+				split := strings.Split(strings.TrimSpace(line), ",")
+				quoted := time.Now().Add(-s.age).UnixNano() / int64(time.Millisecond)
+				conn.Write([]byte("12.50," + split[0] + "," + split[1] + "," +
+					strconv.FormatInt(quoted, 10) + ",key\n"))
+			}
+		}()
+	}
+}
+
+func (s *quoteServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *quoteServer) close() {
+	s.listener.Close()
+}
+
+func TestQueryReusesConnections(t *testing.T) {
+	server := newQuoteServer(t, 0)
+	defer server.close()
+	q := NewQuoteClient(server.addr(), nopLogger{}, Config{})
+	defer q.Close()
+
+	for _, stock := range []string{"ABC", "DEF", "GHI", "ABC"} {
+		price, err := q.Query("user1", stock, 1)
+		if err != nil || !price.Equal(decimal.RequireFromString("12.50")) {
+			t.Fatal("Expected a quote of 12.50 for", stock, "got", price, err)
+		}
+	}
+	if accepted := atomic.LoadInt64(&server.accepted); accepted != 1 {
+		t.Error("Queries should share one connection, opened", accepted)
+	}
+	stats := q.Stats()
+	if stats.Queries != 4 || stats.CacheHits != 1 || stats.IdleConns != 1 || stats.BreakerState != BreakerClosed {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestPooledConnectionsKeepTheirReader(t *testing.T) {
+	server := newQuoteServer(t, 0)
+	defer server.close()
+	q := NewQuoteClient(server.addr(), nopLogger{}, Config{})
+	defer q.Close()
+
+	if _, err := q.Query("user1", "ABC", 1); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-q.idle
+	reader := conn.reader
+	q.idle <- conn
+	if _, err := q.Query("user1", "DEF", 2); err != nil {
+		t.Fatal(err)
+	}
+	if reused := <-q.idle; reused != conn || reused.reader != reader {
+		t.Error("A reused connection should be read through the reader it was opened with")
+	}
+}
+
+func TestQueryCoalescesConcurrentMisses(t *testing.T) {
+	server := newQuoteServer(t, 0)
+	server.delay = 50 * time.Millisecond
+	defer server.close()
+	q := NewQuoteClient(server.addr(), nopLogger{}, Config{})
+	defer q.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			price, err := q.Query(user, "ABC", 1)
+			if err == nil && !price.Equal(decimal.RequireFromString("12.50")) {
+				err = errors.New("wrong price " + price.String())
+			}
+			errs <- err
+		}("user" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("Query failed:", err)
+		}
+	}
+	if requests := atomic.LoadInt64(&server.requests); requests != 1 {
+		t.Error("Concurrent queries should share one request, sent", requests)
+	}
+	if stats := q.Stats(); stats.Coalesced+stats.CacheHits != 10 {
+		t.Errorf("Every query should have shared the request or hit the cache, got %+v", stats)
+	}
+}
+
+func TestCacheExpiresWithQuote(t *testing.T) {
+	server := newQuoteServer(t, 0)
+	defer server.close()
+	q := NewQuoteClient(server.addr(), nopLogger{}, Config{QuoteValidity: time.Minute})
+	defer q.Close()
+
+	// A quote given 50 seconds ago is only valid for 10 more
+	now := time.Now()
+	quoted := uint64(now.Add(-50*time.Second).UnixNano() / int64(time.Millisecond))
+	if ttl := q.ttl(quoted, now); ttl < 9*time.Second || ttl > 10*time.Second {
+		t.Error("Expected a ttl of 10s, got", ttl)
+	}
+	quoted = uint64(now.Add(time.Hour).UnixNano() / int64(time.Millisecond))
+	if ttl := q.ttl(quoted, now); ttl != DefaultConfig.MaxStaleness {
+		t.Error("A quote from the future should be cached for at most MaxStaleness, got", ttl)
+	}
+
+	// Expired quotes are never cached
+	server.age = 2 * time.Minute
+	q.Query("user1", "ABC", 1)
+	q.Query("user1", "ABC", 2)
+	if requests := atomic.LoadInt64(&server.requests); requests != 2 {
+		t.Error("An expired quote shouldn't be cached, sent", requests, "requests")
+	}
+	if stats := q.Stats(); stats.CacheMisses != 2 || stats.CacheHits != 0 {
+		t.Errorf("Expected 2 cache misses, got %+v", stats)
+	}
+}
+
+func TestCacheBypassAndFlush(t *testing.T) {
+	server := newQuoteServer(t, 0)
+	defer server.close()
+	q := NewQuoteClient(server.addr(), nopLogger{}, Config{BypassCacheForTrades: true})
+	defer q.Close()
+
+	q.Query("user1", "ABC", 1)
+	q.Query("user1", "ABC", 2)
+	q.QueryForTrade("user1", "ABC", 3)
+	if requests := atomic.LoadInt64(&server.requests); requests != 2 {
+		t.Error("Only the first query and the trade should reach the quote server, sent", requests)
+	}
+	if stats := q.Stats(); stats.CacheHits != 1 || stats.CacheMisses != 1 || stats.CacheBypasses != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	if !q.Flush("ABC") || q.Flush("ABC") {
+		t.Error("Only the first flush should find the quote cached")
+	}
+	q.Query("user1", "ABC", 4)
+	if requests := atomic.LoadInt64(&server.requests); requests != 3 {
+		t.Error("A flushed quote should be fetched again, sent", requests)
+	}
+}
+
+func TestQueryRejectsBadReplies(t *testing.T) {
+	server := newQuoteServer(t, 0)
+	server.reply = "garbage\n"
+	defer server.close()
+	logger := errorLogger{errors: make(chan string, 10)}
+	q := NewQuoteClient(server.addr(), logger, Config{Retries: -1})
+	defer q.Close()
+
+	_, err := q.Query("user1", "ABC", 1)
+	if !errors.Is(err, ErrMalformedReply) {
+		t.Fatal("Expected a malformed reply error, got", err)
+	}
+	select {
+	case msg := <-logger.errors:
+		if msg != err.Error() {
+			t.Error("Expected the reply error to be logged, got", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for the reply error to be logged")
+	}
+	if stats := q.Stats(); stats.BadReplies != 1 || stats.IdleConns != 0 {
+		t.Errorf("Expected a bad reply and its connection closed, got %+v", stats)
+	}
+}
+
+func TestQueryRetries(t *testing.T) {
+	server := newQuoteServer(t, 2)
+	defer server.close()
+	q := NewQuoteClient(server.addr(), nopLogger{}, Config{RetryBackoff: time.Millisecond})
+	defer q.Close()
+
+	if _, err := q.Query("user1", "ABC", 1); err != nil {
+		t.Fatal("Query should succeed on its last retry, got", err)
+	}
+	if stats := q.Stats(); stats.Retries != 2 || stats.Failures != 0 {
+		t.Errorf("Expected 2 retries and no failures, got %+v", stats)
+	}
+
+	q = NewQuoteClient(server.addr(), nopLogger{}, Config{Retries: -1})
+	atomic.StoreInt64(&server.drop, atomic.LoadInt64(&server.accepted)+1)
+	if _, err := q.Query("user1", "ABC", 1); err == nil {
+		t.Error("Query should fail when retries are disabled")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// Nothing listens on the address once the listener is closed
+	server := newQuoteServer(t, 0)
+	addr := server.addr()
+	server.close()
+
+	logger := errorLogger{errors: make(chan string, 10)}
+	q := NewQuoteClient(addr, logger, Config{
+		Retries:          -1,
+		BreakerThreshold: 3,
+		BreakerCooldown:  50 * time.Millisecond,
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := q.Query("user1", "ABC", 1); err == nil || err == ErrCircuitOpen {
+			t.Fatal("Expected the quote server to be unreachable, got", err)
+		}
+	}
+	if _, err := q.Query("user1", "ABC", 1); err != ErrCircuitOpen {
+		t.Fatal("Expected the breaker to open after 3 failures, got", err)
+	}
+	if stats := q.Stats(); stats.BreakerState != BreakerOpen || stats.Rejected != 1 || stats.BreakerOpens != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// A failed probe after the cooldown opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	if _, err := q.Query("user1", "ABC", 1); err == ErrCircuitOpen {
+		t.Fatal("The quote server should be probed after the cooldown")
+	}
+	if _, err := q.Query("user1", "ABC", 1); err != ErrCircuitOpen {
+		t.Fatal("A failed probe should open the breaker again, got", err)
+	}
+
+	// A successful probe closes it
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("could not listen on the quote server address again:", err)
+	}
+	server = &quoteServer{listener: l}
+	go server.serve()
+	defer server.close()
+	time.Sleep(60 * time.Millisecond)
+	if _, err := q.Query("user1", "ABC", 1); err != nil {
+		t.Fatal("Expected the probe to succeed, got", err)
+	}
+	if stats := q.Stats(); stats.BreakerState != BreakerClosed || stats.BreakerOpens != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Each time the breaker changed is logged
+	close(logger.errors)
+	var changes []string
+	for msg := range logger.errors {
+		changes = append(changes, msg)
+	}
+	expected := []string{
+		"Quote server failed 3 queries in a row, opening circuit breaker for 50ms",
+		"Quote server failed 4 queries in a row, opening circuit breaker for 50ms",
+		"Quote server recovered, closing circuit breaker",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected breaker changes logged:\n%s\ngot:\n%s", strings.Join(expected, "\n"),
+			strings.Join(changes, "\n"))
+	}
+}
@@ -0,0 +1,88 @@
+package quoteclient
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrMalformedReply is wrapped by ReplyErrors for replies that don't
+	// follow the "quote,stock,user,time,key" format
+	ErrMalformedReply = errors.New("malformed quote reply")
+	// ErrMismatchedReply is wrapped by ReplyErrors for well formed replies
+	// quoting a different stock or user than was asked for
+	ErrMismatchedReply = errors.New("quote reply doesn't match the query")
+)
+
+// ReplyError is returned for a reply from the quote server that can't be used
+type ReplyError struct {
+	// Err is ErrMalformedReply or ErrMismatchedReply
+	Err error
+	// Reply is the reply as it was received
+	Reply string
+	// Reason describes what was wrong with it
+	Reason string
+}
+
+func (e *ReplyError) Error() string {
+	return e.Err.Error() + ": " + e.Reason + " in " + strconv.Quote(e.Reply)
+}
+
+// Unwrap lets errors.Is match a ReplyError against its kind
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+type QuoteReply struct {
+	quote decimal.Decimal
+	stock string
+	user  string
+	time  uint64
+	key   string
+}
+
+// parseReply parses a reply from the quote server to a query for the stock
+// by the user, following the format of:
+//		"quote,stock,user,time,key\n"
+// where quote is a positive price, time is in milliseconds since the epoch
+// and key is the quote's cryptographic key
+func parseReply(msg string, stock string, user string) (*QuoteReply, error) {
+	malformed := func(reason string) error {
+		return &ReplyError{ErrMalformedReply, msg, reason}
+	}
+	if !strings.HasSuffix(msg, "\n") {
+		return nil, malformed("reply is incomplete")
+	}
+	fields := strings.Split(strings.TrimRight(msg, "\r\n"), ",")
+	if len(fields) != 5 {
+		return nil, malformed("expected 5 fields, got " + strconv.Itoa(len(fields)))
+	}
+	for i, field := range fields {
+		if field == "" || strings.ContainsAny(field, " \t\r\n") {
+			return nil, malformed("field " + strconv.Itoa(i+1) + " is empty or contains whitespace")
+		}
+	}
+
+	reply := &QuoteReply{stock: fields[1], user: fields[2], key: fields[4]}
+	var err error
+	if reply.quote, err = decimal.NewFromString(fields[0]); err != nil {
+		return nil, malformed("price is not a number")
+	}
+	if !reply.quote.IsPositive() {
+		return nil, malformed("price is not positive")
+	}
+	if reply.time, err = strconv.ParseUint(fields[3], 10, 64); err != nil || reply.time == 0 {
+		return nil, malformed("time is not a timestamp")
+	}
+
+	if reply.stock != stock {
+		return nil, &ReplyError{ErrMismatchedReply, msg, "quoted stock " + reply.stock + " instead of " + stock}
+	}
+	if reply.user != user {
+		return nil, &ReplyError{ErrMismatchedReply, msg, "quoted for user " + reply.user + " instead of " + user}
+	}
+	return reply, nil
+}
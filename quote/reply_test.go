@@ -0,0 +1,48 @@
+package quoteclient
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseReply(t *testing.T) {
+	reply, err := parseReply("12.50,ABC,user1,1500000000000,abc123=\n", "ABC", "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.quote.Equal(decimal.RequireFromString("12.50")) || reply.stock != "ABC" || reply.user != "user1" ||
+		reply.time != 1500000000000 || reply.key != "abc123=" {
+		t.Errorf("Reply parsed wrong: %+v", reply)
+	}
+
+	bad := map[string]error{
+		"":                                           ErrMalformedReply,
+		"12.50,ABC,user1,1500000000000,key":          ErrMalformedReply,
+		"12.50,ABC,user1,1500000000000\n":            ErrMalformedReply,
+		"12.50,ABC,user1,1500000000000,key,extra\n":  ErrMalformedReply,
+		"12.50,ABC,user1,1500000000000,\n":           ErrMalformedReply,
+		"12.50, ABC,user1,1500000000000,key\n":       ErrMalformedReply,
+		"twelve,ABC,user1,1500000000000,key\n":       ErrMalformedReply,
+		"-1.00,ABC,user1,1500000000000,key\n":        ErrMalformedReply,
+		"0,ABC,user1,1500000000000,key\n":            ErrMalformedReply,
+		"12.50,ABC,user1,yesterday,key\n":            ErrMalformedReply,
+		"12.50,ABC,user1,-1,key\n":                   ErrMalformedReply,
+		"12.50,XYZ,user1,1500000000000,key\n":        ErrMismatchedReply,
+		"12.50,ABC,user2,1500000000000,key\n":        ErrMismatchedReply,
+		"12.50,ABC,user1,user1,1500000000000,key\n":  ErrMalformedReply,
+		"12.50,ABC,user1,1500000000000,key\r\n":      nil,
+		"12.50,ABC,user1,1500000000000,k,e,y\n":      ErrMalformedReply,
+		"12.50,ABC,user1,1500000000000,key\nextra\n": ErrMalformedReply,
+	}
+	for msg, want := range bad {
+		_, err := parseReply(msg, "ABC", "user1")
+		if !errors.Is(err, want) {
+			t.Errorf("Parsing %q: expected %v, got %v", msg, want, err)
+		}
+		if _, typed := err.(*ReplyError); want != nil && !typed {
+			t.Errorf("Parsing %q: expected a ReplyError, got %T", msg, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package quotesim
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+// PriceModel decides the price quoted for a stock
+type PriceModel interface {
+	Price(stock string) decimal.Decimal
+}
+
+// Fixed quotes every stock at the same price
+type Fixed struct {
+	Quote decimal.Decimal
+}
+
+// Price returns the fixed price
+func (f Fixed) Price(stock string) decimal.Decimal {
+	return f.Quote
+}
+
+// RandomWalk quotes each stock starting at Start, moving it up or down by up
+// to Step on every quote. Prices never fall below a cent.
+type RandomWalk struct {
+	Start decimal.Decimal
+	Step  decimal.Decimal
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	prices map[string]decimal.Decimal
+}
+
+// NewRandomWalk returns a RandomWalk whose moves are decided by seed, so a
+// run can be repeated
+func NewRandomWalk(start decimal.Decimal, step decimal.Decimal, seed int64) *RandomWalk {
+	return &RandomWalk{
+		Start:  start,
+		Step:   step,
+		rand:   rand.New(rand.NewSource(seed)),
+		prices: make(map[string]decimal.Decimal),
+	}
+}
+
+// Price moves the stock's price and returns it
+func (w *RandomWalk) Price(stock string) decimal.Decimal {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	price, ok := w.prices[stock]
+	if !ok {
+		price = w.Start
+	}
+	// A move between -Step and Step, to the cent
+	cents := w.Step.Shift(2).IntPart()
+	move := decimal.New(w.rand.Int63n(2*cents+1)-cents, -2)
+	price = decimal.Max(price.Add(move), decimal.New(1, -2))
+	w.prices[stock] = price
+	return price
+}
+
+// Replay quotes each stock from a script of prices, in order, starting again
+// from the first once they run out. Stocks without a script are quoted at
+// Default.
+type Replay struct {
+	Default decimal.Decimal
+
+	mu     sync.Mutex
+	prices map[string][]decimal.Decimal
+	next   map[string]int
+}
+
+// NewReplay reads a replay script with one quote per line, following the
+// format of:
+//		"stock,price"
+// Blank lines and lines starting with # are ignored.
+func NewReplay(script io.Reader, defaultPrice decimal.Decimal) (*Replay, error) {
+	r := &Replay{
+		Default: defaultPrice,
+		prices:  make(map[string][]decimal.Decimal),
+		next:    make(map[string]int),
+	}
+	scanner := bufio.NewScanner(script)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		split := strings.Split(text, ",")
+		if len(split) != 2 {
+			return nil, errors.New("replay line " + strconv.Itoa(line) + " is not stock,price")
+		}
+		price, err := decimal.NewFromString(strings.TrimSpace(split[1]))
+		if err != nil || !price.IsPositive() {
+			return nil, errors.New("replay line " + strconv.Itoa(line) + " has an invalid price")
+		}
+		stock := strings.TrimSpace(split[0])
+		r.prices[stock] = append(r.prices[stock], price)
+	}
+	return r, scanner.Err()
+}
+
+// Price returns the stock's next price from the script
+func (r *Replay) Price(stock string) decimal.Decimal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prices := r.prices[stock]
+	if len(prices) == 0 {
+		return r.Default
+	}
+	price := prices[r.next[stock]%len(prices)]
+	r.next[stock]++
+	return price
+}
@@ -0,0 +1,161 @@
+// Package quotesim simulates the course quote server, so the transaction
+// server can be developed and tested without it. It speaks the same protocol,
+// answering each "stock,user\n" request with "price,stock,user,time,key\n".
+package quotesim
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is a simulated quote server. Its fields must be set before it
+// starts serving.
+type Server struct {
+	// Model decides the price of each quote
+	Model PriceModel
+	// Latency delays every reply
+	Latency time.Duration
+	// Jitter adds a random delay of up to this long to every reply
+	Jitter time.Duration
+	// DropRate is the chance, from 0 to 1, that a request's connection is
+	// closed without a reply
+	DropRate float64
+	// GarbageRate is the chance, from 0 to 1, that a request is answered
+	// with a malformed reply
+	GarbageRate float64
+
+	mu       sync.Mutex
+	rand     *mathrand.Rand
+	listener net.Listener
+	served   uint64
+	failed   uint64
+}
+
+// NewServer returns a Server quoting prices from model, with its latency
+// jitter and failures decided by seed
+func NewServer(model PriceModel, seed int64) *Server {
+	return &Server{
+		Model: model,
+		rand:  mathrand.New(mathrand.NewSource(seed)),
+	}
+}
+
+// ListenAndServe listens on addr and serves quotes until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves quotes to connections from the listener until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Addr returns the address the server is listening on, or nil before it has
+// started
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the server listening. Connections already open are served
+// until the client closes them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Stats returns the number of quotes served, and the number of requests
+// failed on purpose
+func (s *Server) Stats() (served uint64, failed uint64) {
+	return atomic.LoadUint64(&s.served), atomic.LoadUint64(&s.failed)
+}
+
+// handle answers every request sent on the connection, in order
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		split := strings.Split(strings.TrimRight(line, "\r\n"), ",")
+		if len(split) != 2 {
+			return
+		}
+		stock, user := split[0], split[1]
+
+		drop, garbage, delay := s.roll()
+		time.Sleep(delay)
+		if drop {
+			atomic.AddUint64(&s.failed, 1)
+			return
+		}
+		reply := s.quote(stock, user)
+		if garbage {
+			atomic.AddUint64(&s.failed, 1)
+			// A reply cut off before its key
+			reply = reply[:strings.LastIndex(reply, ",")] + "\n"
+		} else {
+			atomic.AddUint64(&s.served, 1)
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// roll decides whether a request fails, and how long its reply is delayed
+func (s *Server) roll() (drop bool, garbage bool, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delay = s.Latency
+	if s.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.Jitter)))
+	}
+	return s.rand.Float64() < s.DropRate, s.rand.Float64() < s.GarbageRate, delay
+}
+
+// quote returns the reply quoting the stock for the user now
+func (s *Server) quote(stock string, user string) string {
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	return fmt.Sprintf("%s,%s,%s,%d,%s\n", s.Model.Price(stock).StringFixed(2), stock, user,
+		timestamp, newKey())
+}
+
+// newKey returns a random key in the style of the quote server's
+// cryptographic keys
+func newKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
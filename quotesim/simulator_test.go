@@ -0,0 +1,109 @@
+package quotesim
+
+import (
+	"net"
+	"seng468/transaction-server/logger"
+	"seng468/transaction-server/quote"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// nopLogger drops everything logged to it
+type nopLogger struct{}
+
+func (nopLogger) Log(logger.Event)        {}
+func (nopLogger) DumpLog(string, string) {}
+
+func startServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func TestServerAnswersQuoteClient(t *testing.T) {
+	s := NewServer(Fixed{decimal.RequireFromString("12.5")}, 1)
+	defer s.Close()
+	q := quoteclient.NewQuoteClient(startServer(t, s), nopLogger{}, quoteclient.Config{})
+	defer q.Close()
+
+	for _, stock := range []string{"ABC", "XYZ"} {
+		price, err := q.Query("user1", stock, 1)
+		if err != nil || !price.Equal(decimal.RequireFromString("12.50")) {
+			t.Error("Expected a quote of 12.50 for", stock, "got", price, err)
+		}
+	}
+	if served, failed := s.Stats(); served != 2 || failed != 0 {
+		t.Error("Expected 2 quotes served, got", served, failed)
+	}
+}
+
+func TestServerFailures(t *testing.T) {
+	s := NewServer(Fixed{decimal.RequireFromString("12.5")}, 1)
+	s.GarbageRate = 1
+	defer s.Close()
+	q := quoteclient.NewQuoteClient(startServer(t, s), nopLogger{}, quoteclient.Config{Retries: -1})
+	defer q.Close()
+	if _, err := q.Query("user1", "ABC", 1); err == nil || !strings.Contains(err.Error(), "malformed") {
+		t.Error("Expected a malformed reply, got", err)
+	}
+
+	s = NewServer(Fixed{decimal.RequireFromString("12.5")}, 1)
+	s.DropRate = 1
+	defer s.Close()
+	q = quoteclient.NewQuoteClient(startServer(t, s), nopLogger{}, quoteclient.Config{Retries: -1})
+	defer q.Close()
+	if _, err := q.Query("user1", "ABC", 1); err == nil {
+		t.Error("Expected the connection to be dropped")
+	}
+	if served, failed := s.Stats(); served != 0 || failed != 1 {
+		t.Error("Expected 1 failed request, got", served, failed)
+	}
+}
+
+func TestRandomWalk(t *testing.T) {
+	step := decimal.RequireFromString("0.25")
+	w := NewRandomWalk(decimal.RequireFromString("1.00"), step, 1)
+	last := decimal.RequireFromString("1.00")
+	for i := 0; i < 1000; i++ {
+		price := w.Price("ABC")
+		if price.Sub(last).Abs().GreaterThan(step) || price.LessThan(decimal.New(1, -2)) {
+			t.Fatal("Price moved from", last, "to", price)
+		}
+		last = price
+	}
+
+	// The same seed walks the same way
+	a, b := NewRandomWalk(last, step, 7), NewRandomWalk(last, step, 7)
+	for i := 0; i < 10; i++ {
+		if pa, pb := a.Price("ABC"), b.Price("ABC"); !pa.Equal(pb) {
+			t.Fatal("Walks with the same seed differ:", pa, pb)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	script := "# opening prices\nABC,10.00\nXYZ,5\n\nABC,11.50\n"
+	r, err := NewReplay(strings.NewReader(script), decimal.RequireFromString("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ stock, price string }{
+		{"ABC", "10"}, {"ABC", "11.5"}, {"ABC", "10"}, {"XYZ", "5"}, {"DEF", "1"},
+	}
+	for _, e := range expected {
+		if price := r.Price(e.stock); !price.Equal(decimal.RequireFromString(e.price)) {
+			t.Errorf("Expected %s at %s, got %s", e.stock, e.price, price)
+		}
+	}
+
+	for _, bad := range []string{"ABC\n", "ABC,ten\n", "ABC,-1\n"} {
+		if _, err := NewReplay(strings.NewReader(bad), decimal.Decimal{}); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
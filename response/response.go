@@ -0,0 +1,93 @@
+package response
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Code is a machine readable result code shared by every command
+type Code string
+
+// The set of result codes a command can reply with
+const (
+	OK                Code = "OK"
+	UnknownCommand    Code = "UNKNOWN_COMMAND"
+	BadArguments      Code = "BAD_ARGUMENTS"
+	DuplicateTransNum Code = "DUPLICATE_TRANSACTION"
+	InsufficientFunds Code = "INSUFFICIENT_FUNDS"
+	InsufficientStock Code = "INSUFFICIENT_STOCK"
+	NoPendingOrder    Code = "NO_PENDING_ORDER"
+	OrderExpired      Code = "ORDER_EXPIRED"
+	NoTrigger         Code = "NO_TRIGGER"
+	TriggerExists     Code = "TRIGGER_EXISTS"
+	QuoteUnavailable  Code = "QUOTE_UNAVAILABLE"
+	DatabaseError     Code = "DATABASE_ERROR"
+	InternalError     Code = "INTERNAL_ERROR"
+)
+
+// Format is an encoding of responses sent to clients
+type Format string
+
+const (
+	// JSON encodes the full response envelope as a JSON object
+	JSON Format = "JSON"
+	// Legacy encodes "1" for success and "-1" for failure, as older clients expect
+	Legacy Format = "LEGACY"
+)
+
+// Response is the reply to a command
+type Response struct {
+	Status  string      `json:"status"`
+	Code    Code        `json:"code"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// LegacyFormatter is implemented by result data that replied with something
+// other than "1" in the legacy format
+type LegacyFormatter interface {
+	Legacy() string
+}
+
+// Success returns a successful response carrying the command's result data
+func Success(data interface{}) Response {
+	return Response{Status: "ok", Code: OK, Data: data}
+}
+
+// Error returns a failed response with the reason it failed
+func Error(code Code, message string) Response {
+	return Response{Status: "error", Code: code, Message: message}
+}
+
+// OK reports whether the command succeeded
+func (r Response) OK() bool {
+	return r.Code == OK
+}
+
+// ParseFormat returns the format with the given name, and whether it exists
+func ParseFormat(name string) (Format, bool) {
+	format := Format(strings.ToUpper(name))
+	return format, format == JSON || format == Legacy
+}
+
+// Encode returns the response in the given format
+func (r Response) Encode(format Format) string {
+	if format == Legacy {
+		return r.legacy()
+	}
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		encoded, _ = json.Marshal(Error(InternalError, "Could not encode response: "+err.Error()))
+	}
+	return string(encoded)
+}
+
+func (r Response) legacy() string {
+	if !r.OK() {
+		return "-1"
+	}
+	if data, ok := r.Data.(LegacyFormatter); ok {
+		return data.Legacy()
+	}
+	return "1"
+}
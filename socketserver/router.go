@@ -0,0 +1,119 @@
+package socketserver
+
+import (
+	"regexp"
+	"seng468/transaction-server/response"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Handler runs a command for the given transaction, returning the reply
+type Handler func(transNum int, args ...string) response.Response
+
+// route is a command registered with a pattern such as
+// "BUY,<user>,<stock>,<amount>"
+type route struct {
+	command string
+	params  []string
+	handler Handler
+}
+
+// RouteError is returned when a command can't be matched to a route
+type RouteError struct {
+	Code   response.Code
+	Detail string
+}
+
+func (e *RouteError) Error() string {
+	if e.Code == response.UnknownCommand {
+		return "unknown command: " + e.Detail
+	}
+	return "bad arguments: " + e.Detail
+}
+
+// Response returns the error reply for the client
+func (e *RouteError) Response() response.Response {
+	return response.Error(e.Code, e.Error())
+}
+
+// paramValidators checks the format of route parameters by name.
+// Parameters without a validator only need to be non-empty. Amounts are
+// money, so they must be positive and can't be given in fractions of a cent:
+// either a whole part with a non-zero digit, or non-zero cents.
+var paramValidators = map[string]*regexp.Regexp{
+	"user":   regexp.MustCompile(`^\S+$`),
+	"stock":  regexp.MustCompile(`^[A-Za-z0-9.]{1,10}$`),
+	"amount": regexp.MustCompile(`^(\d*[1-9]\d*(\.\d{1,2})?|\d*\.(0[1-9]|[1-9]\d?))$`),
+}
+
+// newRoute parses a route pattern into its command name and parameter names
+func newRoute(pattern string, handler Handler) *route {
+	split := strings.Split(pattern, ",")
+	r := &route{command: split[0], handler: handler}
+	for _, param := range split[1:] {
+		r.params = append(r.params, strings.Trim(param, "<>"))
+	}
+	return r
+}
+
+// match returns the route for the command with the given positional
+// arguments, or a RouteError if the command is unknown or its arguments
+// are invalid
+func (s SocketServer) match(name string, args []string) (*route, *RouteError) {
+	routes, ok := s.routeMap[name]
+	if !ok {
+		return nil, &RouteError{response.UnknownCommand, name}
+	}
+	for _, r := range routes {
+		if len(r.params) == len(args) {
+			return r, r.validate(args)
+		}
+	}
+	return nil, &RouteError{response.BadArguments, name + " does not take " +
+		strconv.Itoa(len(args)) + " arguments"}
+}
+
+// matchNamed returns the route for the command whose parameters are exactly
+// the given names, along with the arguments in the route's order
+func (s SocketServer) matchNamed(name string, named map[string]string) (*route, []string, *RouteError) {
+	routes, ok := s.routeMap[name]
+	if !ok {
+		return nil, nil, &RouteError{response.UnknownCommand, name}
+	}
+	for _, r := range routes {
+		if len(r.params) != len(named) {
+			continue
+		}
+		var args []string
+		for _, param := range r.params {
+			if arg, ok := named[param]; ok {
+				args = append(args, arg)
+			}
+		}
+		if len(args) == len(r.params) {
+			return r, args, r.validate(args)
+		}
+	}
+
+	var names []string
+	for param := range named {
+		names = append(names, param)
+	}
+	sort.Strings(names)
+	return nil, nil, &RouteError{response.BadArguments, name + " does not take the parameters [" +
+		strings.Join(names, ",") + "]"}
+}
+
+// validate checks the arguments against the format of the route's parameters
+func (r *route) validate(args []string) *RouteError {
+	for i, param := range r.params {
+		if args[i] == "" {
+			return &RouteError{response.BadArguments, param + " is empty"}
+		}
+		if re, ok := paramValidators[param]; ok && !re.MatchString(args[i]) {
+			return &RouteError{response.BadArguments, "invalid " + param + " '" + args[i] + "'"}
+		}
+	}
+	return nil
+}
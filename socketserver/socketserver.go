@@ -1,48 +1,49 @@
 package socketserver
 
 import (
-	"bytes"
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"regexp"
+	"seng468/transaction-server/logger"
+	"seng468/transaction-server/response"
 	"strconv"
 	"strings"
+
+	"github.com/shopspring/decimal"
 )
 
 type SocketServer struct {
 	addr     string
-	routeMap map[string]func(transNum int, args ...string) string
-	transNum int64
+	routeMap map[string][]*route
+	// TransNums assigns transaction numbers to commands sent without one
+	TransNums TransNumSource
+	// Format is the reply format used until a client negotiates another.
+	// It's Legacy unless set, so existing clients keep working.
+	Format response.Format
+	// Logger records every command run as a userCommand event, if set
+	Logger logger.Logger
+	// Name is the server named in the audit log
+	Name string
 }
 
 func NewSocketServer(addr string) SocketServer {
 	return SocketServer{
-		addr:     addr,
-		routeMap: make(map[string]func(transNum int, args ...string) string),
-		transNum: 0,
-	}
-}
-
-func getParamsFromRegex(regex string, msg string) []string {
-	re, _ := regexp.Compile(regex)
-	match := re.FindAllStringSubmatch(msg, -1)[0]
-	var params []string
-	for _, m := range match {
-		m = string(bytes.Trim([]byte(m), "\x00"))
-		params = append(params, m)
+		addr:      addr,
+		routeMap:  make(map[string][]*route),
+		TransNums: newLocalTransNums(),
+		Format:    response.Legacy,
 	}
-	return params[1:]
-}
-
-func (s SocketServer) buildRoutePattern(pattern string) string {
-	re := regexp.MustCompile(`(<\w+>)`)
-	return re.ReplaceAllString(pattern, `(.+)`) // `(?P\1.+)`
 }
 
-func (s SocketServer) Route(pattern string, f func(transNum int, args ...string) string) {
-	regex := s.buildRoutePattern(pattern)
-	s.routeMap[regex] = f
+// Route registers the handler for a command pattern such as
+// "BUY,<user>,<stock>,<amount>". A command may be registered more than once
+// with a different number of parameters.
+func (s SocketServer) Route(pattern string, f Handler) {
+	r := newRoute(pattern, f)
+	s.routeMap[r.command] = append(s.routeMap[r.command], r)
 }
 
 func (s SocketServer) Run() {
@@ -64,43 +65,185 @@ func (s SocketServer) Run() {
 	}
 }
 
-func (s SocketServer) getRoute(command string) (func(transNum int, args ...string) string, []string) {
-	for regex, function := range s.routeMap {
-		re, err := regexp.Compile(regex)
-		if err != nil {
-			fmt.Printf(regex)
-			panic(err)
+// MaxMessageSize is the longest command line the server will accept, and
+// the largest request body the HTTP server will read
+const MaxMessageSize = 64 * 1024
+
+// errMessageTooLong is returned by readLine for a line longer than
+// MaxMessageSize
+var errMessageTooLong = errors.New("message longer than " + strconv.Itoa(MaxMessageSize) + " bytes")
+
+// Handles incoming requests.
+// Each request is a single line of the form "transNum;COMMAND,args...\n",
+// or "COMMAND,args...\n" to have the server assign the transaction number.
+// Clients may keep the connection open and send many requests, without
+// waiting for replies. Replies are written in the order requests were
+// received, as "transNum;response\n".
+// A client can switch the format of its replies by sending "FORMAT,JSON" or
+// "FORMAT,LEGACY", which is acknowledged with the same line.
+// A request longer than MaxMessageSize is answered with a BadArguments error
+// and skipped, without running any of it.
+func (s SocketServer) handleRequest(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	format := s.Format
+	for {
+		line, err := readLine(reader)
+		line = strings.Trim(line, "\r\n\x00 ")
+		if err == errMessageTooLong {
+			transNum, _ := strconv.Atoi(strings.SplitN(line, ";", 2)[0])
+			if transNum < 0 {
+				transNum = 0
+			}
+			res := response.Error(response.BadArguments, err.Error())
+			fmt.Fprintf(writer, "%d;%s\n", transNum, res.Encode(format))
+			err = nil
+		} else if strings.HasPrefix(line, "FORMAT,") {
+			if f, ok := response.ParseFormat(strings.TrimPrefix(line, "FORMAT,")); ok {
+				format = f
+			}
+			fmt.Fprintf(writer, "FORMAT,%s\n", format)
+		} else if line != "" {
+			transNum, res := s.handleMessage(line)
+			fmt.Fprintf(writer, "%d;%s\n", transNum, res.Encode(format))
+		}
+		// Only flush once every pipelined request that has arrived is answered
+		if reader.Buffered() == 0 || err != nil {
+			writer.Flush()
 		}
-		if re.MatchString(command) {
-			return function, getParamsFromRegex(regex, command)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Println("Error reading:", err.Error())
+			return
 		}
+	}
+}
 
+// readLine reads up to and including the next newline. A line longer than
+// MaxMessageSize is read to its end and discarded, returning only its start
+// along with errMessageTooLong.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > MaxMessageSize {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			return string(line[:MaxMessageSize]), errMessageTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
 	}
-	return nil, nil
 }
 
-// Handles incoming requests.
-func (s SocketServer) handleRequest(conn net.Conn) {
-	// Make a buffer to hold incoming data.
-	buf := make([]byte, 1024)
-	// Read the incoming connection into the buffer.
-	_, err := conn.Read(buf)
+// handleMessage runs the command in a single "transNum;COMMAND" or
+// "COMMAND" message
+func (s SocketServer) handleMessage(msg string) (int, response.Response) {
+	supplied, command := "", msg
+	if sepTransCommand := strings.SplitN(msg, ";", 2); len(sepTransCommand) == 2 {
+		supplied, command = strings.TrimSpace(sepTransCommand[0]), sepTransCommand[1]
+	}
+	split := strings.Split(command, ",")
+	for i := range split {
+		split[i] = strings.TrimSpace(split[i])
+	}
+	return s.Execute(supplied, split[0], split[1:])
+}
+
+// Execute runs the command with positional arguments, in the order of the
+// command's registered pattern. supplied is the client's transaction number,
+// or empty to have one assigned. Returns the transaction number the command
+// ran as, along with its reply. A command rejected for its transaction number
+// or arguments is logged as an error instead of running.
+func (s SocketServer) Execute(supplied string, command string, args []string) (int, response.Response) {
+	transNum, res := s.assignTransNum(supplied)
+	r, err := s.match(command, args)
+	if res != nil {
+		s.logRejected(transNum, command, r, args, res.Message)
+		return transNum, *res
+	}
 	if err != nil {
-		fmt.Println("Error reading:", err.Error())
+		s.logRejected(transNum, command, r, args, err.Error())
+		return transNum, err.Response()
+	}
+	return transNum, s.run(transNum, r, args)
+}
+
+// ExecuteNamed runs the command with arguments given by parameter name, such
+// as {"user": "bob", "amount": "10.00"} for ADD. The transaction number is
+// assigned as it is for Execute.
+func (s SocketServer) ExecuteNamed(supplied string, command string, args map[string]string) (int, response.Response) {
+	transNum, res := s.assignTransNum(supplied)
+	r, ordered, err := s.matchNamed(command, args)
+	if res != nil {
+		s.logRejected(transNum, command, r, ordered, res.Message)
+		return transNum, *res
+	}
+	if err != nil {
+		s.logRejected(transNum, command, r, ordered, err.Error())
+		return transNum, err.Response()
+	}
+	return transNum, s.run(transNum, r, ordered)
+}
+
+// run is the single path every transport uses to run a matched command, so
+// every command is logged before it runs
+func (s SocketServer) run(transNum int, r *route, args []string) response.Response {
+	if s.Logger != nil {
+		s.Logger.Log(s.commandEvent(transNum, r.command, r, args))
+	}
+	return r.handler(transNum, args...)
+}
+
+// commandEvent returns the command as a userCommand event, with its user,
+// stock, amount and filename where the route takes them. Amounts that aren't
+// a valid quantity of money are left out.
+func (s SocketServer) commandEvent(transNum int, command string, r *route, args []string) logger.UserCommand {
+	event := logger.UserCommand{Server: s.Name, TransactionNum: transNum, Command: command}
+	if r == nil {
+		return event
+	}
+	for i, param := range r.params {
+		switch param {
+		case "user":
+			event.Username = args[i]
+		case "stock":
+			event.StockSymbol = args[i]
+		case "filename":
+			event.Filename = args[i]
+		case "amount":
+			if amount, err := decimal.NewFromString(args[i]); err == nil && !amount.IsNegative() {
+				event.Funds = &amount
+			}
+		}
+	}
+	return event
+}
+
+// logRejected records a command that was rejected before it ran as an
+// errorEvent, with as much of the command as could be matched to a route.
+// Unknown commands have no place in the log's schema, so aren't logged. A
+// command without a valid transaction number is logged as a new one.
+func (s SocketServer) logRejected(transNum int, command string, r *route, args []string, errorMsg string) {
+	if s.Logger == nil {
 		return
 	}
-	sepTransCommand := strings.Split(string(buf[:]), ";")
-	transNum, _ := strconv.Atoi(sepTransCommand[0])
-	command := sepTransCommand[1]
-	function, params := s.getRoute(command)
-	if function == nil {
-		fmt.Printf("Error: command not implemented '%s'\n", command)
+	if _, ok := s.routeMap[command]; !ok {
 		return
 	}
-	fmt.Println(command)
-	res := function(transNum, params...)
-	// Send a response back to person contacting us.
-	conn.Write([]byte(res))
-	// Close the connection when you're done with it.
-	conn.Close()
+	if transNum < 1 {
+		var err error
+		if transNum, err = s.TransNums.NextTransNum(); err != nil {
+			return
+		}
+	}
+	c := s.commandEvent(transNum, command, r, args)
+	s.Logger.Log(logger.ErrorEvent{Server: c.Server, TransactionNum: c.TransactionNum, Command: c.Command,
+		Username: c.Username, StockSymbol: c.StockSymbol, Filename: c.Filename, Funds: c.Funds,
+		ErrorMessage: errorMsg})
 }
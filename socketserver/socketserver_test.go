@@ -0,0 +1,271 @@
+package socketserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"seng468/transaction-server/database"
+	"seng468/transaction-server/logger"
+	"seng468/transaction-server/response"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPipelinedRequests(t *testing.T) {
+	s := NewSocketServer("")
+	s.Format = response.Legacy
+	s.Route("ADD,<user>,<amount>", func(transNum int, args ...string) response.Response {
+		return response.Success(legacyString(args[0] + ":" + args[1]))
+	})
+
+	client, server := net.Pipe()
+	go s.handleRequest(server)
+	go func() {
+		long := strings.Repeat("a", 2000)
+		client.Write([]byte("1;ADD,bob,10\n2;ADD,al"))
+		client.Write([]byte("ice,20\n3;ADD," + long + ",30\n"))
+	}()
+
+	reader := bufio.NewReader(client)
+	expected := []string{"1;bob:10\n", "2;alice:20\n", "3;" + strings.Repeat("a", 2000) + ":30\n"}
+	for _, exp := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != exp {
+			t.Errorf("Expected reply %q, got %q", exp, line)
+		}
+	}
+	client.Close()
+}
+
+func TestOversizeRequest(t *testing.T) {
+	s := NewSocketServer("")
+	s.Format = response.JSON
+	s.Route("ADD,<user>,<amount>", func(transNum int, args ...string) response.Response {
+		return response.Success(legacyString(args[0] + ":" + args[1]))
+	})
+
+	client, server := net.Pipe()
+	go s.handleRequest(server)
+	go func() {
+		client.Write([]byte("1;ADD,bob,10\n7;ADD," + strings.Repeat("a", MaxMessageSize) + ",30\n"))
+		client.Write([]byte("2;ADD,alice,20\n"))
+	}()
+
+	reader := bufio.NewReader(client)
+	expected := []string{
+		`1;{"status":"ok","code":"OK","data":"bob:10"}` + "\n",
+		`7;{"status":"error","code":"BAD_ARGUMENTS","message":"message longer than 65536 bytes"}` + "\n",
+		`2;{"status":"ok","code":"OK","data":"alice:20"}` + "\n",
+	}
+	for _, exp := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != exp {
+			t.Errorf("Expected reply %q, got %q", exp, line)
+		}
+	}
+	client.Close()
+}
+
+func TestRouteMatching(t *testing.T) {
+	s := NewSocketServer("")
+	name := func(route string) Handler {
+		return func(transNum int, args ...string) response.Response {
+			return response.Success(route + "(" + strings.Join(args, ",") + ")")
+		}
+	}
+	s.Route("BUY,<user>,<stock>,<amount>", name("buy"))
+	s.Route("COMMIT_BUY,<user>", name("commit"))
+	s.Route("DUMPLOG,<user>,<filename>", name("dumpUser"))
+	s.Route("DUMPLOG,<filename>", name("dump"))
+
+	cases := map[string]string{
+		"1;BUY,bob,ABC,10.50":       "buy(bob,ABC,10.50)",
+		"2;COMMIT_BUY,bob":          "commit(bob)",
+		"3;DUMPLOG,bob,out.xml":     "dumpUser(bob,out.xml)",
+		"4;DUMPLOG,out.xml":         "dump(out.xml)",
+		"5;BUY,bob,ABC,ten":         "bad arguments: invalid amount 'ten'",
+		"6;BUY,bob,ABC,-5":          "bad arguments: invalid amount '-5'",
+		"7;BUY,bob,ABC":             "bad arguments: BUY does not take 2 arguments",
+		"8;COMMIT_BUY,":             "bad arguments: user is empty",
+		"9;SELL_EVERYTHING,bob":     "unknown command: SELL_EVERYTHING",
+		"10;BUY,bob,NOT A STOCK,10": "bad arguments: invalid stock 'NOT A STOCK'",
+		"11;BUY,bob,ABC,.5":         "buy(bob,ABC,.5)",
+		"12;BUY,bob,ABC,0.005":      "bad arguments: invalid amount '0.005'",
+		"13;BUY,bob,ABC,0":          "bad arguments: invalid amount '0'",
+		"14;BUY,bob,ABC,0.00":       "bad arguments: invalid amount '0.00'",
+		"15;BUY,bob,ABC,.00":        "bad arguments: invalid amount '.00'",
+		"16;BUY,bob,ABC,0.01":       "buy(bob,ABC,0.01)",
+		"17;BUY,bob,ABC,0.10":       "buy(bob,ABC,0.10)",
+		"18;BUY,bob,ABC,100":        "buy(bob,ABC,100)",
+	}
+	for msg, expected := range cases {
+		_, res := s.handleMessage(msg)
+		if res.OK() && res.Data != expected || !res.OK() && res.Message != expected {
+			t.Errorf("%s: expected %q, got %+v", msg, expected, res)
+		}
+	}
+}
+
+func TestFormatNegotiation(t *testing.T) {
+	s := NewSocketServer("")
+	s.Route("QUOTE,<user>,<stock>", func(transNum int, args ...string) response.Response {
+		return response.Success(legacyString("12.50"))
+	})
+
+	client, server := net.Pipe()
+	go s.handleRequest(server)
+	go client.Write([]byte("1;QUOTE,bob,ABC\n2;QUOTE,bob\nFORMAT,JSON\n3;QUOTE,bob,ABC\n4;QUOTE,bob\n" +
+		"FORMAT,LEGACY\n5;QUOTE,bob,ABC\n"))
+
+	reader := bufio.NewReader(client)
+	expected := []string{
+		"1;12.50\n",
+		"2;-1\n",
+		"FORMAT,JSON\n",
+		`3;{"status":"ok","code":"OK","data":"12.50"}` + "\n",
+		`4;{"status":"error","code":"BAD_ARGUMENTS","message":"bad arguments: QUOTE does not take 1 arguments"}` + "\n",
+		"FORMAT,LEGACY\n",
+		"5;12.50\n",
+	}
+	for _, exp := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != exp {
+			t.Errorf("Expected reply %q, got %q", exp, line)
+		}
+	}
+	client.Close()
+}
+
+// legacyString is result data that replies with itself in the legacy format
+type legacyString string
+
+func (l legacyString) Legacy() string {
+	return string(l)
+}
+
+func TestTransNumAssignment(t *testing.T) {
+	s := NewSocketServer("")
+	s.Route("COMMIT_BUY,<user>", func(transNum int, args ...string) response.Response {
+		return response.Success(nil)
+	})
+
+	cases := []struct {
+		msg      string
+		transNum int
+		code     response.Code
+	}{
+		{"COMMIT_BUY,bob", 1, response.OK},
+		{"3;COMMIT_BUY,bob", 3, response.OK},
+		{"COMMIT_BUY,bob", 2, response.OK},
+		{"COMMIT_BUY,bob", 4, response.OK},
+		{";COMMIT_BUY,bob", 5, response.OK},
+		{"3;COMMIT_BUY,bob", 3, response.DuplicateTransNum},
+		{"4;COMMIT_BUY,bob", 4, response.DuplicateTransNum},
+		{"three;COMMIT_BUY,bob", 0, response.BadArguments},
+		{"-7;COMMIT_BUY,bob", 0, response.BadArguments},
+		{"0;COMMIT_BUY,bob", 0, response.BadArguments},
+		{"99999999999;COMMIT_BUY,bob", 0, response.BadArguments},
+		// Numbers are tracked up to MaxTransNum, so a client can't make the
+		// server track billions of them
+		{"4294967295;COMMIT_BUY,bob", 0, response.BadArguments},
+		{strconv.Itoa(database.MaxTransNum+1) + ";COMMIT_BUY,bob", 0, response.BadArguments},
+		{strconv.Itoa(database.MaxTransNum) + ";COMMIT_BUY,bob", database.MaxTransNum, response.OK},
+		{"COMMIT_BUY,bob", 6, response.OK},
+	}
+	for _, c := range cases {
+		transNum, res := s.handleMessage(c.msg)
+		if transNum != c.transNum || res.Code != c.code {
+			t.Errorf("%s: expected %d %s, got %d %+v", c.msg, c.transNum, c.code, transNum, res)
+		}
+	}
+	// Numbers assigned past MaxTransNum can't be claimed, so aren't tracked
+	local := s.TransNums.(*localTransNums)
+	local.last = database.MaxTransNum - 1
+	for _, expected := range []int{database.MaxTransNum + 1, database.MaxTransNum + 2} {
+		if transNum, _ := s.handleMessage("COMMIT_BUY,bob"); transNum != expected {
+			t.Error("Expected to be assigned", expected, "got", transNum)
+		}
+	}
+	if used := len(local.used); used > database.MaxTransNum/64+1 {
+		t.Error("Expected at most", database.MaxTransNum/64+1, "words of used numbers, got", used)
+	}
+}
+
+// commandLogger records the userCommand and errorEvent events logged to it
+type commandLogger struct {
+	commands []string
+}
+
+func (l *commandLogger) Log(event logger.Event) {
+	c, ok := event.(logger.UserCommand)
+	prefix := ""
+	if e, isError := event.(logger.ErrorEvent); isError {
+		c, ok = logger.UserCommand{Server: e.Server, TransactionNum: e.TransactionNum, Command: e.Command,
+			Username: e.Username, StockSymbol: e.StockSymbol, Filename: e.Filename, Funds: e.Funds}, true
+		prefix = "error "
+	}
+	if ok {
+		if err := event.Validate(); err != nil {
+			prefix = "invalid " + prefix
+		}
+		funds := "-"
+		if c.Funds != nil {
+			funds = c.Funds.String()
+		}
+		l.commands = append(l.commands, fmt.Sprintf("%s%s %d %s %q %q %q %s", prefix, c.Server,
+			c.TransactionNum, c.Command, c.Username, c.StockSymbol, c.Filename, funds))
+	}
+}
+func (*commandLogger) DumpLog(string, string) {}
+
+func TestUserCommandLogging(t *testing.T) {
+	commands := &commandLogger{}
+	s := NewSocketServer("")
+	s.Logger = commands
+	s.Name = "transactionserve"
+	ok := func(transNum int, args ...string) response.Response {
+		return response.Success(nil)
+	}
+	s.Route("BUY,<user>,<stock>,<amount>", ok)
+	s.Route("COMMIT_BUY,<user>", ok)
+	s.Route("DUMPLOG,<filename>", ok)
+
+	s.handleMessage("1;BUY,bob,ABC,10.50")
+	s.handleMessage("2;COMMIT_BUY,bob")
+	s.handleMessage("3;DUMPLOG,out.xml")
+	s.ExecuteNamed("4", "BUY", map[string]string{"user": "al", "stock": "DEF", "amount": "5"})
+	// Rejected commands never run, so are logged as errors instead
+	s.handleMessage("5;BUY,bob,ABC,ten")
+	s.handleMessage("6;BUY,bob,ABC,-5")
+	s.handleMessage("2;COMMIT_BUY,al")
+	s.handleMessage("7;BUY,bob")
+	s.handleMessage("-1;COMMIT_BUY,bob")
+	// Unknown commands aren't in the log's schema, so aren't logged at all
+	s.handleMessage("8;SELL_EVERYTHING,bob")
+
+	expected := []string{
+		`transactionserve 1 BUY "bob" "ABC" "" 10.5`,
+		`transactionserve 2 COMMIT_BUY "bob" "" "" -`,
+		`transactionserve 3 DUMPLOG "" "" "out.xml" -`,
+		`transactionserve 4 BUY "al" "DEF" "" 5`,
+		`error transactionserve 5 BUY "bob" "ABC" "" -`,
+		`error transactionserve 6 BUY "bob" "ABC" "" -`,
+		`error transactionserve 2 COMMIT_BUY "al" "" "" -`,
+		`error transactionserve 7 BUY "" "" "" -`,
+		`error transactionserve 8 COMMIT_BUY "bob" "" "" -`,
+	}
+	if strings.Join(commands.commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected commands logged:\n%s\ngot:\n%s", strings.Join(expected, "\n"),
+			strings.Join(commands.commands, "\n"))
+	}
+}
@@ -0,0 +1,80 @@
+package socketserver
+
+import (
+	"seng468/transaction-server/database"
+	"seng468/transaction-server/response"
+	"strconv"
+	"sync"
+)
+
+// TransNumSource hands out transaction numbers, and tracks which have been
+// used so no two commands run with the same number
+type TransNumSource interface {
+	// NextTransNum returns a transaction number that hasn't been used
+	NextTransNum() (int, error)
+	// ClaimTransNum marks a client supplied transaction number as used,
+	// returning false if it already was
+	ClaimTransNum(transNum int) (bool, error)
+}
+
+// localTransNums is a TransNumSource for a single server, that starts over
+// when the server restarts
+type localTransNums struct {
+	mu   sync.Mutex
+	last int
+	// used has a bit set for each number that has been used, up to
+	// database.MaxTransNum, the largest a client may supply
+	used database.TransNumBits
+}
+
+func newLocalTransNums() *localTransNums {
+	return &localTransNums{}
+}
+
+func (l *localTransNums) NextTransNum() (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last++
+	for l.last <= database.MaxTransNum && l.used.Set(l.last) {
+		l.last++
+	}
+	return l.last, nil
+}
+
+func (l *localTransNums) ClaimTransNum(transNum int) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.used.Set(transNum), nil
+}
+
+// assignTransNum returns the transaction number to run a command as. An empty
+// supplied number is assigned the next one from the server's source, otherwise
+// the client's number is used if it is valid and hasn't been used before.
+// Duplicate numbers are returned along with the error, so the client can
+// tell which request was rejected.
+func (s SocketServer) assignTransNum(supplied string) (int, *response.Response) {
+	if supplied == "" {
+		transNum, err := s.TransNums.NextTransNum()
+		if err != nil {
+			res := response.Error(response.DatabaseError, "Could not assign a transaction number: "+err.Error())
+			return 0, &res
+		}
+		return transNum, nil
+	}
+
+	transNum, err := strconv.Atoi(supplied)
+	if err != nil || transNum < 1 || transNum > database.MaxTransNum {
+		res := response.Error(response.BadArguments, "invalid transaction number '"+supplied+"'")
+		return 0, &res
+	}
+	claimed, err := s.TransNums.ClaimTransNum(transNum)
+	if err != nil {
+		res := response.Error(response.DatabaseError, "Could not claim transaction number: "+err.Error())
+		return transNum, &res
+	}
+	if !claimed {
+		res := response.Error(response.DuplicateTransNum, "transaction number "+supplied+" has already been used")
+		return transNum, &res
+	}
+	return transNum, nil
+}
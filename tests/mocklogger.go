@@ -1,26 +1,55 @@
 package tests
 
+import (
+	"seng468/transaction-server/logger"
+	"strconv"
+	"sync"
+)
+
+// MockLogger records the commands that were logged as errors, the account
+// transactions, and the dumps that were requested
 type MockLogger struct {
+	mu           sync.Mutex
+	errors       []string
+	transactions []string
+	dumps        []string
 }
 
-func (MockLogger) QuoteServer(server string, transNum int, reply *transactionserver.QuoteReply) {
-
+func (l *MockLogger) Log(event logger.Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch e := event.(type) {
+	case logger.ErrorEvent:
+		l.errors = append(l.errors, e.Command)
+	case logger.AccountTransaction:
+		l.transactions = append(l.transactions,
+			strconv.Itoa(e.TransactionNum)+" "+e.Action+" "+e.Username+" "+e.Funds.StringFixed(2))
+	}
 }
 
-func (MockLogger) AccountTransaction(server string, transNum int, action string, user interface{}, funds interface{}) {
-
+func (l *MockLogger) DumpLog(filename string, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if username != "" {
+		filename = username + ":" + filename
+	}
+	l.dumps = append(l.dumps, filename)
 }
 
-func (MockLogger) SystemError(server string, transNum int, command string, user interface{}, stock interface{}, filename interface{},
-	funds interface{}, errorMsg interface{}) {
-
+func (l *MockLogger) loggedErrors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.errors...)
 }
 
-func (MockLogger) SystemEvent(server string, transNum int, command string, username interface{}, stock interface{},
-	filename interface{}, funds interface{}) {
-
+func (l *MockLogger) loggedTransactions() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.transactions...)
 }
 
-func (MockLogger) DumpLog(filename string, username interface{}) {
-
+func (l *MockLogger) loggedDumps() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.dumps...)
 }
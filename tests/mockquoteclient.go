@@ -2,21 +2,38 @@ package tests
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/shopspring/decimal"
 )
 
 type MockQuoteClient struct {
+	mu       sync.Mutex
 	stockMap map[string]decimal.Decimal
+	flushed  []string
 }
 
 func (qc *MockQuoteClient) Query(user string, stock string, transNum int) (decimal.Decimal, error) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
 	if val, ok := qc.stockMap[stock]; ok {
 		return val, nil
 	}
 	return decimal.Decimal{}, errors.New("stock not mocked")
 }
 
+func (qc *MockQuoteClient) QueryForTrade(user string, stock string, transNum int) (decimal.Decimal, error) {
+	return qc.Query(user, stock, transNum)
+}
+
+func (qc *MockQuoteClient) Flush(stock string) bool {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	qc.flushed = append(qc.flushed, stock)
+	_, ok := qc.stockMap[stock]
+	return ok
+}
+
 func NewMockQuoteClient() *MockQuoteClient {
 	return &MockQuoteClient{
 		stockMap: make(map[string]decimal.Decimal),
@@ -24,5 +41,7 @@ func NewMockQuoteClient() *MockQuoteClient {
 }
 
 func (qc *MockQuoteClient) addRule(stock string, amount decimal.Decimal) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
 	qc.stockMap[stock] = amount
 }
@@ -1,8 +0,0 @@
-package tests
-
-type MockServer struct {
-}
-
-func (MockServer) TransactionNum() int {
-	return 0
-}
@@ -1,32 +1,547 @@
 package tests
 
 import (
+	"seng468/transaction-server/database"
+	"seng468/transaction-server/response"
+	"seng468/transaction-server/socketserver"
+	"seng468/transaction-server/transactionserver"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
 
-func NewMockTransactionServer() transactionserver.TransactionServer {
-	mockQuote := NewMockQuoteClient()
-	mockDB := NewMockDatabase()
-	mockLogger := MockLogger{}
-	mockServer := MockServer{}
-	return transactionserver.TransactionServer{
-		Name:         "mock_transaction_serve",
-		Addr:         "mock_addr",
-		Server:       mockServer,
-		Logger:       mockLogger,
-		UserDatabase: mockDB,
-		QuoteClient:  mockQuote,
+// testServer is a TransactionServer backed by an in memory database and
+// mocked quotes, with its commands routed through a socket server that
+// is never started
+type testServer struct {
+	*transactionserver.TransactionServer
+	router socketserver.SocketServer
+	db     *database.MemoryDatabase
+	quotes *MockQuoteClient
+	logger *MockLogger
+}
+
+func NewMockTransactionServer() testServer {
+	return newMockServer(0)
+}
+
+// newMockServer returns a testServer trading shares to sharePrecision
+// decimal places
+func newMockServer(sharePrecision int32) testServer {
+	return newMockServerOn(database.NewMemoryDatabase(), NewMockQuoteClient(), sharePrecision)
+}
+
+// newMockServerOn returns a testServer using the database and quotes
+func newMockServerOn(db *database.MemoryDatabase, quotes *MockQuoteClient, sharePrecision int32) testServer {
+	s := testServer{
+		router: socketserver.NewSocketServer("mock_addr"),
+		db:     db,
+		quotes: quotes,
+		logger: &MockLogger{},
+	}
+	s.router.TransNums = s.db
+	s.TransactionServer = transactionserver.NewTransactionServer("mock_transaction_serve", "mock_addr",
+		s.router, s.logger, s.db, s.quotes, sharePrecision)
+	return s
+}
+
+// restarted returns a new server on the same database and quotes, as the
+// server would be after restarting
+func (s testServer) restarted() testServer {
+	return newMockServerOn(s.db, s.quotes, s.SharePrecision)
+}
+
+// run sends a command such as "ADD,user1,50.00" through the router, as a
+// client would
+func (s testServer) run(command string) response.Response {
+	split := strings.Split(command, ",")
+	_, res := s.router.Execute("", split[0], split[1:])
+	return res
+}
+
+// expect runs the command, failing the test if it doesn't reply with the code
+func (s testServer) expect(t *testing.T, command string, code response.Code) response.Response {
+	res := s.run(command)
+	if res.Code != code {
+		t.Errorf("%s: expected %s, got %+v", command, code, res)
+	}
+	return res
+}
+
+// expectAccount fails the test if the user's funds or shares of the stock
+// don't match
+func (s testServer) expectAccount(t *testing.T, user string, funds string, stock string, shares string) {
+	actualFunds, _ := s.db.GetFunds(user)
+	actualShares, _ := s.db.GetStock(user, stock)
+	if !actualFunds.Equal(dollars(funds)) || !actualShares.Equal(quantity(shares)) {
+		t.Errorf("Expected %s with %s funds and %s %s, has %s and %s",
+			user, funds, shares, stock, actualFunds, actualShares)
+	}
+}
+
+// expectReserve fails the test if the user's reserved funds or shares of the
+// stock don't match
+func (s testServer) expectReserve(t *testing.T, user string, funds string, stock string, shares string) {
+	actualFunds, _ := s.db.GetReserveFunds(user)
+	actualShares, _ := s.db.GetReserveStock(user, stock)
+	if !actualFunds.Equal(dollars(funds)) || !actualShares.Equal(quantity(shares)) {
+		t.Errorf("Expected %s with %s reserved funds and %s reserved %s, has %s and %s",
+			user, funds, shares, stock, actualFunds, actualShares)
 	}
 }
 
+func dollars(amount string) decimal.Decimal {
+	d, _ := decimal.NewFromString(amount)
+	return d
+}
+
+func quantity(shares string) decimal.Decimal {
+	d, _ := decimal.NewFromString(shares)
+	return d
+}
+
+// waitFor polls until the condition is met, failing the test if it takes
+// longer than a few trigger checks
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Timed out waiting for", what)
+}
+
 func TestTransactionServer_Add(t *testing.T) {
 	ts := NewMockTransactionServer()
-	ts.Add("user1", "50.00")
-	actual, _ := ts.UserDatabase.GetFunds("user1")
-	expected := decimal.NewFromFloat(50.00)
-	if !actual.Equal(expected) {
-		t.Error("UserDatabase did not add funds")
+	ts.expect(t, "ADD,user1,50.00", response.OK)
+	ts.expect(t, "ADD,user1,0.25", response.OK)
+	ts.expectAccount(t, "user1", "50.25", "ABC", "0")
+
+	ts.expect(t, "ADD,user1,fifty", response.BadArguments)
+	ts.expect(t, "ADD,user1", response.BadArguments)
+	ts.expect(t, "ADD,user1,0.005", response.BadArguments)
+	ts.expect(t, "ADD,user1,0.00", response.BadArguments)
+	ts.expectAccount(t, "user1", "50.25", "ABC", "0")
+}
+
+func TestTransactionServer_Quote(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("12.50"))
+	res := ts.expect(t, "QUOTE,user1,ABC", response.OK)
+	if quote, ok := res.Data.(transactionserver.QuoteResult); !ok || !quote.Price.Equal(dollars("12.50")) {
+		t.Errorf("Expected a quote of 12.50, got %+v", res.Data)
+	}
+	ts.expect(t, "QUOTE,user1,XYZ", response.QuoteUnavailable)
+}
+
+func TestTransactionServer_Buy(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.expect(t, "BUY,user1,ABC,25.00", response.InsufficientFunds)
+	ts.expect(t, "BUY,user1,XYZ,25.00", response.QuoteUnavailable)
+
+	ts.run("ADD,user1,100.00")
+	res := ts.expect(t, "BUY,user1,ABC,25.00", response.OK)
+	order := res.Data.(transactionserver.OrderResult)
+	if !order.Shares.Equal(quantity("2")) || !order.Cost.Equal(dollars("20")) || !order.Balance.Equal(dollars("80")) {
+		t.Errorf("Expected to buy 2 shares for 20.00 leaving 80.00, got %+v", order)
+	}
+	ts.expectAccount(t, "user1", "80.00", "ABC", "0")
+}
+
+func TestTransactionServer_CommitBuy(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.expect(t, "COMMIT_BUY,user1", response.NoPendingOrder)
+
+	ts.run("ADD,user1,100.00")
+	ts.run("BUY,user1,ABC,25.00")
+	ts.expect(t, "COMMIT_BUY,user1", response.OK)
+	ts.expectAccount(t, "user1", "80.00", "ABC", "2")
+	ts.expect(t, "COMMIT_BUY,user1", response.NoPendingOrder)
+}
+
+func TestTransactionServer_CancelBuy(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.expect(t, "CANCEL_BUY,user1", response.NoPendingOrder)
+
+	ts.run("ADD,user1,100.00")
+	ts.run("BUY,user1,ABC,25.00")
+	ts.expect(t, "CANCEL_BUY,user1", response.OK)
+	ts.expectAccount(t, "user1", "100.00", "ABC", "0")
+	ts.expect(t, "COMMIT_BUY,user1", response.NoPendingOrder)
+}
+
+func TestTransactionServer_Sell(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "ABC", quantity("3"))
+	ts.expect(t, "SELL,user1,ABC,40.00", response.InsufficientStock)
+
+	res := ts.expect(t, "SELL,user1,ABC,25.00", response.OK)
+	order := res.Data.(transactionserver.OrderResult)
+	if !order.Shares.Equal(quantity("2")) || !order.Cost.Equal(dollars("20")) || !order.Held.Equal(quantity("1")) {
+		t.Errorf("Expected to sell 2 shares for 20.00 leaving 1, got %+v", order)
+	}
+	ts.expectAccount(t, "user1", "0", "ABC", "1")
+}
+
+func TestTransactionServer_CommitSell(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "ABC", quantity("3"))
+	ts.expect(t, "COMMIT_SELL,user1", response.NoPendingOrder)
+
+	ts.run("SELL,user1,ABC,25.00")
+	ts.expect(t, "COMMIT_SELL,user1", response.OK)
+	ts.expectAccount(t, "user1", "20.00", "ABC", "1")
+	ts.expect(t, "COMMIT_SELL,user1", response.NoPendingOrder)
+}
+
+func TestTransactionServer_CancelSell(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "ABC", quantity("3"))
+	ts.expect(t, "CANCEL_SELL,user1", response.NoPendingOrder)
+
+	ts.run("SELL,user1,ABC,25.00")
+	ts.expect(t, "CANCEL_SELL,user1", response.OK)
+	ts.expectAccount(t, "user1", "0", "ABC", "3")
+	ts.expect(t, "COMMIT_SELL,user1", response.NoPendingOrder)
+}
+
+func TestTransactionServer_SetBuyAmount(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.expect(t, "SET_BUY_AMOUNT,user1,ABC,30.00", response.InsufficientFunds)
+
+	ts.run("ADD,user1,100.00")
+	ts.expect(t, "SET_BUY_AMOUNT,user1,ABC,30.00", response.OK)
+	ts.expectAccount(t, "user1", "70.00", "ABC", "0")
+	ts.expectReserve(t, "user1", "30.00", "ABC", "0")
+
+	// A second trigger for the stock would strand the first one's reserve
+	ts.expect(t, "SET_BUY_AMOUNT,user1,ABC,30.00", response.TriggerExists)
+	ts.expectAccount(t, "user1", "70.00", "ABC", "0")
+	ts.expect(t, "CANCEL_SET_BUY,user1,ABC", response.OK)
+	ts.expectAccount(t, "user1", "100.00", "ABC", "0")
+	ts.expectReserve(t, "user1", "0", "ABC", "0")
+}
+
+func TestTransactionServer_CancelSetBuy(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.expect(t, "CANCEL_SET_BUY,user1,ABC", response.NoTrigger)
+
+	ts.run("ADD,user1,100.00")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+	ts.expect(t, "CANCEL_SET_BUY,user1,ABC", response.OK)
+	ts.expectAccount(t, "user1", "100.00", "ABC", "0")
+	ts.expectReserve(t, "user1", "0", "ABC", "0")
+	ts.expect(t, "CANCEL_SET_BUY,user1,ABC", response.NoTrigger)
+}
+
+func TestTransactionServer_SetBuyTrigger(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.Start()
+	defer ts.TriggerEngine.Stop()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.expect(t, "SET_BUY_TRIGGER,user1,ABC,8.00", response.NoTrigger)
+
+	ts.run("ADD,user1,100.00")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+	ts.expect(t, "SET_BUY_TRIGGER,user1,ABC,8.00", response.OK)
+	time.Sleep(300 * time.Millisecond)
+	ts.expectAccount(t, "user1", "70.00", "ABC", "0")
+
+	ts.quotes.addRule("ABC", dollars("7.50"))
+	waitFor(t, "the buy trigger to execute", func() bool {
+		shares, _ := ts.db.GetStock("user1", "ABC")
+		return shares.Equal(quantity("4"))
+	})
+	ts.expectAccount(t, "user1", "70.00", "ABC", "4")
+	ts.expectReserve(t, "user1", "0", "ABC", "0")
+	ts.expect(t, "CANCEL_SET_BUY,user1,ABC", response.NoTrigger)
+}
+
+func TestTransactionServer_UnbackedTriggerIsDropped(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.Start()
+	defer ts.TriggerEngine.Stop()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.run("ADD,user1,100.00")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+	ts.run("SET_BUY_TRIGGER,user1,ABC,8.00")
+
+	// The reserve no longer covers the trigger when it executes
+	ts.db.RemoveReserveFunds("user1", dollars("20.00"))
+	ts.quotes.addRule("ABC", dollars("7.50"))
+	waitFor(t, "the failed trigger to be logged", func() bool {
+		return len(ts.logger.loggedErrors()) == 1
+	})
+	if errors := ts.logger.loggedErrors(); errors[0] != "SET_BUY_TRIGGER" {
+		t.Error("Expected SET_BUY_TRIGGER to be logged, got", errors)
+	}
+	ts.expectAccount(t, "user1", "70.00", "ABC", "0")
+	ts.expectReserve(t, "user1", "10.00", "ABC", "0")
+	ts.expect(t, "CANCEL_SET_BUY,user1,ABC", response.NoTrigger)
+}
+
+func TestTransactionServer_SetSellAmount(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "ABC", quantity("10"))
+	ts.expect(t, "SET_SELL_AMOUNT,user1,ABC,200.00", response.InsufficientStock)
+	ts.expect(t, "SET_SELL_AMOUNT,user1,XYZ,50.00", response.QuoteUnavailable)
+
+	ts.expect(t, "SET_SELL_AMOUNT,user1,ABC,50.00", response.OK)
+	ts.expectAccount(t, "user1", "0", "ABC", "10")
+	ts.expectReserve(t, "user1", "0", "ABC", "0")
+	ts.expect(t, "SET_SELL_AMOUNT,user1,ABC,20.00", response.TriggerExists)
+}
+
+func TestTransactionServer_SetSellTrigger(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.Start()
+	defer ts.TriggerEngine.Stop()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "ABC", quantity("10"))
+	ts.expect(t, "SET_SELL_TRIGGER,user1,ABC,12.00", response.NoTrigger)
+
+	ts.run("SET_SELL_AMOUNT,user1,ABC,50.00")
+	// Enough shares are reserved to sell 50.00 at the trigger price
+	ts.expect(t, "SET_SELL_TRIGGER,user1,ABC,12.00", response.OK)
+	ts.expectAccount(t, "user1", "0", "ABC", "6")
+	ts.expectReserve(t, "user1", "0", "ABC", "4")
+
+	ts.quotes.addRule("ABC", dollars("12.50"))
+	waitFor(t, "the sell trigger to execute", func() bool {
+		funds, _ := ts.db.GetFunds("user1")
+		return funds.Equal(dollars("50"))
+	})
+	ts.expectAccount(t, "user1", "50.00", "ABC", "6")
+	ts.expectReserve(t, "user1", "0", "ABC", "0")
+	ts.expect(t, "CANCEL_SET_SELL,user1,ABC", response.NoTrigger)
+}
+
+func TestTransactionServer_ZeroTriggerPrice(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "ABC", quantity("10"))
+	ts.run("ADD,user1,100.00")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+	ts.run("SET_SELL_AMOUNT,user1,ABC,50.00")
+
+	ts.expect(t, "SET_SELL_TRIGGER,user1,ABC,0", response.BadArguments)
+	ts.expect(t, "SET_BUY_TRIGGER,user1,ABC,0.00", response.BadArguments)
+	ts.expect(t, "SET_BUY_AMOUNT,user1,DEF,0", response.BadArguments)
+	if res := ts.SetSellTrigger(1, "user1", "ABC", "0"); res.Code != response.BadArguments {
+		t.Error("Expected a sell trigger price of 0 to be rejected, got", res)
+	}
+	if res := ts.SetBuyTrigger(2, "user1", "ABC", "0.00"); res.Code != response.BadArguments {
+		t.Error("Expected a buy trigger price of 0 to be rejected, got", res)
+	}
+	ts.expectAccount(t, "user1", "70.00", "ABC", "10")
+	ts.expectReserve(t, "user1", "30.00", "ABC", "0")
+
+	// Triggers that wouldn't trade a whole share are rejected too
+	ts.expect(t, "SET_SELL_TRIGGER,user1,ABC,60.00", response.BadArguments)
+	ts.expect(t, "SET_BUY_TRIGGER,user1,ABC,31.00", response.BadArguments)
+	ts.expectAccount(t, "user1", "70.00", "ABC", "10")
+	ts.expectReserve(t, "user1", "30.00", "ABC", "0")
+}
+
+func TestTransactionServer_CancelSetSell(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "ABC", quantity("10"))
+	ts.expect(t, "CANCEL_SET_SELL,user1,ABC", response.NoTrigger)
+
+	ts.run("SET_SELL_AMOUNT,user1,ABC,50.00")
+	ts.run("SET_SELL_TRIGGER,user1,ABC,12.00")
+	ts.expect(t, "CANCEL_SET_SELL,user1,ABC", response.OK)
+	ts.expectAccount(t, "user1", "0", "ABC", "10")
+	ts.expectReserve(t, "user1", "0", "ABC", "0")
+	ts.expect(t, "CANCEL_SET_SELL,user1,ABC", response.NoTrigger)
+}
+
+func TestTransactionServer_RestoresTriggers(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.db.AddStock("user1", "DEF", quantity("10"))
+	ts.run("ADD,user1,100.00")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+	ts.run("SET_BUY_TRIGGER,user1,ABC,8.00")
+	ts.quotes.addRule("DEF", dollars("10.00"))
+	ts.run("SET_SELL_AMOUNT,user1,DEF,50.00")
+	ts.run("SET_SELL_TRIGGER,user1,DEF,12.50")
+
+	restarted := ts.restarted()
+	restarted.Start()
+	defer restarted.TriggerEngine.Stop()
+	if mismatches, err := restarted.ReconcileReserves(); err != nil || len(mismatches) != 0 {
+		t.Error("Restored triggers should back every reserve, got", mismatches, err)
+	}
+	if errors := restarted.logger.loggedErrors(); len(errors) != 0 {
+		t.Error("Expected no errors restoring triggers, got", errors)
+	}
+
+	// The buy trigger is armed again, and the sell trigger can be cancelled
+	ts.quotes.addRule("ABC", dollars("7.50"))
+	waitFor(t, "the restored buy trigger to execute", func() bool {
+		shares, _ := ts.db.GetStock("user1", "ABC")
+		return shares.Equal(quantity("4"))
+	})
+	restarted.expect(t, "CANCEL_SET_SELL,user1,DEF", response.OK)
+	restarted.expectAccount(t, "user1", "70.00", "DEF", "10")
+	restarted.expectReserve(t, "user1", "0", "DEF", "0")
+}
+
+func TestTransactionServer_ReconcileReserves(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.run("ADD,user1,100.00")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+	ts.db.AddReserveFunds("user2", dollars("5.00"))
+	ts.db.AddReserveStock("user2", "DEF", quantity("3"))
+
+	// Starting restores the buy trigger, then reports what it doesn't back
+	restarted := ts.restarted()
+	restarted.Start()
+	defer restarted.TriggerEngine.Stop()
+	// The log only has user commands, so mismatches are logged against the
+	// commands that reserve funds and shares
+	errors := restarted.logger.loggedErrors()
+	sort.Strings(errors)
+	if strings.Join(errors, " ") != "SET_BUY_AMOUNT SET_SELL_TRIGGER" {
+		t.Error("Expected each mismatch logged on start, got", errors)
+	}
+	mismatches, err := restarted.ReconcileReserves()
+	if err != nil || len(mismatches) != 2 {
+		t.Fatal("Expected the unbacked funds and shares reported, got", mismatches, err)
+	}
+	for _, m := range mismatches {
+		if m.User != "user2" || m.Stock == "" && m.Reserved != "5" || m.Stock == "DEF" && m.Reserved != "3" {
+			t.Errorf("Unexpected mismatch %+v", m)
+		}
+	}
+	// Reconciling only reports, so the reserves are left alone
+	restarted.expectReserve(t, "user2", "5.00", "DEF", "3")
+}
+
+func TestTransactionServer_DumpLog(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.expect(t, "DUMPLOG,user1,user.xml", response.OK)
+	ts.expect(t, "DUMPLOG,all.xml", response.OK)
+	waitFor(t, "the logs to be dumped", func() bool {
+		return len(ts.logger.loggedDumps()) == 2
+	})
+	dumps := strings.Join(ts.logger.loggedDumps(), " ")
+	if !strings.Contains(dumps, "user1:user.xml") || !strings.Contains(dumps, "all.xml") {
+		t.Error("Expected a user dump and a full dump, got", dumps)
+	}
+}
+
+func TestTransactionServer_DisplaySummary(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.run("ADD,user1,100.00")
+	ts.run("BUY,user1,ABC,25.00")
+	ts.run("COMMIT_BUY,user1")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+
+	res := ts.expect(t, "DISPLAY_SUMMARY,user1", response.OK)
+	summary := res.Data.(transactionserver.Summary)
+	if !summary.Balance.Equal(dollars("50")) || !summary.ReserveBalance.Equal(dollars("30")) {
+		t.Errorf("Summary has the wrong balance: %+v", summary)
+	}
+	if !summary.Stocks["ABC"].Equal(quantity("2")) || len(summary.BuyTriggers) != 1 || len(summary.History) != 2 {
+		t.Errorf("Summary has the wrong holdings or history: %+v", summary)
+	}
+}
+
+func TestTransactionServer_FractionalShares(t *testing.T) {
+	ts := newMockServer(4)
+	ts.quotes.addRule("ABC", dollars("3.00"))
+	ts.run("ADD,user1,100.00")
+
+	// 10 / 3 is truncated to 4 decimal places, costing 3.3333 * 3 = 9.9999
+	res := ts.expect(t, "BUY,user1,ABC,10.00", response.OK)
+	if order := res.Data.(transactionserver.OrderResult); !order.Shares.Equal(quantity("3.3333")) ||
+		!order.Cost.Equal(dollars("10")) {
+		t.Errorf("Expected to buy 3.3333 shares for 10.00, got %+v", order)
+	}
+	ts.expect(t, "COMMIT_BUY,user1", response.OK)
+	ts.expectAccount(t, "user1", "90", "ABC", "3.3333")
+
+	ts.expect(t, "SELL,user1,ABC,4.50", response.OK)
+	ts.expect(t, "COMMIT_SELL,user1", response.OK)
+	ts.expectAccount(t, "user1", "94.50", "ABC", "1.8333")
+
+	ts.expect(t, "SET_SELL_AMOUNT,user1,ABC,3.00", response.OK)
+	ts.expect(t, "SET_SELL_TRIGGER,user1,ABC,2.00", response.OK)
+	ts.expectReserve(t, "user1", "0", "ABC", "1.5")
+	ts.expectAccount(t, "user1", "94.50", "ABC", "0.3333")
+
+	// Precision past what the database can hold is clamped
+	if ts := newMockServer(10); ts.SharePrecision != database.MaxSharePrecision {
+		t.Error("Expected the share precision to be clamped, got", ts.SharePrecision)
+	}
+}
+
+func TestTransactionServer_FlushQuote(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	res := ts.expect(t, "FLUSH_QUOTE,ABC", response.OK)
+	if flush := res.Data.(transactionserver.FlushResult); flush.Stock != "ABC" || !flush.Flushed {
+		t.Errorf("Expected ABC to be flushed, got %+v", flush)
+	}
+	ts.expect(t, "FLUSH_QUOTE", response.BadArguments)
+}
+
+func TestTransactionServer_LogsFailures(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.expect(t, "COMMIT_SELL,user1", response.NoPendingOrder)
+	waitFor(t, "the failure to be logged", func() bool {
+		return len(ts.logger.loggedErrors()) == 1
+	})
+	if errors := ts.logger.loggedErrors(); errors[0] != "COMMIT_SELL" {
+		t.Error("Expected COMMIT_SELL to be logged, got", errors)
+	}
+}
+
+func TestTransactionServer_LogsAccountTransactions(t *testing.T) {
+	ts := NewMockTransactionServer()
+	ts.quotes.addRule("ABC", dollars("10.00"))
+	ts.run("ADD,user1,100.00")
+	ts.run("BUY,user1,ABC,25.00")
+	ts.run("CANCEL_BUY,user1")
+	ts.run("BUY,user1,ABC,15.00")
+	ts.run("COMMIT_BUY,user1")
+	ts.run("SELL,user1,ABC,10.00")
+	ts.run("COMMIT_SELL,user1")
+	ts.run("SET_BUY_AMOUNT,user1,ABC,30.00")
+	ts.run("CANCEL_SET_BUY,user1,ABC")
+	ts.expect(t, "CANCEL_BUY,user1", response.NoPendingOrder)
+
+	// Every change to funds is logged with the amount actually moved, such
+	// as the cost of a buy rather than the amount asked for
+	expected := []string{
+		"1 add user1 100.00",
+		"2 remove user1 20.00",
+		"3 add user1 20.00",
+		"4 remove user1 10.00",
+		"7 add user1 10.00",
+		"8 remove user1 30.00",
+		"8 reserve user1 30.00",
+		"9 unreserve user1 30.00",
+		"9 add user1 30.00",
+	}
+	if logged := ts.logger.loggedTransactions(); strings.Join(logged, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected account transactions:\n%s\ngot:\n%s", strings.Join(expected, "\n"),
+			strings.Join(logged, "\n"))
 	}
 }
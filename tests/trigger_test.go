@@ -2,14 +2,18 @@ package tests
 
 import (
 	"seng468/transaction-server/trigger"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/shopspring/decimal"
 )
 
-func Callback(t *testing.T, expected *triggers.Trigger, called *bool) func(trigger *transactionserver.Trigger) {
-	return func(trigger *triggers.Trigger) {
+func Callback(t *testing.T, expected *triggers.Trigger, called *bool, mu *sync.Mutex) triggers.Action {
+	return func(trigger *triggers.Trigger, price decimal.Decimal) {
+		if !price.Equal(decimal.NewFromFloat(19.00)) {
+			t.Error("Price that crossed the trigger does not match")
+		}
 		if expected.User != trigger.User {
 			t.Error("User name does not match")
 		}
@@ -19,47 +23,126 @@ func Callback(t *testing.T, expected *triggers.Trigger, called *bool) func(trigg
 		if expected.TransNum != trigger.TransNum {
 			t.Error("Transaction number does not match")
 		}
-		if expected.QuoteClient != trigger.QuoteClient {
-			t.Error("Quote client does not match")
-		}
-		if expected.BuySellAmount != trigger.BuySellAmount {
+		if !expected.BuySellAmount.Equal(trigger.BuySellAmount) {
 			t.Error("Buy amount does not match")
 		}
-		if expected.TriggerAmount != trigger.TriggerAmount {
+		if !expected.TriggerAmount.Equal(trigger.TriggerAmount) {
 			t.Error("Trigger amount does not match")
 		}
 		if expected.TriggerType != trigger.TriggerType {
-			t.Error("Trigger amount does not match")
+			t.Error("Trigger type does not match")
 		}
+		mu.Lock()
 		*called = true
+		mu.Unlock()
 	}
 }
 
 func TestTrigger_Buy(t *testing.T) {
 	mockQuote := NewMockQuoteClient()
 	mockQuote.addRule("ABC", decimal.NewFromFloat(21.00))
+	engine := triggers.NewEngine(mockQuote, 10*time.Millisecond)
+	go engine.Run()
+	defer engine.Stop()
+
 	buyAmount := decimal.NewFromFloat(10.00)
 	triggerAmount := decimal.NewFromFloat(20.00)
-	expected := &transactionserver.Trigger{
+	expected := &triggers.Trigger{
 		User:          "user",
 		Stock:         "ABC",
 		TransNum:      1,
-		QuoteClient:   mockQuote,
 		BuySellAmount: buyAmount,
 		TriggerAmount: triggerAmount,
 		TriggerType:   "BUY",
 	}
+	var mu sync.Mutex
 	called := false
-	trig := transactionserver.NewBuyTrigger("user", "ABC", mockQuote, buyAmount, Callback(t, expected, &called))
-	time.Sleep(time.Second)
+	isCalled := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return called
+	}
+	trig := triggers.NewBuyTrigger("user", "ABC", engine, buyAmount, Callback(t, expected, &called, &mu))
+	time.Sleep(50 * time.Millisecond)
 	trig.Start(triggerAmount, 1)
-	time.Sleep(time.Second)
-	if called {
+	time.Sleep(50 * time.Millisecond)
+	if isCalled() {
 		t.Error("Trigger called too early")
 	}
 	mockQuote.addRule("ABC", decimal.NewFromFloat(19.00))
-	time.Sleep(time.Second * 3)
-	if !called {
-		t.Error("Trigger was never called")
+	waitFor(t, "the trigger to be called", isCalled)
+}
+
+func TestTrigger_CancelRace(t *testing.T) {
+	mockQuote := NewMockQuoteClient()
+	mockQuote.addRule("ABC", decimal.NewFromFloat(5.00))
+	engine := triggers.NewEngine(mockQuote, 10*time.Millisecond)
+	go engine.Run()
+	defer engine.Stop()
+
+	var mu sync.Mutex
+	executed := 0
+	action := func(trig *triggers.Trigger, price decimal.Decimal) {
+		mu.Lock()
+		executed++
+		mu.Unlock()
+	}
+	hasExecuted := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return executed > 0
+	}
+
+	// A trigger that has executed can't be cancelled or started again
+	fired := triggers.NewBuyTrigger("user", "ABC", engine, decimal.NewFromFloat(10.00), action)
+	fired.Start(decimal.NewFromFloat(6.00), 1)
+	waitFor(t, "the trigger to be called", hasExecuted)
+	if fired.Cancel() {
+		t.Error("Cancelling an executed trigger should fail")
+	}
+	if fired.Start(decimal.NewFromFloat(6.00), 2) {
+		t.Error("Starting an executed trigger should fail")
+	}
+
+	// A cancelled trigger never executes, and can only be cancelled once
+	cancelled := triggers.NewBuyTrigger("user", "ABC", engine, decimal.NewFromFloat(10.00), action)
+	cancelled.Start(decimal.NewFromFloat(4.00), 3)
+	if !cancelled.Cancel() {
+		t.Error("Cancelling an armed trigger should succeed")
+	}
+	if cancelled.Cancel() || cancelled.Start(decimal.NewFromFloat(6.00), 4) {
+		t.Error("A cancelled trigger should stay cancelled")
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if executed != 1 {
+		t.Error("Expected only the first trigger to execute, got", executed)
+	}
+}
+
+func TestTrigger_QuoteFailed(t *testing.T) {
+	mockQuote := NewMockQuoteClient()
+	engine := triggers.NewEngine(mockQuote, 10*time.Millisecond)
+	var mu sync.Mutex
+	var failed *triggers.Trigger
+	engine.QuoteFailed = func(trig *triggers.Trigger, err error) {
+		mu.Lock()
+		failed = trig
+		mu.Unlock()
+	}
+	go engine.Run()
+	defer engine.Stop()
+
+	trig := triggers.NewSellTrigger("user", "ABC", engine, decimal.NewFromFloat(10.00),
+		func(*triggers.Trigger, decimal.Decimal) { t.Error("Trigger should not execute without a quote") })
+	trig.Start(decimal.NewFromFloat(20.00), 1)
+	waitFor(t, "the failed quote to be reported", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed == trig
+	})
+	if !trig.Active() {
+		t.Error("Trigger should stay armed after a failed quote")
 	}
 }
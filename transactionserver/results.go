@@ -0,0 +1,43 @@
+package transactionserver
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// FundsResult is the reply to ADD
+type FundsResult struct {
+	Added decimal.Decimal `json:"added"`
+}
+
+// QuoteResult is the reply to QUOTE
+type QuoteResult struct {
+	Stock string          `json:"stock"`
+	Price decimal.Decimal `json:"price"`
+}
+
+// Legacy replies with the price, as QUOTE did before responses had a format
+func (r QuoteResult) Legacy() string {
+	return r.Price.StringFixed(2)
+}
+
+// OrderResult is the reply to BUY, SELL and committing or cancelling them
+type OrderResult struct {
+	Stock   string           `json:"stock"`
+	Shares  decimal.Decimal  `json:"shares"`
+	Cost    decimal.Decimal  `json:"cost"`
+	Balance *decimal.Decimal `json:"balance,omitempty"`
+	Held    *decimal.Decimal `json:"held,omitempty"`
+}
+
+// TriggerResult is the reply to setting or cancelling a buy or sell trigger
+type TriggerResult struct {
+	Stock        string           `json:"stock"`
+	Amount       decimal.Decimal  `json:"amount"`
+	TriggerPrice *decimal.Decimal `json:"triggerPrice,omitempty"`
+}
+
+// FlushResult is the reply to FLUSH_QUOTE
+type FlushResult struct {
+	Stock   string `json:"stock"`
+	Flushed bool   `json:"flushed"`
+}
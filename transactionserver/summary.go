@@ -0,0 +1,134 @@
+package transactionserver
+
+import (
+	"encoding/json"
+	"seng468/transaction-server/database"
+	"seng468/transaction-server/trigger"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/sync/syncmap"
+)
+
+// Summary is the report returned by DISPLAY_SUMMARY
+type Summary struct {
+	User           string                     `json:"user"`
+	Balance        decimal.Decimal            `json:"balance"`
+	ReserveBalance decimal.Decimal            `json:"reserveBalance"`
+	Stocks         map[string]decimal.Decimal `json:"stocks"`
+	ReservedStocks map[string]decimal.Decimal `json:"reservedStocks"`
+	PendingBuys    []SummaryOrder             `json:"pendingBuys"`
+	PendingSells   []SummaryOrder             `json:"pendingSells"`
+	BuyTriggers    []SummaryTrigger           `json:"buyTriggers"`
+	SellTriggers   []SummaryTrigger           `json:"sellTriggers"`
+	History        []SummaryTransaction       `json:"history"`
+}
+
+// Legacy replies with the summary as JSON, since DISPLAY_SUMMARY has no
+// shorter legacy form
+func (s Summary) Legacy() string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+// SummaryOrder is a pending BUY or SELL waiting to be committed
+type SummaryOrder struct {
+	Stock     string          `json:"stock"`
+	Cost      decimal.Decimal `json:"cost"`
+	Shares    decimal.Decimal `json:"shares"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+// SummaryTrigger is a buy or sell trigger set by the user
+type SummaryTrigger struct {
+	Stock        string          `json:"stock"`
+	Amount       decimal.Decimal `json:"amount"`
+	TriggerPrice decimal.Decimal `json:"triggerPrice"`
+	State        string          `json:"state"`
+}
+
+// SummaryTransaction is a completed transaction from the user's history
+type SummaryTransaction struct {
+	Timestamp int64            `json:"timestamp"`
+	TransNum  int              `json:"transactionNum"`
+	Command   string           `json:"command"`
+	Stock     string           `json:"stock,omitempty"`
+	Funds     decimal.Decimal  `json:"funds"`
+	Shares    *decimal.Decimal `json:"shares,omitempty"`
+}
+
+// newSummary builds the summary for a user from their database info and
+// any triggers they have set
+func newSummary(user string, info database.UserInfo, buys []*triggers.Trigger,
+	sells []*triggers.Trigger) Summary {
+	summary := Summary{
+		User:           user,
+		Balance:        info.Balance,
+		ReserveBalance: info.BalanceReserve,
+		Stocks:         info.Stocks,
+		ReservedStocks: info.StocksReserve,
+		PendingBuys:    summaryOrders(info.BuyOrders),
+		PendingSells:   summaryOrders(info.SellOrders),
+		BuyTriggers:    summaryTriggers(buys),
+		SellTriggers:   summaryTriggers(sells),
+		History:        []SummaryTransaction{},
+	}
+	for _, entry := range info.History {
+		transaction := SummaryTransaction{
+			Timestamp: entry.Timestamp,
+			TransNum:  entry.TransNum,
+			Command:   entry.Command,
+			Stock:     entry.Stock,
+			Funds:     entry.Funds,
+		}
+		// Transactions that didn't move any shares leave them out
+		if !entry.Shares.IsZero() {
+			shares := entry.Shares
+			transaction.Shares = &shares
+		}
+		summary.History = append(summary.History, transaction)
+	}
+	return summary
+}
+
+func summaryOrders(orders []database.Order) []SummaryOrder {
+	summary := []SummaryOrder{}
+	for _, order := range orders {
+		summary = append(summary, SummaryOrder{
+			Stock:     order.Stock,
+			Cost:      order.Cost,
+			Shares:    order.Shares,
+			Timestamp: order.Timestamp,
+		})
+	}
+	return summary
+}
+
+func summaryTriggers(trigs []*triggers.Trigger) []SummaryTrigger {
+	summary := []SummaryTrigger{}
+	for _, trig := range trigs {
+		state := "PENDING"
+		if trig.Active() {
+			state = "ACTIVE"
+		}
+		summary = append(summary, SummaryTrigger{
+			Stock:        trig.Stock,
+			Amount:       trig.BuySellAmount,
+			TriggerPrice: trig.TriggerAmount,
+			State:        state,
+		})
+	}
+	return summary
+}
+
+// userTriggers returns all of the triggers in the map that belong to the user
+func userTriggers(user string, trigs *syncmap.Map) []*triggers.Trigger {
+	var found []*triggers.Trigger
+	trigs.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), user+",") {
+			found = append(found, value.(*triggers.Trigger))
+		}
+		return true
+	})
+	return found
+}
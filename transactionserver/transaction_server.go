@@ -0,0 +1,766 @@
+package transactionserver
+
+import (
+	"fmt"
+	"seng468/transaction-server/database"
+	"seng468/transaction-server/logger"
+	"seng468/transaction-server/quote"
+	"seng468/transaction-server/response"
+	"seng468/transaction-server/socketserver"
+	"seng468/transaction-server/trigger"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/sync/syncmap"
+)
+
+// TransactionServer holds the main components of the module itself
+type TransactionServer struct {
+	Name          string
+	Addr          string
+	Server        Router
+	Logger        logger.Logger
+	QuoteClient   quoteclient.QuoteClientI
+	TriggerEngine *triggers.Engine
+	BuyTriggers   *syncmap.Map
+	SellTriggers  *syncmap.Map
+
+	// userDatabase logs every change it makes to funds. It's only used
+	// through accounts, which binds it to the transaction making the change.
+	userDatabase database.AuditedDatabase
+
+	// SharePrecision is the number of decimal places of a share that can be
+	// bought or sold. At 0 only whole shares are traded.
+	SharePrecision int32
+}
+
+// Router registers the handler for each command a TransactionServer runs,
+// such as a socketserver.SocketServer
+type Router interface {
+	Route(pattern string, f socketserver.Handler)
+}
+
+// triggerInterval is how often running triggers are checked against their quote
+const triggerInterval = 200 * time.Millisecond
+
+// NewTransactionServer returns a TransactionServer with its commands
+// registered with the server. Start must be called before running the server.
+// sharePrecision is clamped to database.MaxSharePrecision.
+func NewTransactionServer(name string, addr string, server Router, logger logger.Logger,
+	userDatabase database.UserDatabase, quoteClient quoteclient.QuoteClientI,
+	sharePrecision int32) *TransactionServer {
+	if sharePrecision < 0 {
+		sharePrecision = 0
+	} else if sharePrecision > database.MaxSharePrecision {
+		sharePrecision = database.MaxSharePrecision
+	}
+	ts := &TransactionServer{
+		Name:          name,
+		Addr:          addr,
+		Server:        server,
+		Logger:        logger,
+		QuoteClient:   quoteClient,
+		TriggerEngine: triggers.NewEngine(quoteClient, triggerInterval),
+		BuyTriggers:   new(syncmap.Map),
+		SellTriggers:  new(syncmap.Map),
+
+		userDatabase:   database.NewAuditedDatabase(userDatabase, logger, name, 0),
+		SharePrecision: sharePrecision,
+	}
+	ts.TriggerEngine.QuoteFailed = ts.triggerQuoteFailed
+
+	server.Route("ADD,<user>,<amount>", ts.Add)
+	server.Route("QUOTE,<user>,<stock>", ts.Quote)
+	server.Route("BUY,<user>,<stock>,<amount>", ts.Buy)
+	server.Route("COMMIT_BUY,<user>", ts.CommitBuy)
+	server.Route("CANCEL_BUY,<user>", ts.CancelBuy)
+	server.Route("SELL,<user>,<stock>,<amount>", ts.Sell)
+	server.Route("COMMIT_SELL,<user>", ts.CommitSell)
+	server.Route("CANCEL_SELL,<user>", ts.CancelSell)
+	server.Route("SET_BUY_AMOUNT,<user>,<stock>,<amount>", ts.SetBuyAmount)
+	server.Route("CANCEL_SET_BUY,<user>,<stock>", ts.CancelSetBuy)
+	server.Route("SET_BUY_TRIGGER,<user>,<stock>,<amount>", ts.SetBuyTrigger)
+	server.Route("SET_SELL_AMOUNT,<user>,<stock>,<amount>", ts.SetSellAmount)
+	server.Route("SET_SELL_TRIGGER,<user>,<stock>,<amount>", ts.SetSellTrigger)
+	server.Route("CANCEL_SET_SELL,<user>,<stock>", ts.CancelSetSell)
+	server.Route("DUMPLOG,<user>,<filename>", ts.DumpLogUser)
+	server.Route("DUMPLOG,<filename>", ts.DumpLog)
+	server.Route("DISPLAY_SUMMARY,<user>", ts.DisplaySummary)
+	server.Route("FLUSH_QUOTE,<stock>", ts.FlushQuote)
+	return ts
+}
+
+// Start restores the triggers saved in the database, and starts checking
+// triggers and expiring pending orders in the background
+func (ts TransactionServer) Start() {
+	// The log only has user commands, so errors are logged against the
+	// commands that saved the triggers and reserves
+	err := ts.restoreTriggers()
+	if err != nil {
+		ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: ts.backgroundTransNum(),
+			Command: "SET_BUY_TRIGGER", ErrorMessage: fmt.Sprintf("Error restoring triggers: %s", err.Error())})
+	}
+	_, err = ts.ReconcileReserves()
+	if err != nil {
+		ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: ts.backgroundTransNum(),
+			Command: "SET_BUY_AMOUNT", ErrorMessage: fmt.Sprintf("Error reconciling reserves: %s", err.Error())})
+	}
+
+	go ts.expireOrders(time.Second)
+	go ts.TriggerEngine.Run()
+}
+
+// Add the given amount of money to the user's account
+// Params: user, amount
+// PostCondition: the user's account is increased by the amount of money specified
+func (ts TransactionServer) Add(transNum int, params ...string) response.Response {
+	user := params[0]
+	amount, err := decimal.NewFromString(params[1])
+	if err != nil {
+		return ts.fail(response.BadArguments, transNum, "ADD", user, "", nil,
+			"Could not parse add amount to decimal")
+	}
+	err = ts.accounts(transNum).AddFunds(user, amount)
+	if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "ADD", user, "", &amount,
+			"Failed to add amount to the database for user")
+	}
+	ts.addHistory(transNum, "ADD", user, "", amount, decimal.Decimal{})
+	return response.Success(FundsResult{Added: amount})
+}
+
+// Quote gets the current quote for the stock for the specified user
+// Params: user, stock
+// PostCondition: the current price of the specified stock is displayed to the user
+func (ts TransactionServer) Quote(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	dec, err := ts.QuoteClient.Query(user, stock, transNum)
+	if err != nil {
+		return ts.fail(response.QuoteUnavailable, transNum, "QUOTE", user, stock, nil,
+			err.Error())
+	}
+	return response.Success(QuoteResult{Stock: stock, Price: dec})
+}
+
+// Buy the dollar amount of the stock for the specified user at the current price.
+// Params: user, stock, amount
+// PreCondition: The user's account must be greater or equal to the amount of the purchase.
+// PostCondition: The user is asked to confirm or cancel the transaction
+func (ts TransactionServer) Buy(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	amount, err := decimal.NewFromString(params[2])
+	if err != nil {
+		return ts.fail(response.BadArguments, transNum, "BUY", user, stock, nil,
+			"Could not parse buy amount to decimal")
+	}
+
+	cost, shares, err := ts.getMaxPurchase(user, stock, amount, transNum)
+	if err != nil {
+		return ts.fail(response.QuoteUnavailable, transNum, "BUY", user, stock, &amount,
+			fmt.Sprintf("Error connecting to the quote server: %s", err.Error()))
+	}
+
+	balance, err := ts.accounts(transNum).PlaceBuy(user, stock, cost, shares)
+	if err == database.ErrInsufficientFunds {
+		return ts.fail(response.InsufficientFunds, transNum, "BUY", user, stock, &amount,
+			"Not enough funds to issue buy order")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "BUY", user, stock, &amount,
+			fmt.Sprintf("Error connecting to the database to place buy order: %s", err.Error()))
+	}
+	return response.Success(OrderResult{Stock: stock, Shares: shares, Cost: cost, Balance: &balance})
+}
+
+// CommitBuy commits the most recently executed BUY command
+// Params: user
+// Pre-Conditions: The user must have executed a BUY command within the previous 60 seconds
+// Post-Conditions:
+// 		(a) the user's cash account is decreased by the amount user to purchase the stock
+// 		(b) the user's account for the given stock is increased by the purchase amount
+func (ts TransactionServer) CommitBuy(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock, cost, shares, err := ts.accounts(transNum).CommitBuy(user)
+	if err == database.ErrNoPendingOrder {
+		return ts.fail(response.NoPendingOrder, transNum, "COMMIT_BUY", user, "", nil,
+			"No pending buy orders to commit")
+	} else if err == database.ErrOrderExpired {
+		return ts.fail(response.OrderExpired, transNum, "COMMIT_BUY", user, "", nil,
+			"Pending buy order is older than 60 seconds")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "COMMIT_BUY", user, "", nil,
+			fmt.Sprintf("Error connecting to database to commit buy: %s", err.Error()))
+	}
+	ts.addHistory(transNum, "COMMIT_BUY", user, stock, cost, shares)
+	return response.Success(OrderResult{Stock: stock, Shares: shares, Cost: cost})
+}
+
+// CancelBuy cancels the most recently executed BUY Command
+// Param: user
+// Pre-Condition: The user must have executed a BUY command within the previous 60 seconds
+// Post-Condition: The last BUY command is canceled and any allocated system resources are reset and released.
+func (ts TransactionServer) CancelBuy(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock, cost, shares, err := ts.accounts(transNum).CancelBuy(user)
+	if err == database.ErrNoPendingOrder {
+		return ts.fail(response.NoPendingOrder, transNum, "CANCEL_BUY", user, "", nil,
+			"No pending buy orders to pop")
+	} else if err == database.ErrOrderExpired {
+		return ts.fail(response.OrderExpired, transNum, "CANCEL_BUY", user, "", nil,
+			"Pending buy order is older than 60 seconds")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "CANCEL_BUY", user, "", nil,
+			fmt.Sprintf("Error connecting to database to cancel buy: %s", err.Error()))
+	}
+	return response.Success(OrderResult{Stock: stock, Shares: shares, Cost: cost})
+}
+
+// Sell the specified dollar mount of the stock currently held by the specified
+// user at the current price.
+// Param: user, stock, amount
+// Pre-condition: The user's account for the given stock must be greater than
+// 		or equal to the amount being sold.
+// Post-condition: The user is asked to confirm or cancel the given transaction
+func (ts TransactionServer) Sell(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	amount, err := decimal.NewFromString(params[2])
+	if err != nil {
+		return ts.fail(response.BadArguments, transNum, "SELL", user, stock, nil,
+			"Could not parse sell amount to decimal")
+	}
+	cost, shares, err := ts.getMaxPurchase(user, stock, amount, transNum)
+	if err != nil {
+		return ts.fail(response.QuoteUnavailable, transNum, "SELL", user, stock, &amount,
+			fmt.Sprintf("Could not connect to the quote server: %s", err.Error()))
+	}
+
+	held, err := ts.accounts(transNum).PlaceSell(user, stock, cost, shares)
+	if err == database.ErrInsufficientStock {
+		return ts.fail(response.InsufficientStock, transNum, "SELL", user, stock, &amount,
+			"Cannot sell more stock than you own")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "SELL", user, stock, &amount,
+			fmt.Sprintf("Error placing sell order in database: %s", err.Error()))
+	}
+	return response.Success(OrderResult{Stock: stock, Shares: shares, Cost: cost, Held: &held})
+}
+
+// CommitSell commits the most recently executed SELL command
+// Params: user
+// Pre-Conditions: The user must have executed a SELL command within the previous 60 seconds
+// Post-Conditions:
+// 		(a) the user's account for the given stock is decremented by the sale amount
+// 		(b) the user's cash account is increased by the sell amount
+func (ts TransactionServer) CommitSell(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock, cost, shares, err := ts.accounts(transNum).CommitSell(user)
+	if err == database.ErrNoPendingOrder {
+		return ts.fail(response.NoPendingOrder, transNum, "COMMIT_SELL", user, "", nil,
+			"No pending sell orders to commit")
+	} else if err == database.ErrOrderExpired {
+		return ts.fail(response.OrderExpired, transNum, "COMMIT_SELL", user, "", nil,
+			"Pending sell order is older than 60 seconds")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "COMMIT_SELL", user, "", nil,
+			fmt.Sprintf("Error connecting to database to commit sell: %s", err.Error()))
+	}
+	ts.addHistory(transNum, "COMMIT_SELL", user, stock, cost, shares)
+	return response.Success(OrderResult{Stock: stock, Shares: shares, Cost: cost})
+}
+
+// CancelSell cancels the most recently executed SELL Command
+// Params: user
+// Pre-conditions: The user must have executed a SELL command within the previous 60 seconds
+// Post-conditions: The last SELL command is canceled and any allocated system resources are reset and released.
+func (ts TransactionServer) CancelSell(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock, cost, shares, err := ts.accounts(transNum).CancelSell(user)
+	if err == database.ErrNoPendingOrder {
+		return ts.fail(response.NoPendingOrder, transNum, "CANCEL_SELL", user, "", nil,
+			"No pending sell orders to pop")
+	} else if err == database.ErrOrderExpired {
+		return ts.fail(response.OrderExpired, transNum, "CANCEL_SELL", user, "", nil,
+			"Pending sell order is older than 60 seconds")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "CANCEL_SELL", user, "", nil,
+			fmt.Sprintf("Error connecting to database to cancel sell: %s", err.Error()))
+	}
+	return response.Success(OrderResult{Stock: stock, Shares: shares, Cost: cost})
+}
+
+// SetBuyAmount sets a defined amount of the given stock to buy when the
+// current stock price is less than or equal to the BUY_TRIGGER
+// Params: user, stock, amount
+// Pre-condition: The user's cash account must be greater than or equal to the
+//		BUY amount at the time the transaction occurs, and the user must not
+//		already have a buy trigger set for the stock
+// Post-condition:
+// 		(a) a reserve account is created for the BUY transaction to hold the
+//			specified amount in reserve for when the transaction is triggered
+// 		(b) the user's cash account is decremented by the specified amount
+// 		(c) when the trigger point is reached the user's stock account is
+//			updated to reflect the BUY transaction.
+func (ts TransactionServer) SetBuyAmount(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	amount, err := decimal.NewFromString(params[2])
+	if err != nil {
+		return ts.fail(response.BadArguments, transNum, "SET_BUY_AMOUNT", user, stock, nil,
+			"Could not parse set buy amount to decimal")
+	}
+	if ts.getBuyTrigger(user, stock) != nil {
+		return ts.fail(response.TriggerExists, transNum, "SET_BUY_AMOUNT", user, stock, &amount,
+			"A buy trigger is already set for this user and stock")
+	}
+
+	_, err = ts.accounts(transNum).ReserveFunds(user, amount)
+	if err == database.ErrInsufficientFunds {
+		return ts.fail(response.InsufficientFunds, transNum, "SET_BUY_AMOUNT", user, stock, &amount,
+			"Not enough funds to execute command")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "SET_BUY_AMOUNT", user, stock, &amount,
+			fmt.Sprintf("Error reserving funds in database: %s", err.Error()))
+	}
+
+	trig := triggers.NewBuyTrigger(user, stock, ts.TriggerEngine, amount, ts.buyExecute)
+	trig.TransNum = transNum
+	if _, loaded := ts.BuyTriggers.LoadOrStore(user+","+stock, trig); loaded {
+		// Another SET_BUY_AMOUNT set a trigger while the funds were being
+		// reserved, so they're returned
+		err = ts.accounts(transNum).UnreserveFunds(user, amount)
+		if err != nil {
+			return ts.fail(response.DatabaseError, transNum, "SET_BUY_AMOUNT", user, stock, &amount,
+				fmt.Sprintf("Error returning reserved funds: %s", err.Error()))
+		}
+		return ts.fail(response.TriggerExists, transNum, "SET_BUY_AMOUNT", user, stock, &amount,
+			"A buy trigger is already set for this user and stock")
+	}
+	ts.saveTrigger(trig)
+	return response.Success(TriggerResult{Stock: stock, Amount: amount})
+}
+
+// CancelSetBuy cancels a SET_BUY command issued for the given stock
+// Params: user, stock
+// The must have been a SET_BUY Command issued for the given stock by the user
+// Post-condition:
+// 		(a) All accounts are reset to the values they would have had had the
+//			SET_BUY Command not been issued
+// 		(b) the BUY_TRIGGER for the given user and stock is also canceled.
+func (ts TransactionServer) CancelSetBuy(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+
+	// Once cancelled the trigger can't execute, so only this command returns
+	// its reserve. If it has already executed there's nothing to cancel.
+	trigger := ts.getBuyTrigger(user, stock)
+	if trigger == nil || !trigger.Cancel() {
+		return ts.fail(response.NoTrigger, transNum, "CANCEL_SET_BUY", user, stock, nil,
+			"No existing buy trigger for this user and stock")
+	}
+	ts.BuyTriggers.CompareAndDelete(user+","+stock, trigger)
+	err := ts.accounts(transNum).UnreserveFunds(user, trigger.BuySellAmount)
+	if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "CANCEL_SET_BUY", user, stock, &trigger.BuySellAmount,
+			fmt.Sprintf("Error returning reserved funds:  %s", err.Error()))
+	}
+	ts.deleteTrigger(trigger)
+	return response.Success(TriggerResult{Stock: stock, Amount: trigger.BuySellAmount})
+}
+
+// SetBuyTrigger sets the trigger point base on the current stock price when
+// any SET_BUY will execute.
+// Params: user, stock, amount
+// Pre-conditions: The user must have specified a SET_BUY_AMOUNT prior to
+//		 setting a SET_BUY_TRIGGER
+// Post-conditions: The set of the user's buy triggers is updated to
+//		include the specified trigger
+func (ts TransactionServer) SetBuyTrigger(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	triggerAmount, err := decimal.NewFromString(params[2])
+	if err != nil {
+		return ts.fail(response.BadArguments, transNum, "SET_BUY_TRIGGER", user, stock, nil,
+			"Could not parse set buy trigger amount to decimal")
+	}
+	if !triggerAmount.IsPositive() {
+		return ts.fail(response.BadArguments, transNum, "SET_BUY_TRIGGER", user, stock, nil,
+			"Buy trigger amount must be positive")
+	}
+	trig := ts.getBuyTrigger(user, stock)
+	if trig == nil {
+		return ts.fail(response.NoTrigger, transNum, "SET_BUY_TRIGGER", user, stock, nil,
+			"No existing buy trigger for this user and stock")
+	}
+	if _, shares := ts.sharesAt(trig.BuySellAmount, triggerAmount); shares.IsZero() {
+		return ts.fail(response.BadArguments, transNum, "SET_BUY_TRIGGER", user, stock, &triggerAmount,
+			"Buy amount is not enough for a share at the trigger amount")
+	}
+	if !trig.Start(triggerAmount, transNum) {
+		return ts.fail(response.NoTrigger, transNum, "SET_BUY_TRIGGER", user, stock, nil,
+			"Buy trigger for this user and stock has already executed or been cancelled")
+	}
+	ts.saveTrigger(trig)
+	return response.Success(TriggerResult{Stock: stock, Amount: trig.BuySellAmount, TriggerPrice: &triggerAmount})
+}
+
+// SetSellAmount sets a defined amount of the specified stock to sell when
+// the current stock price is equal or greater than the sell trigger point
+// Params: user, stock, amount
+// Pre-conditions: The user must have the specified amount of stock in their
+//		account for that stock, and must not already have a sell trigger set
+//		for the stock.
+// Post-conditions: A trigger is initialized for this username/stock symbol
+//		combination, but is not complete until SET_SELL_TRIGGER is executed.
+func (ts TransactionServer) SetSellAmount(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	amount, err := decimal.NewFromString(params[2])
+	if err != nil {
+		return ts.fail(response.BadArguments, transNum, "SET_SELL_AMOUNT", user, stock, nil,
+			"Could not parse set sell amount to decimal")
+	}
+
+	_, shares, err := ts.getMaxPurchase(user, stock, amount, transNum)
+	if err != nil {
+		return ts.fail(response.QuoteUnavailable, transNum, "SET_SELL_AMOUNT", user, stock, &amount,
+			fmt.Sprintf("Could not connect to quote server: %s", err.Error()))
+	}
+
+	curr, err := ts.accounts(transNum).GetStock(user, stock)
+	if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "SET_SELL_AMOUNT", user, stock, &amount,
+			fmt.Sprintf("Could not get stock from database: %s", err.Error()))
+	}
+
+	if shares.GreaterThan(curr) {
+		return ts.fail(response.InsufficientStock, transNum, "SET_SELL_AMOUNT", user, stock, &amount,
+			"Cannot set sell trigger for more stock than you own")
+	}
+
+	trig := triggers.NewSellTrigger(user, stock, ts.TriggerEngine, amount, ts.sellExecute)
+	trig.TransNum = transNum
+	if _, loaded := ts.SellTriggers.LoadOrStore(user+","+stock, trig); loaded {
+		return ts.fail(response.TriggerExists, transNum, "SET_SELL_AMOUNT", user, stock, &amount,
+			"A sell trigger is already set for this user and stock")
+	}
+	ts.saveTrigger(trig)
+	return response.Success(TriggerResult{Stock: stock, Amount: amount})
+}
+
+// SetSellTrigger sets the stock price trigger point for executing any
+// SET_SELL triggers associated with the given stock and user
+// Params: user, stock, amount
+// Pre-Conditions: The user must have specified a SET_SELL_AMOUNT prior to
+//		setting a SET_SELL_TRIGGER
+// Post-Conditions:
+// 		(a) a reserve account is created for the specified amount of the
+//			given stock
+// 		(b) the user account for the given stock is reduced by the max number
+//			of stocks that could be purchased and
+// 		(c) the set of the user's sell triggers is updated to include the
+//			specified trigger.
+func (ts TransactionServer) SetSellTrigger(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	amount, err := decimal.NewFromString(params[2])
+	if err != nil {
+		return ts.fail(response.BadArguments, transNum, "SET_SELL_TRIGGER", user, stock, nil,
+			"Could not parse set sell trigger amount to decimal")
+	}
+	// The shares to reserve are worked out at the trigger amount
+	if !amount.IsPositive() {
+		return ts.fail(response.BadArguments, transNum, "SET_SELL_TRIGGER", user, stock, nil,
+			"Sell trigger amount must be positive")
+	}
+
+	trig := ts.getSellTrigger(user, stock)
+	if trig == nil {
+		return ts.fail(response.NoTrigger, transNum, "SET_SELL_TRIGGER", user, stock, nil,
+			"No existing sell trigger for this user and stock")
+	}
+
+	// The trigger sells at the trigger amount or higher, so at most the
+	// shares the sell amount buys at the trigger amount are needed
+	_, shares := ts.sharesAt(trig.BuySellAmount, amount)
+	if shares.IsZero() {
+		return ts.fail(response.BadArguments, transNum, "SET_SELL_TRIGGER", user, stock, &amount,
+			"Sell amount is not worth a share at the trigger amount")
+	}
+	_, err = ts.accounts(transNum).ReserveStock(user, stock, shares)
+	if err == database.ErrInsufficientStock {
+		return ts.fail(response.InsufficientStock, transNum, "SET_SELL_TRIGGER", user, stock, &amount,
+			"Cannot reserve more stock than you own")
+	} else if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "SET_SELL_TRIGGER", user, stock, &amount,
+			fmt.Sprintf("Could not reserve stock in database: %s", err.Error()))
+	}
+
+	if !trig.Start(amount, transNum) {
+		// The trigger executed or was cancelled while the shares were being
+		// reserved, so they're returned
+		err = ts.accounts(transNum).UnreserveStock(user, stock, shares)
+		if err != nil {
+			return ts.fail(response.DatabaseError, transNum, "SET_SELL_TRIGGER", user, stock, &amount,
+				fmt.Sprintf("Could not return reserved stock: %s", err.Error()))
+		}
+		return ts.fail(response.NoTrigger, transNum, "SET_SELL_TRIGGER", user, stock, &amount,
+			"Sell trigger for this user and stock has already executed or been cancelled")
+	}
+	ts.saveTrigger(trig)
+	ts.Logger.Log(logger.SystemEvent{Server: ts.Name, TransactionNum: transNum, Command: "SET_SELL_TRIGGER",
+		Username: user, StockSymbol: stock, Funds: &amount})
+	return response.Success(TriggerResult{Stock: stock, Amount: trig.BuySellAmount, TriggerPrice: &amount})
+}
+
+// CancelSetSell cancels the SET_SELL associated with the given stock and user
+// Pre-Conditions: The user must have had a previously set SET_SELL for the given stock
+// Post-Conditions:
+// 		(a) The set of the user's sell triggers is updated to remove the sell trigger associated with the specified stock
+// 		(b) all user account information is reset to the values they would have been if the given SET_SELL command had not been issued
+func (ts TransactionServer) CancelSetSell(transNum int, params ...string) response.Response {
+	user := params[0]
+	stock := params[1]
+	trigger := ts.getSellTrigger(user, stock)
+	if trigger == nil || !trigger.Cancel() {
+		return ts.fail(response.NoTrigger, transNum, "CANCEL_SET_SELL", user, stock, nil,
+			"No existing sell trigger for this user and stock")
+	}
+	ts.SellTriggers.CompareAndDelete(user+","+stock, trigger)
+
+	// The trigger has been claimed, so nothing else changes its reserve
+	// between reading and returning it
+	reserved, err := ts.accounts(transNum).GetReserveStock(user, stock)
+	if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "CANCEL_SET_SELL", user, stock, nil,
+			fmt.Sprintf("Error getting reserved stock from database:  %s", err.Error()))
+	}
+	err = ts.accounts(transNum).UnreserveStock(user, stock, reserved)
+	if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "CANCEL_SET_SELL", user, stock, nil,
+			fmt.Sprintf("Error returning reserved stock:  %s", err.Error()))
+	}
+
+	ts.deleteTrigger(trigger)
+	return response.Success(TriggerResult{Stock: stock, Amount: trigger.BuySellAmount})
+}
+
+// DumpLogUser Print out the history of the users transactions
+// to the user specified file
+func (ts TransactionServer) DumpLogUser(transNum int, params ...string) response.Response {
+	user := params[0]
+	filename := params[1]
+	go ts.Logger.DumpLog(filename, user)
+	return response.Success(nil)
+}
+
+// DumpLog prints out to the specified file the complete set of transactions
+// that have occurred in the system.
+// Can only be executed from the supervisor (root/administrator) account.
+func (ts TransactionServer) DumpLog(transNum int, params ...string) response.Response {
+	filename := params[0]
+	go ts.Logger.DumpLog(filename, "")
+	return response.Success(nil)
+}
+
+// DisplaySummary provides a summary to the client of the given user's
+// transaction history and the current status of their accounts as well
+// as any set buy or sell triggers and their parameters.
+func (ts TransactionServer) DisplaySummary(transNum int, params ...string) response.Response {
+	user := params[0]
+	info, err := ts.accounts(transNum).GetUserInfo(user)
+	if err != nil {
+		return ts.fail(response.DatabaseError, transNum, "DISPLAY_SUMMARY", user, "", nil,
+			fmt.Sprintf("Error getting user info from database: %s", err.Error()))
+	}
+
+	summary := newSummary(user, info, userTriggers(user, ts.BuyTriggers),
+		userTriggers(user, ts.SellTriggers))
+	return response.Success(summary)
+}
+
+// FlushQuote is an admin command that removes the stock's quote from the
+// cache, so the next QUOTE or trade fetches a new one from the quote server
+// Params: stock
+func (ts TransactionServer) FlushQuote(transNum int, params ...string) response.Response {
+	stock := params[0]
+	ts.Logger.Log(logger.SystemEvent{Server: ts.Name, TransactionNum: transNum, Command: "FLUSH_QUOTE",
+		StockSymbol: stock})
+	flushed := ts.QuoteClient.Flush(stock)
+	return response.Success(FlushResult{Stock: stock, Flushed: flushed})
+}
+
+// accounts returns the user database for a transaction, which logs an
+// accountTransaction event for every change it makes to a user's funds.
+// It's the only way the server reaches the database, so no change goes
+// unlogged.
+func (ts TransactionServer) accounts(transNum int) database.UserDatabase {
+	return ts.userDatabase.ForTransaction(transNum)
+}
+
+// fail logs a failed command as a system error and returns the error
+// response for the client
+func (ts TransactionServer) fail(code response.Code, transNum int, command string,
+	user string, stock string, funds *decimal.Decimal, errorMsg string) response.Response {
+	ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: transNum, Command: command,
+		Username: user, StockSymbol: stock, Funds: funds, ErrorMessage: errorMsg})
+	return response.Error(code, errorMsg)
+}
+
+// fallbackTransNum is what an event outside any command is logged as when a
+// new transaction number can't be assigned, since the log requires every
+// event to have a positive one
+const fallbackTransNum = 1
+
+// backgroundTransNum returns a new transaction number for an event the server
+// logs on its own, outside any command
+func (ts TransactionServer) backgroundTransNum() int {
+	transNum, err := ts.userDatabase.NextTransNum()
+	if err != nil {
+		return fallbackTransNum
+	}
+	return transNum
+}
+
+// addHistory records a completed transaction in the user's history
+func (ts TransactionServer) addHistory(transNum int, command string, user string,
+	stock string, funds decimal.Decimal, shares decimal.Decimal) {
+	err := ts.accounts(transNum).AddHistory(user, database.HistoryEntry{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		TransNum:  transNum,
+		Command:   command,
+		Stock:     stock,
+		Funds:     funds,
+		Shares:    shares,
+	})
+	if err != nil {
+		ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: transNum, Command: command,
+			Username: user, StockSymbol: stock, Funds: &funds,
+			ErrorMessage: fmt.Sprintf("Error adding transaction to history: %s", err.Error())})
+	}
+}
+
+// expireOrders periodically refunds any pending BUY or SELL orders that
+// weren't committed or cancelled within 60 seconds. Each expiry is logged as
+// its own transaction, as a CANCEL_BUY or CANCEL_SELL run by the server.
+func (ts TransactionServer) expireOrders(interval time.Duration) {
+	for range time.Tick(interval) {
+		expired, err := ts.accounts(fallbackTransNum).ExpireOrders(time.Now())
+		if err != nil {
+			ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: ts.backgroundTransNum(),
+				Command: "CANCEL_BUY", ErrorMessage: fmt.Sprintf("Error expiring pending orders: %s", err.Error())})
+		}
+		for _, exp := range expired {
+			// Only an expired buy returns funds; a sell returns shares
+			var funds *decimal.Decimal
+			if exp.Type == "Buy" {
+				funds = &exp.Order.Cost
+			}
+			command := "CANCEL_" + strings.ToUpper(exp.Type)
+			ts.Logger.Log(logger.SystemEvent{Server: ts.Name, TransactionNum: exp.TransNum, Command: command,
+				Username: exp.User, StockSymbol: exp.Order.Stock, Funds: funds})
+		}
+	}
+}
+
+// getBuyTrigger returns a pointer to the running buy trigger that corresponds
+// to the given user, stock combo.
+// If there is not a matching running trigger, returns nil
+func (ts TransactionServer) getBuyTrigger(user string, stock string) *triggers.Trigger {
+	if val, ok := ts.BuyTriggers.Load(user+","+stock); ok {
+		return val.(*triggers.Trigger)
+	}
+	return nil
+}
+
+// getSellTrigger returns a pointer to the running sell trigger that corresponds
+// to the given user, stock combo.
+// If there is not a matching running trigger, returns nil
+func (ts TransactionServer) getSellTrigger(user string, stock string) *triggers.Trigger {
+	if val, ok := ts.SellTriggers.Load(user+","+stock); ok {
+		return val.(*triggers.Trigger)
+	}
+	return nil
+}
+
+// sellExecute sells the shares reserved for the trigger at the price that
+// crossed it. If the sale can't be settled the trigger is retried, unless
+// its reserve is missing.
+func (ts TransactionServer) sellExecute(trigger *triggers.Trigger, price decimal.Decimal) {
+	ts.SellTriggers.CompareAndDelete(trigger.User+","+trigger.Stock, trigger)
+	proceeds, shares := ts.sharesAt(trigger.BuySellAmount, price)
+	err := ts.accounts(trigger.TransNum).FillSellTrigger(trigger.User, trigger.Stock, shares, proceeds)
+	if err != nil {
+		ts.triggerFailed(ts.SellTriggers, trigger, err == database.ErrInsufficientStock, err)
+		return
+	}
+	ts.addHistory(trigger.TransNum, "SELL_TRIGGER", trigger.User, trigger.Stock, proceeds, shares)
+	ts.deleteTrigger(trigger)
+}
+
+// buyExecute buys as many shares as the trigger's reserved funds afford at
+// the price that crossed it. If the purchase can't be settled the trigger is
+// retried, unless its reserve is missing.
+func (ts TransactionServer) buyExecute(trigger *triggers.Trigger, price decimal.Decimal) {
+	ts.BuyTriggers.CompareAndDelete(trigger.User+","+trigger.Stock, trigger)
+	cost, shares := ts.sharesAt(trigger.BuySellAmount, price)
+	err := ts.accounts(trigger.TransNum).FillBuyTrigger(trigger.User, trigger.Stock, trigger.BuySellAmount,
+		cost, shares)
+	if err != nil {
+		ts.triggerFailed(ts.BuyTriggers, trigger, err == database.ErrInsufficientFunds, err)
+		return
+	}
+	ts.addHistory(trigger.TransNum, "BUY_TRIGGER", trigger.User, trigger.Stock, cost, shares)
+	ts.deleteTrigger(trigger)
+}
+
+// triggerFailed logs why an executed trigger couldn't be settled. The trigger
+// is dropped if its reserve doesn't cover it, which would only happen again,
+// and otherwise armed again to be retried.
+func (ts TransactionServer) triggerFailed(running *syncmap.Map, trigger *triggers.Trigger,
+	unbacked bool, err error) {
+	msg := fmt.Sprintf("Error settling executed trigger, retrying: %s", err.Error())
+	if unbacked {
+		msg = "Reserve does not cover executed trigger, dropping it"
+	}
+	ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: trigger.TransNum,
+		Command: "SET_" + trigger.TriggerType + "_TRIGGER", Username: trigger.User, StockSymbol: trigger.Stock,
+		Funds: &trigger.BuySellAmount, ErrorMessage: msg})
+	if unbacked {
+		ts.deleteTrigger(trigger)
+		return
+	}
+	running.LoadOrStore(trigger.User+","+trigger.Stock, trigger)
+	trigger.Retry()
+}
+
+// triggerQuoteFailed logs a quote the trigger engine couldn't get for one
+// of a stock's triggers. The engine tries again on its next tick.
+func (ts TransactionServer) triggerQuoteFailed(trigger *triggers.Trigger, err error) {
+	ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: trigger.TransNum,
+		Command: "SET_" + trigger.TriggerType + "_TRIGGER", Username: trigger.User, StockSymbol: trigger.Stock,
+		ErrorMessage: fmt.Sprintf("Error quoting stock for trigger: %s", err.Error())})
+}
+
+// getMaxPurchase returns the most shares of the stock that amount can buy at
+// its current trading price, to SharePrecision decimal places, along with
+// what those shares cost
+func (ts TransactionServer) getMaxPurchase(user string, stock string, amount decimal.Decimal,
+	transNum int) (money decimal.Decimal, shares decimal.Decimal, err error) {
+	dec, err := ts.QuoteClient.QueryForTrade(user, stock, transNum)
+	if err != nil {
+		return decimal.Decimal{}, decimal.Decimal{}, err
+	}
+	money, shares = ts.sharesAt(amount, dec)
+	return money, shares, nil
+}
+
+// sharesAt returns the most shares that amount can buy at the price, to
+// SharePrecision decimal places, along with what those shares cost
+func (ts TransactionServer) sharesAt(amount decimal.Decimal, price decimal.Decimal) (money decimal.Decimal,
+	shares decimal.Decimal) {
+	shares = amount.Div(price).Truncate(ts.SharePrecision)
+	return price.Mul(shares).Round(2), shares
+}
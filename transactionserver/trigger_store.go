@@ -0,0 +1,129 @@
+package transactionserver
+
+import (
+	"fmt"
+	"seng468/transaction-server/database"
+	"seng468/transaction-server/logger"
+	"seng468/transaction-server/trigger"
+
+	"github.com/shopspring/decimal"
+)
+
+// ReserveMismatch is a reserve account that isn't backed by the user's triggers
+type ReserveMismatch struct {
+	User     string
+	Stock    string
+	Reserved string
+	Backed   string
+}
+
+// saveTrigger persists the current state of a trigger so it can be restored
+// if the server restarts
+func (ts TransactionServer) saveTrigger(trig *triggers.Trigger) {
+	err := ts.accounts(trig.TransNum).SaveTrigger(database.TriggerRecord{
+		Type:          trig.TriggerType,
+		User:          trig.User,
+		Stock:         trig.Stock,
+		TransNum:      trig.TransNum,
+		BuySellAmount: trig.BuySellAmount,
+		TriggerAmount: trig.TriggerAmount,
+		Active:        trig.Active(),
+	})
+	if err != nil {
+		ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: trig.TransNum,
+			Command: "SET_" + trig.TriggerType + "_TRIGGER", Username: trig.User, StockSymbol: trig.Stock,
+			Funds: &trig.BuySellAmount, ErrorMessage: fmt.Sprintf("Error saving trigger to database: %s", err.Error())})
+	}
+}
+
+// deleteTrigger removes a cancelled or executed trigger from the database
+func (ts TransactionServer) deleteTrigger(trig *triggers.Trigger) {
+	err := ts.accounts(trig.TransNum).DeleteTrigger(trig.TriggerType, trig.User, trig.Stock)
+	if err != nil {
+		ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: trig.TransNum,
+			Command: "CANCEL_SET_" + trig.TriggerType, Username: trig.User, StockSymbol: trig.Stock,
+			Funds: &trig.BuySellAmount, ErrorMessage: fmt.Sprintf("Error deleting trigger from database: %s", err.Error())})
+	}
+}
+
+// restoreTriggers reloads all saved triggers from the database, restarting
+// the ones that had a trigger price set
+func (ts TransactionServer) restoreTriggers() error {
+	records, err := ts.accounts(0).GetTriggers()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		var trig *triggers.Trigger
+		if rec.Type == "BUY" {
+			trig = triggers.NewBuyTrigger(rec.User, rec.Stock, ts.TriggerEngine, rec.BuySellAmount, ts.buyExecute)
+			ts.BuyTriggers.Store(rec.User+","+rec.Stock, trig)
+		} else if rec.Type == "SELL" {
+			trig = triggers.NewSellTrigger(rec.User, rec.Stock, ts.TriggerEngine, rec.BuySellAmount, ts.sellExecute)
+			ts.SellTriggers.Store(rec.User+","+rec.Stock, trig)
+		} else {
+			continue
+		}
+
+		trig.TransNum = rec.TransNum
+		if rec.Active {
+			trig.Start(rec.TriggerAmount, rec.TransNum)
+		}
+	}
+	return nil
+}
+
+// ReconcileReserves compares every reserve account against the triggers
+// that should be holding it, and returns any reserved funds or shares that
+// no trigger accounts for, logging an error event for each. It only reports
+// mismatches and never repairs them, since an operator has to decide whether
+// the reserve or the triggers are wrong.
+func (ts TransactionServer) ReconcileReserves() ([]ReserveMismatch, error) {
+	reserves, err := ts.accounts(0).GetReserves()
+	if err != nil {
+		return nil, err
+	}
+
+	backedFunds := make(map[string]decimal.Decimal)
+	ts.BuyTriggers.Range(func(key, value interface{}) bool {
+		trig := value.(*triggers.Trigger)
+		backedFunds[trig.User] = backedFunds[trig.User].Add(trig.BuySellAmount)
+		return true
+	})
+	backedStocks := make(map[string]bool)
+	ts.SellTriggers.Range(func(key, value interface{}) bool {
+		if value.(*triggers.Trigger).Active() {
+			backedStocks[key.(string)] = true
+		}
+		return true
+	})
+
+	var mismatches []ReserveMismatch
+	for user, reserved := range reserves.Funds {
+		if !reserved.Equal(backedFunds[user]) {
+			mismatches = append(mismatches, ReserveMismatch{user, "", reserved.String(),
+				backedFunds[user].String()})
+		}
+	}
+	for user, stocks := range reserves.Stocks {
+		for stock, reserved := range stocks {
+			if !reserved.IsZero() && !backedStocks[user+","+stock] {
+				mismatches = append(mismatches, ReserveMismatch{user, stock, reserved.String(), "0"})
+			}
+		}
+	}
+
+	// Funds are reserved by SET_BUY_AMOUNT and shares by SET_SELL_TRIGGER, so
+	// mismatches are logged against those commands
+	for _, m := range mismatches {
+		command := "SET_BUY_AMOUNT"
+		if m.Stock != "" {
+			command = "SET_SELL_TRIGGER"
+		}
+		msg := fmt.Sprintf("Reserve of %s is not backed by triggers, which account for %s", m.Reserved, m.Backed)
+		ts.Logger.Log(logger.ErrorEvent{Server: ts.Name, TransactionNum: ts.backgroundTransNum(),
+			Command: command, Username: m.User, StockSymbol: m.Stock, ErrorMessage: msg})
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,252 @@
+package triggers
+
+import (
+	"seng468/transaction-server/quote"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Engine watches every armed trigger. Triggers are grouped by stock so that
+// each tick fetches a single quote per stock, no matter how many users have
+// triggers set on it.
+type Engine struct {
+	QuoteClient quoteclient.QuoteClientI
+	Interval    time.Duration
+	// QuoteFailed, if set, is called with the trigger a stock was quoted for
+	// when the quote fails. The stock's triggers are checked again next tick.
+	QuoteFailed func(trig *Trigger, err error)
+	mu          sync.Mutex
+	stocks      map[string]*stockTriggers
+	fired       int64
+	stop        chan bool
+}
+
+// stockTriggers holds the armed triggers for a single stock, each sorted so
+// the triggers closest to executing come first
+type stockTriggers struct {
+	buys  []*Trigger // highest trigger amount first
+	sells []*Trigger // lowest trigger amount first
+}
+
+// EngineMetrics reports the current load on the trigger engine
+type EngineMetrics struct {
+	Stocks     int
+	ArmedBuys  int
+	ArmedSells int
+	Fired      int64
+}
+
+// NewEngine returns an engine that checks its triggers every interval
+func NewEngine(quoteClient quoteclient.QuoteClientI, interval time.Duration) *Engine {
+	return &Engine{
+		QuoteClient: quoteClient,
+		Interval:    interval,
+		stocks:      make(map[string]*stockTriggers),
+		stop:        make(chan bool),
+	}
+}
+
+// Run checks the armed triggers every interval until Stop is called
+func (e *Engine) Run() {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.tick()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the engine's Run loop
+func (e *Engine) Stop() {
+	close(e.stop)
+}
+
+// Metrics returns the number of armed triggers and how many have executed
+func (e *Engine) Metrics() EngineMetrics {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	metrics := EngineMetrics{Stocks: len(e.stocks), Fired: e.fired}
+	for _, st := range e.stocks {
+		metrics.ArmedBuys += len(st.buys)
+		metrics.ArmedSells += len(st.sells)
+	}
+	return metrics
+}
+
+// tick fetches one quote for every stock with armed triggers and executes
+// any triggers that the price has crossed
+func (e *Engine) tick() {
+	e.mu.Lock()
+	watchers := make(map[string]*Trigger, len(e.stocks))
+	for stock, st := range e.stocks {
+		if len(st.buys) > 0 {
+			watchers[stock] = st.buys[0]
+		} else {
+			watchers[stock] = st.sells[0]
+		}
+	}
+	e.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for stock, watcher := range watchers {
+		wg.Add(1)
+		go func(stock string, watcher *Trigger) {
+			defer wg.Done()
+			e.check(stock, watcher)
+		}(stock, watcher)
+	}
+	wg.Wait()
+}
+
+// check quotes the stock on behalf of one of its triggers, then executes
+// every trigger on the stock that the quote has crossed
+func (e *Engine) check(stock string, watcher *Trigger) {
+	quote, err := e.QuoteClient.Query(watcher.User, stock, watcher.TransNum)
+	if err != nil {
+		if e.QuoteFailed != nil {
+			e.QuoteFailed(watcher, err)
+		}
+		return
+	}
+
+	for _, trig := range e.fire(stock, quote) {
+		trig.action(trig, quote)
+	}
+}
+
+// fire disarms and returns every trigger on the stock crossed by the quote.
+// Once fired a trigger can't be started or cancelled, so its action is the
+// only thing left to settle it.
+func (e *Engine) fire(stock string, quote decimal.Decimal) []*Trigger {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st, ok := e.stocks[stock]
+	if !ok {
+		return nil
+	}
+
+	var fired []*Trigger
+	n := 0
+	for n < len(st.buys) && st.buys[n].crossed(quote) {
+		n++
+	}
+	fired = append(fired, st.buys[:n]...)
+	st.buys = append([]*Trigger(nil), st.buys[n:]...)
+
+	n = 0
+	for n < len(st.sells) && st.sells[n].crossed(quote) {
+		n++
+	}
+	fired = append(fired, st.sells[:n]...)
+	st.sells = append([]*Trigger(nil), st.sells[n:]...)
+
+	for _, trig := range fired {
+		trig.active = false
+		trig.done = true
+	}
+	if len(st.buys) == 0 && len(st.sells) == 0 {
+		delete(e.stocks, stock)
+	}
+	e.fired += int64(len(fired))
+	return fired
+}
+
+// arm adds the trigger to its stock's watch list, replacing its previous
+// trigger amount if it was already armed. Returns false if the trigger has
+// fired or been cancelled.
+func (e *Engine) arm(trig *Trigger, amount decimal.Decimal, transNum int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if trig.done {
+		return false
+	}
+	if trig.active {
+		e.remove(trig)
+	}
+	trig.TriggerAmount = amount
+	trig.TransNum = transNum
+	e.insert(trig)
+	return true
+}
+
+// retry arms a fired trigger again at the same trigger amount
+func (e *Engine) retry(trig *Trigger) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if trig.active {
+		return
+	}
+	trig.done = false
+	e.insert(trig)
+}
+
+// insert adds the trigger to its stock's watch list, in order of its
+// trigger amount. The engine must be locked by the caller
+func (e *Engine) insert(trig *Trigger) {
+	amount := trig.TriggerAmount
+	trig.active = true
+
+	st, ok := e.stocks[trig.Stock]
+	if !ok {
+		st = &stockTriggers{}
+		e.stocks[trig.Stock] = st
+	}
+	if trig.TriggerType == "BUY" {
+		i := sort.Search(len(st.buys), func(i int) bool {
+			return st.buys[i].TriggerAmount.LessThan(amount)
+		})
+		st.buys = append(st.buys[:i], append([]*Trigger{trig}, st.buys[i:]...)...)
+	} else {
+		i := sort.Search(len(st.sells), func(i int) bool {
+			return st.sells[i].TriggerAmount.GreaterThan(amount)
+		})
+		st.sells = append(st.sells[:i], append([]*Trigger{trig}, st.sells[i:]...)...)
+	}
+}
+
+// cancel removes the trigger from the engine if it is armed, and stops it
+// from being armed again. Returns false if the trigger has already fired or
+// been cancelled.
+func (e *Engine) cancel(trig *Trigger) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if trig.done {
+		return false
+	}
+	if trig.active {
+		e.remove(trig)
+	}
+	trig.done = true
+	return true
+}
+
+// remove takes an armed trigger out of its stock's watch list
+// The engine must be locked by the caller
+func (e *Engine) remove(trig *Trigger) {
+	st, ok := e.stocks[trig.Stock]
+	if !ok {
+		return
+	}
+	st.buys = removeTrigger(st.buys, trig)
+	st.sells = removeTrigger(st.sells, trig)
+	trig.active = false
+	if len(st.buys) == 0 && len(st.sells) == 0 {
+		delete(e.stocks, trig.Stock)
+	}
+}
+
+func removeTrigger(trigs []*Trigger, trig *Trigger) []*Trigger {
+	for i, t := range trigs {
+		if t == trig {
+			return append(trigs[:i], trigs[i+1:]...)
+		}
+	}
+	return trigs
+}
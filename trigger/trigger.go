@@ -1,86 +1,82 @@
 package triggers
 
 import (
-	"fmt"
-	"seng468/transaction-server/quote"
-	"time"
-
 	"github.com/shopspring/decimal"
 )
 
+// Action executes a trigger once the stock's price crosses its trigger
+// amount, given the quoted price that crossed it
+type Action func(trig *Trigger, price decimal.Decimal)
+
 type Trigger struct {
 	User          string
 	Stock         string
 	TransNum      int
-	QuoteClient   quoteclient.QuoteClientI
 	BuySellAmount decimal.Decimal
 	TriggerAmount decimal.Decimal
-	action        func(trig *Trigger)
+	action        Action
 	TriggerType   string
-	cancel        chan bool
+	engine        *Engine
+	active        bool
+	done          bool
 }
 
-func NewBuyTrigger(user string, stock string, quoteClient quoteclient.QuoteClientI,
-	buySellAmount decimal.Decimal, action func(*Trigger)) *Trigger {
+func NewBuyTrigger(user string, stock string, engine *Engine,
+	buySellAmount decimal.Decimal, action Action) *Trigger {
 	return &Trigger{
 		User:          user,
 		Stock:         stock,
-		QuoteClient:   quoteClient,
+		engine:        engine,
 		BuySellAmount: buySellAmount,
 		action:        action,
 		TriggerType:   "BUY",
 	}
 }
 
-func NewSellTrigger(user string, stock string, quoteClient quoteclient.QuoteClientI,
-	buySellAmount decimal.Decimal, action func(trigger *Trigger)) *Trigger {
+func NewSellTrigger(user string, stock string, engine *Engine,
+	buySellAmount decimal.Decimal, action Action) *Trigger {
 	return &Trigger{
 		User:          user,
 		Stock:         stock,
-		QuoteClient:   quoteClient,
+		engine:        engine,
 		BuySellAmount: buySellAmount,
 		action:        action,
 		TriggerType:   "SELL",
 	}
 }
 
-func (trig Trigger) Start(trigger decimal.Decimal, transNum int) {
-	trig.TriggerAmount = trigger
-	trig.TransNum = transNum
-	trig.cancel = make(chan bool)
-	go func() {
-		for {
-			trig.testTrigger()
-			select {
-			case <-time.After(time.Millisecond * 200):
-			case <-trig.cancel:
-				return
-			}
-		}
-	}()
+// Start arms the trigger with the engine, executing its action once the
+// stock price crosses the trigger amount. Returns false, leaving the trigger
+// as it was, if it has already executed or been cancelled.
+func (trig *Trigger) Start(trigger decimal.Decimal, transNum int) bool {
+	return trig.engine.arm(trig, trigger, transNum)
 }
 
-func (trig Trigger) Cancel() {
-	if trig.cancel != nil {
-		trig.cancel <- true
-	}
+// Cancel disarms the trigger so that it never executes. Returns false if it
+// is too late, because the trigger has already executed or started to, or
+// was cancelled before.
+func (trig *Trigger) Cancel() bool {
+	return trig.engine.cancel(trig)
 }
 
-func (trig Trigger) testTrigger() {
-	quote, err := trig.QuoteClient.Query(trig.User, trig.Stock, trig.TransNum)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
+// Retry re-arms a trigger whose action couldn't be completed, at the trigger
+// amount it fired at, so it executes again the next time the price crosses it
+func (trig *Trigger) Retry() {
+	trig.engine.retry(trig)
+}
 
-	if trig.TriggerType == "BUY" && quote.LessThanOrEqual(trig.TriggerAmount) {
-		trig.action(&trig)
-		trig.cancel <- true
-		return
-	}
+// Active reports whether the trigger has been started and is watching
+// the stock price
+func (trig *Trigger) Active() bool {
+	trig.engine.mu.Lock()
+	defer trig.engine.mu.Unlock()
+	return trig.active
+}
 
-	if trig.TriggerType == "SELL" && quote.GreaterThanOrEqual(trig.TriggerAmount) {
-		trig.action(&trig)
-		trig.cancel <- true
+// crossed reports whether the quoted price has reached the trigger amount
+func (trig *Trigger) crossed(quote decimal.Decimal) bool {
+	if trig.TriggerType == "BUY" {
+		return quote.LessThanOrEqual(trig.TriggerAmount)
 	}
+	return quote.GreaterThanOrEqual(trig.TriggerAmount)
 }